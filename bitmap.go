@@ -0,0 +1,374 @@
+package main
+
+import (
+	"math/bits"
+	"slices"
+)
+
+// Roaring-style compressed bitmap of packet positions within a split. Positions are grouped in
+// chunks of 65536 by their high 16 bits, a chunk is stored as a sorted array of its low 16 bits
+// while it holds at most 4096 positions and as a plain bitmap of 1024 words beyond that.
+type Bitmap struct {
+	keys 		[]uint16
+	containers 	[]*bitmapContainer
+}
+
+const (
+	arrayContainerMax	= 4096
+	bitmapContainerWords	= 1 << 16 / 64
+)
+
+// Either array or words is set
+type bitmapContainer struct {
+	array 	[]uint16
+	words 	[]uint64
+	n 		int
+}
+
+func NewBitmap() *Bitmap {
+	return &Bitmap{}
+}
+
+func (c *bitmapContainer) add(low uint16) {
+	if c.words != nil {
+		w, bit := &c.words[low >> 6], uint64(1) << (low & 63)
+		if *w & bit == 0 {
+			*w |= bit
+			c.n++
+		}
+		return
+	}
+	// Positions are mostly added in order
+	pos := len(c.array)
+	if pos > 0 && c.array[pos - 1] >= low {
+		var found bool
+		pos, found = slices.BinarySearch(c.array, low)
+		if found {
+			return
+		}
+	}
+	if c.n == arrayContainerMax {
+		c.toWords()
+		c.add(low)
+		return
+	}
+	c.array = slices.Insert(c.array, pos, low)
+	c.n++
+}
+
+func (c *bitmapContainer) contains(low uint16) bool {
+	if c.words != nil {
+		return c.words[low >> 6] & (uint64(1) << (low & 63)) != 0
+	}
+	_, found := slices.BinarySearch(c.array, low)
+	return found
+}
+
+func (c *bitmapContainer) toWords() {
+	c.words = make([]uint64, bitmapContainerWords)
+	for _, low := range c.array {
+		c.words[low >> 6] |= uint64(1) << (low & 63)
+	}
+	c.array = nil
+}
+
+// Switches back to an array once the container is small enough
+func (c *bitmapContainer) compact() {
+	if c.words == nil || c.n > arrayContainerMax {
+		return
+	}
+	array := make([]uint16, 0, c.n)
+	c.forEach(func(low uint16) {
+		array = append(array, low)
+	})
+	c.array, c.words = array, nil
+}
+
+func (c *bitmapContainer) forEach(f func(uint16)) {
+	if c.words == nil {
+		for _, low := range c.array {
+			f(low)
+		}
+		return
+	}
+	for i, w := range c.words {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			f(uint16(i * 64 + t))
+			w &= w - 1
+		}
+	}
+}
+
+func (c *bitmapContainer) clone() *bitmapContainer {
+	return &bitmapContainer{
+		array:	slices.Clone(c.array),
+		words:	slices.Clone(c.words),
+		n:		c.n,
+	}
+}
+
+func andContainers(x, y *bitmapContainer) *bitmapContainer {
+	switch {
+	case x.words != nil && y.words != nil:
+		c := &bitmapContainer{words: make([]uint64, bitmapContainerWords)}
+		for i := range c.words {
+			c.words[i] = x.words[i] & y.words[i]
+			c.n += bits.OnesCount64(c.words[i])
+		}
+		c.compact()
+		return c
+	case x.words != nil:
+		x, y = y, x
+		fallthrough
+	case y.words != nil:
+		c := &bitmapContainer{array: make([]uint16, 0, Min(x.n, 1024))}
+		for _, low := range x.array {
+			if y.contains(low) {
+				c.array = append(c.array, low)
+			}
+		}
+		c.n = len(c.array)
+		return c
+	default:
+		c := &bitmapContainer{array: make([]uint16, 0, Min(x.n, y.n))}
+		for i, j := 0, 0; i < len(x.array) && j < len(y.array); {
+			if x.array[i] < y.array[j] {
+				i++
+			} else if x.array[i] > y.array[j] {
+				j++
+			} else {
+				c.array = append(c.array, x.array[i])
+				i++
+				j++
+			}
+		}
+		c.n = len(c.array)
+		return c
+	}
+}
+
+func orContainers(x, y *bitmapContainer) *bitmapContainer {
+	if x.words == nil && y.words == nil && x.n + y.n <= arrayContainerMax {
+		c := &bitmapContainer{array: make([]uint16, 0, x.n + y.n)}
+		i, j := 0, 0
+		for i < len(x.array) && j < len(y.array) {
+			if x.array[i] < y.array[j] {
+				c.array = append(c.array, x.array[i])
+				i++
+			} else if x.array[i] > y.array[j] {
+				c.array = append(c.array, y.array[j])
+				j++
+			} else {
+				c.array = append(c.array, x.array[i])
+				i++
+				j++
+			}
+		}
+		c.array = append(c.array, x.array[i:]...)
+		c.array = append(c.array, y.array[j:]...)
+		c.n = len(c.array)
+		return c
+	}
+	if x.words == nil {
+		x, y = y, x
+	}
+	c := x.clone()
+	if c.words == nil {
+		c.toWords()
+	}
+	if y.words != nil {
+		c.n = 0
+		for i := range c.words {
+			c.words[i] |= y.words[i]
+			c.n += bits.OnesCount64(c.words[i])
+		}
+	} else {
+		for _, low := range y.array {
+			c.add(low)
+		}
+	}
+	c.compact()
+	return c
+}
+
+func (b *Bitmap) container(key uint16) (int, bool) {
+	// Positions are mostly added in order, so try the last container first
+	if n := len(b.keys); n > 0 && b.keys[n - 1] == key {
+		return n - 1, true
+	}
+	return slices.BinarySearch(b.keys, key)
+}
+
+func (b *Bitmap) Add(x uint32) {
+	key := uint16(x >> 16)
+	i, found := b.container(key)
+	if !found {
+		b.keys = slices.Insert(b.keys, i, key)
+		b.containers = slices.Insert(b.containers, i, &bitmapContainer{})
+	}
+	b.containers[i].add(uint16(x))
+}
+
+func (b *Bitmap) Contains(x uint32) bool {
+	if b == nil {
+		return false
+	}
+	i, found := b.container(uint16(x >> 16))
+	return found && b.containers[i].contains(uint16(x))
+}
+
+func (b *Bitmap) Len() int {
+	if b == nil {
+		return 0
+	}
+	n := 0
+	for _, c := range b.containers {
+		n += c.n
+	}
+	return n
+}
+
+// Calls f for every position in increasing order
+func (b *Bitmap) ForEach(f func(uint32)) {
+	if b == nil {
+		return
+	}
+	for i, c := range b.containers {
+		high := uint32(b.keys[i]) << 16
+		c.forEach(func(low uint16) {
+			f(high | uint32(low))
+		})
+	}
+}
+
+func (b *Bitmap) And(o *Bitmap) *Bitmap {
+	ret := NewBitmap()
+	if b == nil || o == nil {
+		return ret
+	}
+	for i, j := 0, 0; i < len(b.keys) && j < len(o.keys); {
+		if b.keys[i] < o.keys[j] {
+			i++
+		} else if b.keys[i] > o.keys[j] {
+			j++
+		} else {
+			if c := andContainers(b.containers[i], o.containers[j]); c.n > 0 {
+				ret.keys = append(ret.keys, b.keys[i])
+				ret.containers = append(ret.containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+func (b *Bitmap) Or(o *Bitmap) *Bitmap {
+	ret := NewBitmap()
+	// A nil bitmap is empty, but must not alias ret, which grows while the keys are merged
+	if b == nil {
+		b = NewBitmap()
+	}
+	if o == nil {
+		o = NewBitmap()
+	}
+	i, j := 0, 0
+	for i < len(b.keys) || j < len(o.keys) {
+		if j == len(o.keys) || (i < len(b.keys) && b.keys[i] < o.keys[j]) {
+			ret.keys = append(ret.keys, b.keys[i])
+			ret.containers = append(ret.containers, b.containers[i].clone())
+			i++
+		} else if i == len(b.keys) || b.keys[i] > o.keys[j] {
+			ret.keys = append(ret.keys, o.keys[j])
+			ret.containers = append(ret.containers, o.containers[j].clone())
+			j++
+		} else {
+			ret.keys = append(ret.keys, b.keys[i])
+			ret.containers = append(ret.containers, orContainers(b.containers[i], o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// Set of packets across splits, as one Bitmap of packet positions per split
+type PacketSet struct {
+	splits []*Bitmap
+}
+
+func NewPacketSet() *PacketSet {
+	return &PacketSet{}
+}
+
+// Bitmap of the split, nil if no packet of it is in the set
+func (s *PacketSet) Split(split_idx int) *Bitmap {
+	if s == nil || split_idx >= len(s.splits) {
+		return nil
+	}
+	return s.splits[split_idx]
+}
+
+// Replaces the packets of a split
+func (s *PacketSet) SetSplit(split_idx int, b *Bitmap) {
+	for len(s.splits) <= split_idx {
+		s.splits = append(s.splits, nil)
+	}
+	s.splits[split_idx] = b
+}
+
+func (s *PacketSet) Add(split_idx int, packet_idx int) {
+	b := s.Split(split_idx)
+	if b == nil {
+		b = NewBitmap()
+		s.SetSplit(split_idx, b)
+	}
+	b.Add(uint32(packet_idx))
+}
+
+func (s *PacketSet) Contains(split_idx int, packet_idx int) bool {
+	return s.Split(split_idx).Contains(uint32(packet_idx))
+}
+
+func (s *PacketSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	n := 0
+	for _, b := range s.splits {
+		n += b.Len()
+	}
+	return n
+}
+
+func (s *PacketSet) And(o *PacketSet) *PacketSet {
+	ret := NewPacketSet()
+	if s == nil || o == nil {
+		return ret
+	}
+	for i := 0; i < Min(len(s.splits), len(o.splits)); i++ {
+		if s.splits[i] != nil && o.splits[i] != nil {
+			ret.SetSplit(i, s.splits[i].And(o.splits[i]))
+		}
+	}
+	return ret
+}
+
+func (s *PacketSet) Or(o *PacketSet) *PacketSet {
+	ret := NewPacketSet()
+	for i := 0; i < Max(len(s.Splits()), len(o.Splits())); i++ {
+		if b := s.Split(i).Or(o.Split(i)); b.Len() > 0 {
+			ret.SetSplit(i, b)
+		}
+	}
+	return ret
+}
+
+// Bitmaps per split, some may be nil
+func (s *PacketSet) Splits() []*Bitmap {
+	if s == nil {
+		return nil
+	}
+	return s.splits
+}
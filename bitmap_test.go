@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestPacketSetOrWithMissingSplits(t *testing.T) {
+	x := NewPacketSet()
+	y := NewPacketSet()
+	// Array and bitmap containers, in two containers of the second split
+	for j := 0; j < 5000; j++ {
+		y.Add(1, j)
+	}
+	y.Add(1, 1 << 16 + 3)
+	y.Add(0, 7)
+
+	for _, got := range []*PacketSet{x.Or(y), y.Or(x)} {
+		if got.Len() != y.Len() {
+			t.Fatalf("Got %d packets, want %d", got.Len(), y.Len())
+		}
+		if !got.Contains(0, 7) || !got.Contains(1, 4999) || !got.Contains(1, 1 << 16 + 3) || got.Contains(1, 5000) {
+			t.Fatal("Union does not have the packets of its operands")
+		}
+	}
+	if got := x.Or(x); got.Len() != 0 {
+		t.Fatalf("Union of empty sets has %d packets", got.Len())
+	}
+}
+
+// Checks b against the positions in want, and that containers are arrays up to arrayContainerMax
+// positions and words beyond
+func checkBitmap(t *testing.T, name string, b *Bitmap, want map[uint32]bool) {
+	t.Helper()
+	if b.Len() != len(want) {
+		t.Fatalf("%s has %d positions, want %d", name, b.Len(), len(want))
+	}
+	for i, c := range b.containers {
+		n := 0
+		c.forEach(func(uint16) { n++ })
+		if n != c.n || n == 0 || (c.words != nil) != (n > arrayContainerMax) || (c.words != nil && c.array != nil) {
+			t.Fatalf("%s: container %d of %d positions has n %d and words %v", name, b.keys[i], n, c.n, c.words != nil)
+		}
+	}
+	sorted := make([]uint32, 0, len(want))
+	for x := range want {
+		sorted = append(sorted, x)
+	}
+	slices.Sort(sorted)
+	got := make([]uint32, 0, len(want))
+	b.ForEach(func(x uint32) { got = append(got, x) })
+	if !slices.Equal(got, sorted) {
+		t.Fatalf("%s iterates over %d positions, want %d in order", name, len(got), len(sorted))
+	}
+	for _, x := range sorted {
+		// Neighbours are outside as often as inside
+		if !b.Contains(x) || b.Contains(x + 1) != want[x + 1] || b.Contains(x - 1) != want[x - 1] {
+			t.Fatalf("%s does not contain %d or its neighbours as it should", name, x)
+		}
+	}
+}
+
+// Draws n positions of chunk key, in random order and some twice
+func addRandom(r *rand.Rand, b *Bitmap, want map[uint32]bool, key uint32, n int) {
+	for len(want) < n || r.IntN(10) == 0 {
+		x := key << 16 | uint32(r.IntN(1 << 16))
+		b.Add(x)
+		want[x] = true
+	}
+}
+
+func TestBitmapContainersCrossThreshold(t *testing.T) {
+	r := SeededRand(1, PacketStream)
+	// Chunk sizes around the threshold and far from it, chunk 2 is empty in every bitmap
+	sizes := []int{1, arrayContainerMax - 1, arrayContainerMax, arrayContainerMax + 1, 10000}
+	bitmaps := make([]*Bitmap, 0, len(sizes) * len(sizes))
+	wants := make([]map[uint32]bool, 0, len(sizes) * len(sizes))
+	for _, n0 := range sizes {
+		for _, n1 := range sizes {
+			b, want := NewBitmap(), make(map[uint32]bool)
+			chunk := make(map[uint32]bool)
+			addRandom(r, b, chunk, 3, n1)
+			maps.Copy(want, chunk)
+			chunk = make(map[uint32]bool)
+			addRandom(r, b, chunk, 0, n0)
+			maps.Copy(want, chunk)
+			checkBitmap(t, fmt.Sprintf("Bitmap of %d and %d", n0, n1), b, want)
+			bitmaps, wants = append(bitmaps, b), append(wants, want)
+		}
+	}
+
+	for i, x := range bitmaps {
+		for j, y := range bitmaps {
+			if (i + j) % 3 != 0 {
+				continue
+			}
+			and, or := make(map[uint32]bool), maps.Clone(wants[i])
+			for v := range wants[j] {
+				if wants[i][v] {
+					and[v] = true
+				}
+				or[v] = true
+			}
+			name := fmt.Sprintf("Bitmaps %d and %d", i, j)
+			checkBitmap(t, name + " intersected", x.And(y), and)
+			checkBitmap(t, name + " united", x.Or(y), or)
+		}
+		checkBitmap(t, "Intersection with nil", x.And(nil), nil)
+		checkBitmap(t, "Union with nil", x.Or(nil), wants[i])
+		checkBitmap(t, "Nil united", (*Bitmap)(nil).Or(x), wants[i])
+	}
+}
+
+func TestBitmapContainerConversions(t *testing.T) {
+	// Arrays turn into words on the position past the threshold, not on adding one twice
+	b, want := NewBitmap(), make(map[uint32]bool)
+	for x := uint32(0); x < arrayContainerMax; x++ {
+		b.Add(x * 2)
+		want[x * 2] = true
+	}
+	b.Add(0)
+	checkBitmap(t, "Full array", b, want)
+	b.Add(1)
+	want[1] = true
+	checkBitmap(t, "Array past the threshold", b, want)
+
+	// Two arrays whose union passes the threshold, and two word containers whose intersection does not
+	odd, even := NewBitmap(), NewBitmap()
+	odd_want, even_want := make(map[uint32]bool), make(map[uint32]bool)
+	for x := uint32(0); x < 6000; x++ {
+		if x % 2 == 1 {
+			odd.Add(x)
+			odd_want[x] = true
+		} else if x < 4000 {
+			even.Add(x)
+			even_want[x] = true
+		}
+	}
+	union := maps.Clone(odd_want)
+	maps.Copy(union, even_want)
+	checkBitmap(t, "Union of arrays", odd.Or(even), union)
+	checkBitmap(t, "Intersection of words and array", odd.Or(even).And(even), even_want)
+	below := NewBitmap()
+	for x := uint32(0); x < 5000; x++ {
+		below.Add(x)
+	}
+	intersection := make(map[uint32]bool)
+	for x := range odd_want {
+		if x < 5000 {
+			intersection[x] = true
+		}
+	}
+	checkBitmap(t, "Intersection of words", below.And(odd.Or(even)).And(odd), intersection)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Simplified form of a composition. Operands of xor, and and or are flattened, deduplicated and sorted,
+// so compositions that the identities below show to compute the same values at the same width get the same key.
+type canonicalTerm struct {
+	// Name of an initial function, binary operation or feature extraction, or "const"
+	op 		string
+	// Parameter of a feature extraction or value of a constant
+	n 		uint64
+	width 	int
+	args 	[]*canonicalTerm
+	key 	string
+}
+
+var bitwise_operations = map[string]bool{
+	"xor":	true,
+	"and":	true,
+	"or":	true,
+}
+
+func newTerm(op string, n uint64, width int, args []*canonicalTerm) *canonicalTerm {
+	t := &canonicalTerm{op, n, width, args, ""}
+	switch {
+	case op == "const":
+		t.key = fmt.Sprintf("const/%d:%d", width, n)
+	case len(args) == 0:
+		t.key = initialByName(op).key
+	case len(args) == 1 && !bitwise_operations[op]:
+		t.key = fmt.Sprintf("%s:%d(%s)", op, n, args[0].key)
+	default:
+		keys := Map[*canonicalTerm, string](args, func(a *canonicalTerm) string {
+			return a.key
+		})
+		t.key = fmt.Sprintf("%s/%d(%s)", op, width, strings.Join(keys, ","))
+	}
+	return t
+}
+
+func constTerm(width int, v uint64) *canonicalTerm {
+	return newTerm("const", v & widthMask(width), width, nil)
+}
+
+func constFunction(v uint64) TypedFunction {
+	return func(*Packet) uint64 { return v }
+}
+
+// Operands of a term under op, treating xorc as xor with a constant
+func flattenTerm(op string, t *canonicalTerm) []*canonicalTerm {
+	if t.op == op && bitwise_operations[op] {
+		return t.args
+	}
+	if op == "xor" && t.op == "xorc" {
+		return []*canonicalTerm{t.args[0], constTerm(t.width, t.n)}
+	}
+	if op == "and" && t.op == "mask" {
+		return []*canonicalTerm{t.args[0], constTerm(t.width, t.n)}
+	}
+	return []*canonicalTerm{t}
+}
+
+func simplifyBinary(op string, a *canonicalTerm, b *canonicalTerm) (*canonicalTerm, error) {
+	width := binaryWidth(a.width, b.width)
+	if a.op == "const" && b.op == "const" {
+		f, err := compileBinary(op, constFunction(a.n), constFunction(b.n), width)
+		if err != nil {
+			return nil, err
+		}
+		return constTerm(width, f(nil)), nil
+	}
+	if bitwise_operations[op] {
+		return simplifyBitwise(op, width, append(flattenTerm(op, a), flattenTerm(op, b)...)), nil
+	}
+	switch op {
+	case "add", "mul":
+		// Operands are sorted by key, with a constant first
+		if b.op == "const" || (a.op != "const" && cmp.Compare(a.key, b.key) > 0) {
+			a, b = b, a
+		}
+		if op == "add" && a.op == "const" && a.n == 0 && b.width == width {
+			return b, nil
+		}
+		if op == "mul" && a.op == "const" && a.n == 0 {
+			return constTerm(width, 0), nil
+		}
+		if op == "mul" && a.op == "const" && a.n == 1 && b.width == width {
+			return b, nil
+		}
+	case "sub":
+		if a.key == b.key {
+			return constTerm(width, 0), nil
+		}
+		if b.op == "const" && b.n == 0 && a.width == width {
+			return a, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown binary operation %q", op)
+	}
+	return newTerm(op, 0, width, []*canonicalTerm{a, b}), nil
+}
+
+// Folds constants, cancels pairs under xor and drops repeats under and and or
+func simplifyBitwise(op string, width int, operands []*canonicalTerm) *canonicalTerm {
+	var c uint64
+	has_const := false
+	if op == "and" {
+		c = widthMask(width)
+	}
+	by_key := make(map[string]*canonicalTerm)
+	n_key := make(map[string]int)
+	for _, x := range operands {
+		if x.op == "const" {
+			has_const = true
+			switch op {
+			case "xor":
+				c ^= x.n
+			case "and":
+				c &= x.n
+			case "or":
+				c |= x.n
+			}
+			continue
+		}
+		by_key[x.key] = x
+		n_key[x.key]++
+	}
+	args := make([]*canonicalTerm, 0, len(by_key))
+	for key, x := range by_key {
+		if op == "xor" && n_key[key] % 2 == 0 {
+			continue
+		}
+		args = append(args, x)
+	}
+	slices.SortFunc(args, func(x, y *canonicalTerm) int {
+		return cmp.Compare(x.key, y.key)
+	})
+
+	// Constants that absorb all operands or leave them unchanged
+	switch {
+	case op == "and" && c == 0, op == "or" && c == widthMask(width):
+		return constTerm(width, c)
+	case op == "and" && c == widthMask(width), op != "and" && c == 0:
+		has_const = false
+	}
+	if len(args) == 0 {
+		return constTerm(width, c)
+	}
+	if len(args) == 1 && args[0].width == width {
+		switch {
+		case !has_const:
+			return args[0]
+		case op == "xor":
+			return newTerm("xorc", c, width, args)
+		case op == "and":
+			return newTerm("mask", c, width, args)
+		}
+	}
+	if has_const {
+		args = append(args, constTerm(width, c))
+	}
+	return newTerm(op, 0, width, args)
+}
+
+func simplifyFeature(op string, n uint64, a *canonicalTerm) (*canonicalTerm, error) {
+	out_width, err := featureWidth(op, n, a.width)
+	if err != nil {
+		return nil, err
+	}
+	if a.op == "const" {
+		return constTerm(out_width, compileFeature(op, n, constFunction(a.n), a.width, out_width)(nil)), nil
+	}
+	switch op {
+	case "lbytes", "rbytes":
+		if out_width == a.width {
+			return a, nil
+		}
+	case "lbitshift", "rbitshift":
+		if n == 0 {
+			return a, nil
+		}
+		if a.op == op {
+			if a.n + n >= uint64(a.width) {
+				return constTerm(a.width, 0), nil
+			}
+			return newTerm(op, a.n + n, a.width, a.args), nil
+		}
+	case "rotl", "rotr":
+		// Rotations right are rotations left by the rest of the width
+		k := n % uint64(a.width)
+		if op == "rotr" {
+			k = (uint64(a.width) - k) % uint64(a.width)
+		}
+		if a.op == "rotl" {
+			k = (k + a.n) % uint64(a.width)
+			a = a.args[0]
+		}
+		if k == 0 {
+			return a, nil
+		}
+		return newTerm("rotl", k, a.width, []*canonicalTerm{a}), nil
+	case "mask":
+		return simplifyBitwise("and", a.width, append(flattenTerm("and", a), constTerm(a.width, n))), nil
+	case "xorc":
+		return simplifyBitwise("xor", a.width, append(flattenTerm("xor", a), constTerm(a.width, n))), nil
+	}
+	return newTerm(op, n, out_width, []*canonicalTerm{a}), nil
+}
+
+func canonicalize(comp *TCPComposition, memo map[*TCPComposition]*canonicalTerm) (*canonicalTerm, error) {
+	if t, ok := memo[comp]; ok {
+		return t, nil
+	}
+	var t, a, b *canonicalTerm
+	var err error
+	switch len(comp.comp) {
+	case 0:
+		init := initialByName(comp.name)
+		if init == nil {
+			return nil, fmt.Errorf("Unknown initial function %q", comp.name)
+		}
+		t = newTerm(init.name, 0, init.width, nil)
+	case 1:
+		op, n, ok := parseFeatureName(comp.name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown feature extraction %q", comp.name)
+		}
+		if a, err = canonicalize(comp.comp[0], memo); err != nil {
+			return nil, err
+		}
+		t, err = simplifyFeature(op, n, a)
+	case 2:
+		if a, err = canonicalize(comp.comp[0], memo); err != nil {
+			return nil, err
+		}
+		if b, err = canonicalize(comp.comp[1], memo); err != nil {
+			return nil, err
+		}
+		t, err = simplifyBinary(comp.name, a, b)
+	default:
+		return nil, fmt.Errorf("Composition %q has %d children", comp.name, len(comp.comp))
+	}
+	if err != nil {
+		return nil, err
+	}
+	memo[comp] = t
+	return t, nil
+}
+
+// Composition computing t from the compositions kept so far, or nil if t needs one that is not kept
+func buildTerm(t *canonicalTerm, kept map[string]*TCPComposition) *TCPComposition {
+	switch {
+	case t.op == "const":
+		return nil
+	case len(t.args) == 0:
+		return &TCPComposition{t.op, []*TCPComposition{}}
+	case len(t.args) == 1 && !bitwise_operations[t.op]:
+		a, ok := kept[t.args[0].key]
+		if !ok {
+			return nil
+		}
+		return &TCPComposition{fmt.Sprintf("%s: %d", t.op, t.n), []*TCPComposition{a}}
+	case len(t.args) < 2:
+		return nil
+	}
+	// Flattened operands are applied from the left, the width of the last application has to match
+	init := t.args[:len(t.args) - 1]
+	last := t.args[len(t.args) - 1]
+	init_width := 0
+	for _, x := range init {
+		init_width = Max(init_width, x.width)
+	}
+	if binaryWidth(init_width, last.width) != t.width {
+		return nil
+	}
+	a, ok := kept[init[0].key]
+	if len(init) > 1 {
+		a, ok = kept[newTerm(t.op, 0, init_width, init).key]
+	}
+	b, ok_b := kept[last.key]
+	if !ok || !ok_b {
+		return nil
+	}
+	return &TCPComposition{t.op, []*TCPComposition{a, b}}
+}
+
+// Nodes of comp as a tree, which is what evaluating it costs
+func countNodes(comp *TCPComposition, memo map[*TCPComposition]int) int {
+	if n, ok := memo[comp]; ok {
+		return n
+	}
+	n := 1
+	for _, child := range comp.comp {
+		n += countNodes(child, memo)
+	}
+	memo[comp] = n
+	return n
+}
+
+// Key of the values of t regardless of its width, which a sign only compares
+func valueKey(t *canonicalTerm) string {
+	if bitwise_operations[t.op] && len(t.args) == 1 {
+		return valueKey(t.args[0])
+	}
+	return t.key
+}
+
+// Functions DeduplicateFunctions does not evaluate or replaces, by reason
+type deduplicateCounts struct {
+	// Same values as an earlier function, at the same width or at another one
+	merged 		int
+	simplified 	int
+	// Constant functions, apart from those merged with an earlier constant
+	constant 	int
+}
+
+// Drops compositions that compute the same values as an earlier one and replaces the others by simpler
+// equivalents where the compositions they need are kept. Children have to be earlier compositions, as
+// Generate_functions and checkpoints keep them, and remain so. Returns the remaining compositions and the
+// positions among them of functions that cannot add signs but that others are built from: constants, and
+// functions with the values of an earlier one at a different width.
+func DeduplicateFunctions(compositions []*TCPComposition) ([]*TCPComposition, map[int]struct{}, error) {
+	ret, skip, counts, err := deduplicateFunctions(compositions)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf(
+		"Canonicalized %d functions: %d merged as duplicates, %d simplified, %d constant, %d kept unevaluated to build others\n",
+		len(compositions), counts.merged, counts.simplified, counts.constant, len(skip),
+	)
+	return ret, skip, nil
+}
+
+func deduplicateFunctions(compositions []*TCPComposition) ([]*TCPComposition, map[int]struct{}, *deduplicateCounts, error) {
+	memo := make(map[*TCPComposition]*canonicalTerm)
+	sizes := make(map[*TCPComposition]int)
+	kept := make(map[string]*TCPComposition)
+	values := make(map[string]struct{})
+	// Composition each original one is replaced by
+	replaced := make(map[*TCPComposition]*TCPComposition)
+	ret := make([]*TCPComposition, 0, len(compositions))
+	skipped := make(map[*TCPComposition]bool)
+	counts := &deduplicateCounts{}
+	for i, comp := range compositions {
+		t, err := canonicalize(comp, memo)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Function %d: %w", i, err)
+		}
+		if existing, ok := kept[t.key]; ok {
+			replaced[comp] = existing
+			counts.merged++
+			continue
+		}
+		// Falls back to the composition itself, with children replaced like it
+		children := make([]*TCPComposition, len(comp.comp))
+		changed := false
+		for j, child := range comp.comp {
+			children[j] = child
+			if r, ok := replaced[child]; ok {
+				children[j] = r
+				changed = changed || r != child
+			}
+		}
+		next := comp
+		if changed {
+			next = &TCPComposition{comp.name, children}
+		}
+		if built := buildTerm(t, kept); built != nil && countNodes(built, sizes) < countNodes(next, sizes) {
+			next = built
+			counts.simplified++
+		}
+		_, seen := values[valueKey(t)]
+		switch {
+		case t.op == "const":
+			skipped[next] = true
+			counts.constant++
+		case seen:
+			skipped[next] = true
+			counts.merged++
+		default:
+			values[valueKey(t)] = struct{}{}
+		}
+		kept[t.key] = next
+		replaced[comp] = next
+		ret = append(ret, next)
+	}
+
+	// Skipped functions are only kept if a later one is built from them
+	needed := make(map[*TCPComposition]bool)
+	n := 0
+	for i := len(ret) - 1; i >= 0; i-- {
+		comp := ret[i]
+		if skipped[comp] && !needed[comp] {
+			continue
+		}
+		for _, child := range comp.comp {
+			needed[child] = true
+		}
+		ret[len(ret) - 1 - n] = comp
+		n++
+	}
+	ret = ret[len(ret) - n:]
+	skip := make(map[int]struct{})
+	for i, comp := range ret {
+		if skipped[comp] {
+			skip[i] = struct{}{}
+		}
+	}
+	return ret, skip, counts, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func canonicalTestTerm(t *testing.T, expr string) *canonicalTerm {
+	t.Helper()
+	_, _, comp, err := ParseFunction(expr)
+	if err != nil {
+		t.Fatalf("%s: %s", expr, err)
+	}
+	term, err := canonicalize(comp, make(map[*TCPComposition]*canonicalTerm))
+	if err != nil {
+		t.Fatalf("%s: %s", expr, err)
+	}
+	return term
+}
+
+func TestCanonicalTermIdentities(t *testing.T) {
+	for _, c := range []struct {
+		a		string
+		b		string
+		same	bool
+	}{
+		{"xor(xor(seq, dst_ip), dst_ip)", "seq", true},
+		{"xor(dst_ip, xor(seq, dst_ip))", "seq", true},
+		{"xor(seq, ttl)", "xor(ttl, seq)", true},
+		{"xor(xor(ttl, seq), ip_id)", "xor(ttl, xor(ip_id, seq))", true},
+		{"and(seq, seq)", "seq", true},
+		{"or(or(seq, ttl), seq)", "or(ttl, seq)", true},
+		{"xorc(xorc(seq, 0xff), 0xff)", "seq", true},
+		{"xor(xorc(seq, 0xf0), xorc(ttl, 0x0f))", "xorc(xor(seq, ttl), 0xff)", true},
+		{"mask(mask(seq, 0xff00), 0x0ff0)", "mask(seq, 0x0f00)", true},
+		{"mask(seq, 0xffffffff)", "seq", true},
+		// lbytes and rbytes of a one-byte value
+		{"lbytes1(ttl)", "ttl", true},
+		{"rbytes2(ttl)", "ttl", true},
+		{"lbytes4(seq)", "seq", true},
+		{"lbytes2(seq)", "seq", false},
+		{"lbytes2(seq)", "rbytes2(seq)", false},
+		// Nested shifts and rotations
+		{"lbitshift2(lbitshift3(seq))", "lbitshift5(seq)", true},
+		{"rbitshift4(rbitshift4(ip_id))", "rbitshift8(ip_id)", true},
+		{"lbitshift1(rbitshift1(seq))", "seq", false},
+		{"lbitshift1(rbitshift1(seq))", "rbitshift1(lbitshift1(seq))", false},
+		{"rotl7(rotl9(seq))", "rotl16(seq)", true},
+		{"rotr8(seq)", "rotl24(seq)", true},
+		{"rotr3(rotl3(ip_id))", "ip_id", true},
+		{"rotl20(rotl20(seq))", "rotl8(seq)", true},
+		{"rotl4(seq)", "rotl4(ip_id)", false},
+		{"add(seq, ttl)", "add(ttl, seq)", true},
+		{"mul(ttl, seq)", "mul(seq, ttl)", true},
+		{"sub(seq, ttl)", "sub(ttl, seq)", false},
+		{"xor(ttl, seq)", "xor(ip_id, seq)", false},
+	} {
+		a, b := canonicalTestTerm(t, c.a), canonicalTestTerm(t, c.b)
+		if (a.key == b.key) != c.same {
+			t.Errorf("%s has key %s, %s has key %s, want same %v", c.a, a.key, c.b, b.key, c.same)
+		}
+	}
+}
+
+func TestCanonicalTermConstants(t *testing.T) {
+	for _, c := range []struct {
+		expr	string
+		width	int
+		value	uint64
+	}{
+		{"xor(ttl, ttl)", 8, 0},
+		{"xor(xor(seq, ttl), xor(ttl, seq))", 32, 0},
+		{"sub(seq, seq)", 32, 0},
+		{"and(mask(seq, 0xff00), mask(seq, 0x00ff))", 32, 0},
+		{"xorc(xor(ttl, ttl), 0xff)", 8, 0xff},
+		{"mask(ttl, 0)", 8, 0},
+		{"mul(sub(ip_id, ip_id), seq)", 32, 0},
+		{"rbitshift20(rbitshift20(seq))", 32, 0},
+		{"lbitshift10(lbitshift6(ip_id))", 16, 0},
+	} {
+		term := canonicalTestTerm(t, c.expr)
+		if term.op != "const" || term.width != c.width || term.n != c.value {
+			t.Errorf("%s has key %s, want the %d-bit constant %d", c.expr, term.key, c.width, c.value)
+		}
+	}
+}
+
+// Signs compare values regardless of width, so functions with the same values at another width share
+// a value key but not a key
+func TestCanonicalValueKeyMixedWidths(t *testing.T) {
+	for _, c := range []struct {
+		a		string
+		b		string
+		same	bool
+	}{
+		{"xor(xor(ttl, seq), seq)", "ttl", true},
+		{"xor(ttl, xor(seq, seq))", "ttl", true},
+		{"or(ip_id, mask(seq, 0))", "ip_id", true},
+		{"xor(xor(ttl, ip_id), xor(ip_id, seq))", "xor(ttl, seq)", true},
+		{"xor(ttl, ip_id)", "xor(ip_id, ttl)", true},
+		{"xor(ttl, xor(seq, seq))", "ip_id", false},
+	} {
+		a, b := canonicalTestTerm(t, c.a), canonicalTestTerm(t, c.b)
+		if a.width != b.width && a.key == b.key {
+			t.Errorf("%s and %s have widths %d and %d but the key %s", c.a, c.b, a.width, b.width, a.key)
+		}
+		if (valueKey(a) == valueKey(b)) != c.same {
+			t.Errorf("%s has value key %s, %s has value key %s, want same %v", c.a, valueKey(a), c.b, valueKey(b), c.same)
+		}
+	}
+}
+
+func TestDeduplicateFunctionsCounts(t *testing.T) {
+	exprs := []string{
+		"ttl",
+		"seq",
+		"xor(ttl, seq)",
+		// Merged into earlier ones
+		"xor(seq, ttl)",
+		"lbytes1(ttl)",
+		// Constant, and merged into that constant
+		"xor(ttl, ttl)",
+		"sub(ttl, ttl)",
+		// The values of ttl at 32 bits, kept unevaluated as the next one is built from it
+		"xor(xor(ttl, seq), seq)",
+		"add(xor(xor(ttl, seq), seq), seq)",
+		// Simplified to xor(ip_id, seq)
+		"ip_id",
+		"xor(xor(ip_id, ttl), xor(ttl, seq))",
+	}
+	// Children are the compositions of earlier positions, as generated
+	compositions := make([]*TCPComposition, 0, len(exprs))
+	by_key := make(map[string]*TCPComposition)
+	var share func(comp *TCPComposition) *TCPComposition
+	share = func(comp *TCPComposition) *TCPComposition {
+		for i, child := range comp.comp {
+			comp.comp[i] = share(child)
+		}
+		key := TCPExpr(comp)
+		if existing, ok := by_key[key]; ok {
+			return existing
+		}
+		by_key[key] = comp
+		return comp
+	}
+	for _, expr := range exprs {
+		_, _, comp, err := ParseFunction(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compositions = append(compositions, share(comp))
+	}
+
+	ret, skip, counts, err := deduplicateFunctions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Map[*TCPComposition, string](ret, TCPExpr)
+	if counts.merged != 4 || counts.constant != 1 || counts.simplified != 1 {
+		t.Errorf("Got %d merged, %d constant and %d simplified, want 4, 1 and 1", counts.merged, counts.constant, counts.simplified)
+	}
+	// Merged functions and constants not needed by others are dropped
+	want := []string{
+		"ttl", "seq", "xor(ttl, seq)", "xor(xor(ttl, seq), seq)", "add(xor(xor(ttl, seq), seq), seq)",
+		"ip_id", "xor(ip_id, seq)",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Got %v, want %v", got, want)
+	}
+	if _, ok := skip[3]; len(skip) != 1 || !ok {
+		t.Fatalf("Got unevaluated positions %v, want 3", skip)
+	}
+	// Every function is either evaluated, merged, constant or not evaluated
+	if n := len(ret) - len(skip) + counts.merged + counts.constant; n != len(compositions) {
+		t.Fatalf("Counts add up to %d of %d functions", n, len(compositions))
+	}
+}
+
+// Every generated function that is not constant is computed by a kept one, and the kept functions
+// compute what their originals did
+func TestDeduplicateFunctionsKeepsValues(t *testing.T) {
+	packets := RandomPackets(SeededRand(3, PacketStream), 300)
+	values := func(comp *TCPComposition) string {
+		f, _, err := CompileComposition(comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		for _, p := range packets {
+			fmt.Fprintf(&b, "%x,", f(p))
+		}
+		return b.String()
+	}
+	names := strings.Split("lbytes1,lbytes2,rbytes1,rbytes2,rotl,rotr,mask,xorc,lbitshift,rbitshift", ",")
+	for seed := uint64(0); seed < 3; seed++ {
+		r := SeededRand(seed, FunctionStream)
+		feature_extractions, err := SelectFeatureExtractions(names, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary_operations, err := SelectBinaryOperations(strings.Split("xor,and,or,add,sub,mul", ","))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, compositions := Generate_functions(r, 2000, 0.5, Initial_set, binary_operations, feature_extractions)
+		ret, skip, counts, err := deduplicateFunctions(compositions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(ret) - len(skip) + counts.merged + counts.constant; n != len(compositions) {
+			t.Fatalf("Counts add up to %d of %d functions", n, len(compositions))
+		}
+		kept := make(map[string]bool)
+		for _, comp := range ret {
+			kept[values(comp)] = true
+		}
+		for _, comp := range compositions {
+			v := values(comp)
+			constant := strings.Repeat(strings.SplitN(v, ",", 2)[0] + ",", len(packets)) == v
+			if !kept[v] && !constant {
+				t.Fatalf("No kept function computes %s", TCPExpr(comp))
+			}
+		}
+		// Kept compositions only refer to earlier ones, which checkpoints rely on
+		if _, err := compositionsToCheckpoint(ret); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Version of the checkpoint format, bumped on incompatible changes
+const CheckpointFormatVersion = 4
+
+// State of Fgpt_ident_iterative after a successful iteration. Packets are not stored, resuming
+// reloads the dataset and removes the packets fingerprinted in every iteration up to the checkpoint.
+type Checkpoint struct {
+	n_samples 				int
+	max_sign 				int
+	n_packets 				int
+	seed 					uint64
+	config 					*Config
+	n_iterations 			int
+	sign_thres 				float64
+	too_many_c 				int
+	too_little_c 			int
+	n_nothing 				int
+	n_fingerprinted_packets int
+	threshold_set 			bool
+	split_sizes 			[]int
+	compositions 			[]*TCPComposition
+	intersections 			[]*Intersection
+	functionResults 		[]*FunctionResult
+	bad_functions 			map[int]struct{}
+	filtered 				[]*PacketSet
+}
+
+// A composition whose args are positions of earlier compositions, as they share subtrees
+type CheckpointFunctionJSON struct {
+	Op   string  `json:"op"`
+	N    *uint64 `json:"n,omitempty"`
+	Args []int   `json:"args,omitempty"`
+}
+
+type CheckpointSignJSON struct {
+	Function int `json:"function"`
+	Value    int `json:"value"`
+}
+
+type CheckpointIntersectionJSON struct {
+	Idxs  []int `json:"idxs"`
+	FIdxs []int `json:"f_idxs"`
+	Size  int   `json:"size"`
+}
+
+type CheckpointFileJSON struct {
+	Version               int                           `json:"version"`
+	Samples               int                           `json:"samples"`
+	MaxSign               int                           `json:"max_sign"`
+	Packets               int                           `json:"packets"`
+	Seed                  uint64                        `json:"seed"`
+	Config                *Config                       `json:"config"`
+	Iterations            int                           `json:"iterations"`
+	SignThres             float64                       `json:"sign_thres"`
+	TooMany               int                           `json:"too_many"`
+	TooLittle             int                           `json:"too_little"`
+	Nothing               int                           `json:"nothing"`
+	FingerprintedPackets  int                           `json:"fingerprinted_packets"`
+	ThresholdSet          bool                          `json:"threshold_set"`
+	SplitSizes            []int                         `json:"split_sizes"`
+	Functions             []*CheckpointFunctionJSON     `json:"functions"`
+	FunctionResults       []*CheckpointSignJSON         `json:"function_results"`
+	Intersections         []*CheckpointIntersectionJSON `json:"intersections"`
+	BadFunctions          []int                         `json:"bad_functions"`
+	// Per successful iteration and split, the increasing positions of the packets removed from the split
+	// as uvarint gaps, base64 in the JSON
+	Filtered              [][][]byte                    `json:"filtered"`
+}
+
+func compositionsToCheckpoint(compositions []*TCPComposition) ([]*CheckpointFunctionJSON, error) {
+	positions := make(map[*TCPComposition]int, len(compositions))
+	functions := make([]*CheckpointFunctionJSON, 0, len(compositions))
+	for i, comp := range compositions {
+		args := make([]int, 0, len(comp.comp))
+		for _, child := range comp.comp {
+			pos, ok := positions[child]
+			if !ok {
+				return nil, fmt.Errorf("Function %d: argument is not an earlier function", i)
+			}
+			args = append(args, pos)
+		}
+		function := &CheckpointFunctionJSON{Args: args}
+		switch len(comp.comp) {
+		case 0:
+			init := initialByName(comp.name)
+			if init == nil {
+				return nil, fmt.Errorf("Function %d: unknown initial function %q", i, comp.name)
+			}
+			function.Op = init.key
+		case 1:
+			op, n, ok := parseFeatureName(comp.name)
+			if !ok {
+				return nil, fmt.Errorf("Function %d: unknown feature extraction %q", i, comp.name)
+			}
+			function.Op, function.N = op, &n
+		default:
+			function.Op = comp.name
+		}
+		positions[comp] = i
+		functions = append(functions, function)
+	}
+	return functions, nil
+}
+
+func compositionsFromCheckpoint(functions []*CheckpointFunctionJSON) ([]*TCPComposition, error) {
+	compositions := make([]*TCPComposition, 0, len(functions))
+	for i, function := range functions {
+		args := make([]*TCPComposition, 0, len(function.Args))
+		for _, pos := range function.Args {
+			if pos < 0 || pos >= i {
+				return nil, fmt.Errorf("Function %d: argument %d is not an earlier function", i, pos)
+			}
+			args = append(args, compositions[pos])
+		}
+		var comp *TCPComposition
+		if init := initialByKey(function.Op); init != nil && len(args) == 0 && function.N == nil {
+			comp = &TCPComposition{init.name, args}
+		} else if _, ok := Binary_operations_by_name[function.Op]; ok && len(args) == 2 && function.N == nil {
+			comp = &TCPComposition{function.Op, args}
+		} else if _, ok := Feature_constructors[function.Op]; ok && len(args) == 1 && function.N != nil {
+			comp = &TCPComposition{fmt.Sprintf("%s: %d", function.Op, *function.N), args}
+		} else {
+			return nil, fmt.Errorf("Function %d: invalid %q with %d arguments", i, function.Op, len(args))
+		}
+		// Checks the parameters of feature extractions
+		if _, _, err := CompileComposition(comp); err != nil {
+			return nil, fmt.Errorf("Function %d: %w", i, err)
+		}
+		compositions = append(compositions, comp)
+	}
+	return compositions, nil
+}
+
+func CheckpointToJSON(c *Checkpoint) (*CheckpointFileJSON, error) {
+	functions, err := compositionsToCheckpoint(c.compositions)
+	if err != nil {
+		return nil, err
+	}
+	file := &CheckpointFileJSON{
+		Version:				CheckpointFormatVersion,
+		Samples:				c.n_samples,
+		MaxSign:				c.max_sign,
+		Packets:				c.n_packets,
+		Seed:					c.seed,
+		Config:					c.config,
+		Iterations:				c.n_iterations,
+		SignThres:				c.sign_thres,
+		TooMany:				c.too_many_c,
+		TooLittle:				c.too_little_c,
+		Nothing:				c.n_nothing,
+		FingerprintedPackets:	c.n_fingerprinted_packets,
+		ThresholdSet:			c.threshold_set,
+		SplitSizes:				c.split_sizes,
+		Functions:				functions,
+		FunctionResults:		make([]*CheckpointSignJSON, 0, len(c.functionResults)),
+		Intersections:			make([]*CheckpointIntersectionJSON, 0, len(c.intersections)),
+		BadFunctions:			make([]int, 0, len(c.bad_functions)),
+		Filtered:				make([][][]byte, 0, len(c.filtered)),
+	}
+	for _, result := range c.functionResults {
+		file.FunctionResults = append(file.FunctionResults, &CheckpointSignJSON{result.index, result.sign.b})
+	}
+	for _, inter := range c.intersections {
+		file.Intersections = append(file.Intersections, &CheckpointIntersectionJSON{inter.idxs, inter.f_idxs, inter.size})
+	}
+	for f_idx := range c.bad_functions {
+		file.BadFunctions = append(file.BadFunctions, f_idx)
+	}
+	slices.Sort(file.BadFunctions)
+	for _, visited := range c.filtered {
+		splits := make([][]byte, len(c.split_sizes))
+		for i := range splits {
+			splits[i] = encodePositions(visited.Split(i))
+		}
+		file.Filtered = append(file.Filtered, splits)
+	}
+	return file, nil
+}
+
+func CheckpointFromJSON(file *CheckpointFileJSON) (*Checkpoint, error) {
+	if file.Version != CheckpointFormatVersion {
+		return nil, fmt.Errorf("Unsupported checkpoint format version %d", file.Version)
+	}
+	if file.Config == nil {
+		return nil, errors.New("Checkpoint has no config")
+	}
+	// Checkpoints written before the scorer was configurable used the default one
+	if file.Config.Signs.Scorer == "" {
+		file.Config.Signs.Scorer = DefaultConfig().Signs.Scorer
+	}
+	if err := file.Config.Validate(); err != nil {
+		return nil, err
+	}
+	compositions, err := compositionsFromCheckpoint(file.Functions)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{
+		n_samples:					file.Samples,
+		max_sign:					file.MaxSign,
+		n_packets:					file.Packets,
+		seed:						file.Seed,
+		config:						file.Config,
+		n_iterations:				file.Iterations,
+		sign_thres:					file.SignThres,
+		too_many_c:					file.TooMany,
+		too_little_c:				file.TooLittle,
+		n_nothing:					file.Nothing,
+		n_fingerprinted_packets:	file.FingerprintedPackets,
+		threshold_set:				file.ThresholdSet,
+		split_sizes:				file.SplitSizes,
+		compositions:				compositions,
+		intersections:				make([]*Intersection, 0, len(file.Intersections)),
+		functionResults:			make([]*FunctionResult, 0, len(file.FunctionResults)),
+		bad_functions:				make(map[int]struct{}),
+		filtered:					make([]*PacketSet, 0, len(file.Filtered)),
+	}
+	for i, result := range file.FunctionResults {
+		if result.Function < 0 || result.Function >= len(compositions) {
+			return nil, fmt.Errorf("Function result %d: unknown function %d", i, result.Function)
+		}
+		// Sign functions are compiled once the checkpoint is resumed
+		c.functionResults = append(c.functionResults, &FunctionResult{
+			sign:	&Sign{b: result.Value},
+			index:	result.Function,
+		})
+	}
+	for i, inter := range file.Intersections {
+		for _, idx := range inter.Idxs {
+			if idx < 0 || idx >= len(c.functionResults) {
+				return nil, fmt.Errorf("Intersection %d: unknown function result %d", i, idx)
+			}
+		}
+		for _, f_idx := range inter.FIdxs {
+			if f_idx < 0 || f_idx >= len(compositions) {
+				return nil, fmt.Errorf("Intersection %d: unknown function %d", i, f_idx)
+			}
+		}
+		// Packets of earlier iterations refer to splits that were filtered since
+		c.intersections = append(c.intersections, &Intersection{
+			idxs:		inter.Idxs,
+			f_idxs:		inter.FIdxs,
+			packets:	NewPacketSet(),
+			size:		inter.Size,
+		})
+	}
+	for _, f_idx := range file.BadFunctions {
+		if f_idx < 0 || f_idx >= len(compositions) {
+			return nil, fmt.Errorf("Unknown bad function %d", f_idx)
+		}
+		c.bad_functions[f_idx] = struct{}{}
+	}
+	// Positions refer to the splits left after the iterations before
+	sizes := slices.Clone(file.SplitSizes)
+	for split_idx, size := range sizes {
+		if size < 0 {
+			return nil, fmt.Errorf("Split %d has negative size %d", split_idx, size)
+		}
+	}
+	for i, splits := range file.Filtered {
+		if len(splits) != len(sizes) {
+			return nil, fmt.Errorf("Iteration %d: expected %d splits, got %d", i, len(sizes), len(splits))
+		}
+		visited := NewPacketSet()
+		for split_idx, data := range splits {
+			positions, err := decodePositions(data, sizes[split_idx])
+			if err != nil {
+				return nil, fmt.Errorf("Iteration %d, split %d: %w", i, split_idx, err)
+			}
+			visited.SetSplit(split_idx, positions)
+			sizes[split_idx] -= positions.Len()
+		}
+		c.filtered = append(c.filtered, visited)
+	}
+	return c, nil
+}
+
+// Positions in b as the first one and the gaps to the next ones, every one a uvarint
+func encodePositions(b *Bitmap) []byte {
+	data := make([]byte, 0, b.Len())
+	prev := uint32(0)
+	b.ForEach(func(p_idx uint32) {
+		data = binary.AppendUvarint(data, uint64(p_idx - prev))
+		prev = p_idx
+	})
+	return data
+}
+
+// Reads positions written by encodePositions, which have to be increasing and below size
+func decodePositions(data []byte, size int) (*Bitmap, error) {
+	b := NewBitmap()
+	p_idx := uint64(0)
+	for first := true; len(data) > 0; first = false {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("Invalid packet positions")
+		}
+		data = data[n:]
+		if !first && gap == 0 {
+			return nil, fmt.Errorf("Packet %d is removed twice", p_idx)
+		}
+		if gap >= uint64(size) - p_idx {
+			return nil, fmt.Errorf("Packet %d is outside the split of %d packets", p_idx + gap, size)
+		}
+		p_idx += gap
+		b.Add(uint32(p_idx))
+	}
+	return b, nil
+}
+
+// Removes the packets fingerprinted up to the checkpoint from splits of the dataset it was written for
+func (c *Checkpoint) restoreSplits(splits []*Split) ([]*Split, error) {
+	sizes := Map[*Split, int](splits, func(s *Split) int {
+		return s.size
+	})
+	if !slices.Equal(sizes, c.split_sizes) {
+		return nil, errors.New("Checkpoint was written for a different dataset, split sizes differ")
+	}
+	for _, visited := range c.filtered {
+		splits = filterSplits(visited, splits)
+	}
+	return splits, nil
+}
+
+// Writes the checkpoint to a temporary file first, so a crash while writing keeps the previous one
+func WriteCheckpoint(path string, c *Checkpoint) error {
+	file, err := CheckpointToJSON(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(file); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	var file CheckpointFileJSON
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c, err := CheckpointFromJSON(&file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Checkpoint of two iterations over splits of 70000 and 10 packets, the second iteration removing
+// packets of what the first one left
+func testCheckpoint() *Checkpoint {
+	first := NewPacketSet()
+	for j := 0; j < 70000; j += 3 {
+		first.Add(0, j)
+	}
+	first.Add(1, 9)
+	second := NewPacketSet()
+	second.Add(0, 0)
+	second.Add(0, 46665)
+	return &Checkpoint{
+		config:			DefaultConfig(),
+		split_sizes:	[]int{70000, 10},
+		bad_functions:	make(map[int]struct{}),
+		filtered:		[]*PacketSet{first, second},
+	}
+}
+
+func roundTripCheckpoint(t *testing.T, file *CheckpointFileJSON) (*Checkpoint, error) {
+	t.Helper()
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	var decoded CheckpointFileJSON
+	if err := json.NewDecoder(&b).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return CheckpointFromJSON(&decoded)
+}
+
+func TestCheckpointFilteredRoundTrip(t *testing.T) {
+	c := testCheckpoint()
+	file, err := CheckpointToJSON(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One byte per position, as the positions of an iteration are close to each other
+	if n := len(file.Filtered[0][0]); n != c.filtered[0].Split(0).Len() {
+		t.Fatalf("Got %d bytes for %d positions", n, c.filtered[0].Split(0).Len())
+	}
+	got, err := roundTripCheckpoint(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.filtered) != len(c.filtered) {
+		t.Fatalf("Got %d iterations, want %d", len(got.filtered), len(c.filtered))
+	}
+	for i, visited := range c.filtered {
+		for split_idx := range c.split_sizes {
+			var want, positions []uint32
+			visited.Split(split_idx).ForEach(func(p_idx uint32) { want = append(want, p_idx) })
+			got.filtered[i].Split(split_idx).ForEach(func(p_idx uint32) { positions = append(positions, p_idx) })
+			if !slices.Equal(positions, want) {
+				t.Fatalf("Iteration %d, split %d: got %d positions, want %d", i, split_idx, len(positions), len(want))
+			}
+		}
+	}
+}
+
+func TestCheckpointFilteredBounds(t *testing.T) {
+	c := testCheckpoint()
+	// The first iteration leaves 46666 packets of the first split and 9 of the second
+	c.filtered[1].Add(0, 46666)
+	file, err := CheckpointToJSON(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := roundTripCheckpoint(t, file); err == nil || !strings.Contains(err.Error(), "outside the split") {
+		t.Fatalf("Expected a position outside the split, got %v", err)
+	}
+
+	c = testCheckpoint()
+	c.filtered[1].Add(1, 9)
+	file, _ = CheckpointToJSON(c)
+	if _, err := roundTripCheckpoint(t, file); err == nil {
+		t.Fatal("Expected an error for a packet the first iteration removed already")
+	}
+
+	file, _ = CheckpointToJSON(testCheckpoint())
+	for _, data := range [][]byte{{0, 0}, {0x80}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}} {
+		file.Filtered[1][0] = data
+		if _, err := roundTripCheckpoint(t, file); err == nil {
+			t.Fatalf("Expected an error for positions %v", data)
+		}
+	}
+
+	file, _ = CheckpointToJSON(testCheckpoint())
+	file.SplitSizes = []int{70000}
+	if _, err := roundTripCheckpoint(t, file); err == nil {
+		t.Fatal("Expected an error for a missing split")
+	}
+
+	// Functions, results and intersections refer to each other by position
+	for _, corrupt := range []struct {
+		change	func(file *CheckpointFileJSON)
+		err		string
+	}{
+		{func(file *CheckpointFileJSON) {}, ""},
+		{func(file *CheckpointFileJSON) { file.FunctionResults[1].Function = 2 }, "Function result 1: unknown function 2"},
+		{func(file *CheckpointFileJSON) { file.Intersections[0].Idxs[1] = 2 }, "Intersection 0: unknown function result 2"},
+		{func(file *CheckpointFileJSON) { file.Intersections[0].FIdxs[1] = 2 }, "Intersection 0: unknown function 2"},
+		{func(file *CheckpointFileJSON) { file.Intersections[0].FIdxs[0] = -1 }, "Intersection 0: unknown function -1"},
+		{func(file *CheckpointFileJSON) { file.BadFunctions = []int{1, 2} }, "Unknown bad function 2"},
+		{func(file *CheckpointFileJSON) { file.BadFunctions = []int{-1} }, "Unknown bad function -1"},
+	} {
+		c := testCheckpoint()
+		c.compositions = []*TCPComposition{{"Get IP Id", []*TCPComposition{}}, {"Get TTL", []*TCPComposition{}}}
+		c.functionResults = []*FunctionResult{{sign: &Sign{b: 54321}, index: 0}, {sign: &Sign{b: 255}, index: 1}}
+		c.intersections = []*Intersection{{idxs: []int{0, 1}, f_idxs: []int{0, 1}, size: 3}}
+		c.bad_functions[1] = struct{}{}
+		file, err := CheckpointToJSON(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt.change(file)
+		_, err = roundTripCheckpoint(t, file)
+		if (err == nil) != (corrupt.err == "") || (err != nil && err.Error() != corrupt.err) {
+			t.Errorf("Got error %v, want %q", err, corrupt.err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Label of the packets no fingerprint matches
+const UnclassifiedLabel = "unclassified"
+
+type Classification struct {
+	// Labels of the fingerprints in their order, then UnclassifiedLabel
+	labels 		[]string
+	// Per label, the packets given the label
+	packets 	[]*PacketSet
+	data 		[]*FingerprintData
+	// Packets with more than one label, by their labels joined with + in label order
+	overlaps 	map[string]int
+	size 		int
+}
+
+func ValidateLabels(labels []string) error {
+	for i, label := range labels {
+		switch {
+		case label == "":
+			return fmt.Errorf("Fingerprint %d has an empty label", i)
+		case label == UnclassifiedLabel:
+			return fmt.Errorf("Label %q is reserved for packets no fingerprint matches", label)
+		case strings.Contains(label, "+"):
+			return fmt.Errorf("Label %q contains '+', which joins the labels of overlaps", label)
+		case slices.Index(labels, label) != i:
+			return fmt.Errorf("Label %q is given twice", label)
+		}
+	}
+	return nil
+}
+
+// Labels packet j of spl with every fingerprint matching it, or only the first one with first_match
+func classify_split(
+	ctx context.Context,
+	split_idx int,
+	spl *Split,
+	labels []string,
+	matchers []FingerprintFunc,
+	first_match bool,
+) *ClassifyResult {
+	n_labels := len(labels) + 1
+	result := &ClassifyResult{
+		split_idx:	split_idx,
+		packets:	make([]*Bitmap, n_labels),
+		data:		make([]*FingerprintData, n_labels),
+		overlaps:	make(map[string]int),
+	}
+	for i := range result.packets {
+		result.packets[i] = NewBitmap()
+		result.data[i] = NewFingerprintData()
+	}
+	matched := make([]int, 0, len(matchers))
+	var p Packet
+	for j := 0; j < spl.size; j++ {
+		if j % 65536 == 0 && ctx.Err() != nil {
+			break
+		}
+		spl.packets.Row(j, &p)
+		matched = matched[:0]
+		for l_idx, f := range matchers {
+			if f(&p) {
+				matched = append(matched, l_idx)
+				if first_match {
+					break
+				}
+			}
+		}
+		if len(matched) == 0 {
+			matched = append(matched, len(labels))
+		}
+		if len(matched) > 1 {
+			names := Map[int, string](matched, func(l_idx int) string {
+				return labels[l_idx]
+			})
+			result.overlaps[strings.Join(names, "+")] += 1
+		}
+		for _, l_idx := range matched {
+			result.packets[l_idx].Add(uint32(j))
+			result.data[l_idx].add(&p)
+		}
+	}
+	return result
+}
+
+// Labels every packet of splits with the fingerprints matching it, in one pass over the packets with
+// n_workers splits classified concurrently. Labels name the fingerprints, and every packet gets the
+// labels of all matching fingerprints in their order, or with first_match only the first of them.
+// Packets and overlaps are merged in split order, so the same splits give the same classification.
+func ClassifySplits(
+	ctx context.Context,
+	splits []*Split,
+	labels []string,
+	fingerprints []*Fingerprint,
+	first_match bool,
+	n_workers int,
+) (*Classification, error) {
+	if len(labels) != len(fingerprints) {
+		return nil, fmt.Errorf("Got %d labels for %d fingerprints", len(labels), len(fingerprints))
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	if n_workers <= 0 {
+		return nil, errors.New("Need at least one classify worker")
+	}
+	matchers := Map[*Fingerprint, FingerprintFunc](fingerprints, func(x *Fingerprint) FingerprintFunc {
+		return FingerprintFromSigns(x.signs)
+	})
+
+	tasks := make(chan *ClassifyJob, len(splits))
+	results := make(chan *ClassifyResult)
+
+	for i := 0; i < n_workers; i++ {
+		go ClassifyWorker(
+			&Worker[*ClassifyJob, *ClassifyResult]{i, tasks, results},
+		)
+	}
+
+	var wg sync.WaitGroup
+	for i, spl := range splits {
+		wg.Add(1)
+		tasks <- &ClassifyJob{
+			ctx:			ctx,
+			split_idx:		i,
+			split:			spl,
+			labels:			labels,
+			matchers:		matchers,
+			first_match:	first_match,
+			wg:				&wg,
+		}
+	}
+	close(tasks)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	by_split := make([]*ClassifyResult, len(splits))
+	for result := range results {
+		by_split[result.split_idx] = result
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c := &Classification{
+		labels:		append(slices.Clone(labels), UnclassifiedLabel),
+		packets:	make([]*PacketSet, len(labels) + 1),
+		data:		make([]*FingerprintData, len(labels) + 1),
+		overlaps:	make(map[string]int),
+		size:		SplitLen(splits),
+	}
+	for l_idx := range c.labels {
+		c.packets[l_idx] = NewPacketSet()
+		c.data[l_idx] = NewFingerprintData()
+	}
+	for split_idx, result := range by_split {
+		for l_idx := range c.labels {
+			c.packets[l_idx].SetSplit(split_idx, result.packets[l_idx])
+			c.data[l_idx].merge(result.data[l_idx])
+		}
+		for key, count := range result.overlaps {
+			c.overlaps[key] += count
+		}
+	}
+	return c, nil
+}
+
+// Labels of packet j of split i, UnclassifiedLabel alone if no fingerprint matches it
+func (c *Classification) Labels(i int, j int) []string {
+	labels := make([]string, 0, 1)
+	for l_idx, label := range c.labels {
+		if c.packets[l_idx].Contains(i, j) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Overlapping label sets, by decreasing number of packets and then by name
+func (c *Classification) sortedOverlaps() []string {
+	keys := make([]string, 0, len(c.overlaps))
+	for key := range c.overlaps {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if c.overlaps[a] != c.overlaps[b] {
+			return c.overlaps[b] - c.overlaps[a]
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+func SprintClassification(c *Classification) string {
+	var b strings.Builder
+	for l_idx, label := range c.labels {
+		fmt.Fprintf(&b, "Label %s:\n%s\n", label, SprintFingerprintData(c.data[l_idx], float64(c.size)))
+	}
+	if len(c.overlaps) > 0 {
+		fmt.Fprintf(&b, "Overlaps:\n")
+		for _, key := range c.sortedOverlaps() {
+			fmt.Fprintf(&b, "  %s: %d\n", key, c.overlaps[key])
+		}
+	}
+	return b.String()
+}
+
+var classificationColumns = []string{"label", "packets", "fraction", "sources", "ports", "overlapping"}
+
+// One row per label with its packets, sources and ports, and how many of its packets have another label too
+func WriteClassificationCSV(w io.Writer, c *Classification) error {
+	overlapping := make(map[string]int)
+	for key, count := range c.overlaps {
+		for _, label := range strings.Split(key, "+") {
+			overlapping[label] += count
+		}
+	}
+	writer := csv.NewWriter(w)
+	if err := writer.Write(classificationColumns); err != nil {
+		return err
+	}
+	for l_idx, label := range c.labels {
+		data := c.data[l_idx]
+		fraction := 0.0
+		if c.size > 0 {
+			fraction = float64(data.n_packets) / float64(c.size)
+		}
+		err := writer.Write([]string{
+			label,
+			strconv.Itoa(data.n_packets),
+			strconv.FormatFloat(fraction, 'f', 6, 64),
+			strconv.Itoa(data.n_sources),
+			strconv.Itoa(data.n_ports),
+			strconv.Itoa(overlapping[label]),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ZMap's packets all go to port 80, so they match both fingerprints
+func classifyTestData(t *testing.T) ([]*Split, []string, []*Fingerprint) {
+	t.Helper()
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.1), MasscanTool(0.1)}, 3, 4000, 8, fixtureStart, time.Hour)
+	labels := []string{"zmap", "port80"}
+	fingerprints := make([]*Fingerprint, len(labels))
+	for i, expr := range []string{"ip_id == 54321 && ttl == 255", "dst_port == 80"} {
+		fgpt, _, err := ParseFingerprint(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[i] = fgpt
+	}
+	return data.splits, labels, fingerprints
+}
+
+// Labels of every packet, matching every fingerprint in turn
+func classifyBruteForce(splits []*Split, labels []string, fingerprints []*Fingerprint, first_match bool) [][][]string {
+	ret := make([][][]string, len(splits))
+	var p Packet
+	for i, spl := range splits {
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			matched := []string{}
+			for l_idx, fgpt := range fingerprints {
+				if FingerprintFromSigns(fgpt.signs)(&p) {
+					matched = append(matched, labels[l_idx])
+					if first_match {
+						break
+					}
+				}
+			}
+			if len(matched) == 0 {
+				matched = append(matched, UnclassifiedLabel)
+			}
+			ret[i] = append(ret[i], matched)
+		}
+	}
+	return ret
+}
+
+func TestClassifySplits(t *testing.T) {
+	splits, labels, fingerprints := classifyTestData(t)
+	for _, first_match := range []bool{false, true} {
+		want := classifyBruteForce(splits, labels, fingerprints, first_match)
+		want_overlaps := make(map[string]int)
+		want_counts := make(map[string]int)
+		for i := range want {
+			for _, matched := range want[i] {
+				if len(matched) > 1 {
+					want_overlaps[strings.Join(matched, "+")]++
+				}
+				for _, label := range matched {
+					want_counts[label]++
+				}
+			}
+		}
+		if first_match != (len(want_overlaps) == 0) || want_counts["zmap"] == 0 || want_counts[UnclassifiedLabel] == 0 {
+			t.Fatalf("Data does not test overlaps: %v, %v", want_overlaps, want_counts)
+		}
+
+		var results []*Classification
+		for _, n_workers := range []int{1, 4} {
+			c, err := ClassifySplits(context.Background(), splits, labels, fingerprints, first_match, n_workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(c.labels, []string{"zmap", "port80", UnclassifiedLabel}) || c.size != SplitLen(splits) {
+				t.Fatalf("Got labels %v over %d packets", c.labels, c.size)
+			}
+			if len(c.overlaps) != len(want_overlaps) || c.overlaps["zmap+port80"] != want_overlaps["zmap+port80"] {
+				t.Errorf("First match %v: got overlaps %v, want %v", first_match, c.overlaps, want_overlaps)
+			}
+			for l_idx, label := range c.labels {
+				if c.data[l_idx].n_packets != want_counts[label] || c.packets[l_idx].Len() != want_counts[label] {
+					t.Errorf("First match %v: label %s has %d packets, want %d", first_match, label, c.data[l_idx].n_packets, want_counts[label])
+				}
+			}
+			for i := range want {
+				for j, matched := range want[i] {
+					if got := c.Labels(i, j); !slices.Equal(got, matched) {
+						t.Fatalf("First match %v: packet %d of split %d has labels %v, want %v", first_match, j, i, got, matched)
+					}
+				}
+			}
+
+			var b bytes.Buffer
+			if err := WriteClassificationCSV(&b, c); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := csv.NewReader(bytes.NewReader(b.Bytes())).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 4 || !slices.Equal(rows[0], classificationColumns) {
+				t.Fatalf("Got CSV %v", rows)
+			}
+			for _, row := range rows[1:] {
+				overlapping := 0
+				for key, count := range want_overlaps {
+					if slices.Contains(strings.Split(key, "+"), row[0]) {
+						overlapping += count
+					}
+				}
+				if row[1] != strconv.Itoa(want_counts[row[0]]) || row[5] != strconv.Itoa(overlapping) {
+					t.Errorf("First match %v: got CSV row %v, want %d packets and %d overlapping", first_match, row, want_counts[row[0]], overlapping)
+				}
+			}
+			results = append(results, c)
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("First match %v: 1 and 4 workers classify differently", first_match)
+		}
+	}
+}
+
+func TestClassifySplitsNoWorkers(t *testing.T) {
+	splits, labels, fingerprints := classifyTestData(t)
+	done := make(chan error)
+	go func() {
+		_, err := ClassifySplits(context.Background(), splits, labels, fingerprints, false, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Classified without workers")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Classifying without workers does not return")
+	}
+}
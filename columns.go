@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// Packets of a split stored column by column, one contiguous slice per Packet field.
+// SrcIp6 and DstIp6 stay nil until the first IPv6 packet, before that every row holds
+// the IPv4-mapped address of SrcIp and DstIp, as set by SetIPv4Addrs.
+type PacketColumns struct {
+	IPId 		[]uint16
+	SrcIp 		[]uint32
+	DstIp 		[]uint32
+	SrcPort 	[]uint16
+	DstPort 	[]uint16
+	Seq 		[]uint32
+	Window 		[]uint16
+	TTL 		[]uint8
+	Flags 		[]uint8
+	Ack 		[]uint32
+	IPLen 		[]uint16
+	MSS 		[]uint16
+	OptLayout 	[]uint32
+	IPv6 		[]bool
+	SrcIp6 		[][16]byte
+	DstIp6 		[][16]byte
+}
+
+func NewPacketColumns(capacity int) *PacketColumns {
+	return &PacketColumns{
+		IPId:		make([]uint16, 0, capacity),
+		SrcIp:		make([]uint32, 0, capacity),
+		DstIp:		make([]uint32, 0, capacity),
+		SrcPort:	make([]uint16, 0, capacity),
+		DstPort:	make([]uint16, 0, capacity),
+		Seq:		make([]uint32, 0, capacity),
+		Window:		make([]uint16, 0, capacity),
+		TTL:		make([]uint8, 0, capacity),
+		Flags:		make([]uint8, 0, capacity),
+		Ack:		make([]uint32, 0, capacity),
+		IPLen:		make([]uint16, 0, capacity),
+		MSS:		make([]uint16, 0, capacity),
+		OptLayout:	make([]uint32, 0, capacity),
+		IPv6:		make([]bool, 0, capacity),
+	}
+}
+
+// Columns holding packets, in order
+func PacketsToColumns(packets []*Packet) *PacketColumns {
+	cols := NewPacketColumns(len(packets))
+	for _, p := range packets {
+		cols.Append(p)
+	}
+	return cols
+}
+
+func (c *PacketColumns) Len() int {
+	return len(c.IPId)
+}
+
+func (c *PacketColumns) Append(p *Packet) {
+	// Addresses set other than through SetIPv4Addrs are kept as they are
+	if c.SrcIp6 == nil && (p.IPv6 || p.SrcIp6 != mappedIPv4(p.SrcIp) || p.DstIp6 != mappedIPv4(p.DstIp)) {
+		c.SrcIp6 = make([][16]byte, 0, cap(c.IPId))
+		c.DstIp6 = make([][16]byte, 0, cap(c.IPId))
+		for i := range c.IPId {
+			c.SrcIp6 = append(c.SrcIp6, mappedIPv4(c.SrcIp[i]))
+			c.DstIp6 = append(c.DstIp6, mappedIPv4(c.DstIp[i]))
+		}
+	}
+	c.IPId = append(c.IPId, p.IPId)
+	c.SrcIp = append(c.SrcIp, p.SrcIp)
+	c.DstIp = append(c.DstIp, p.DstIp)
+	c.SrcPort = append(c.SrcPort, p.SrcPort)
+	c.DstPort = append(c.DstPort, p.DstPort)
+	c.Seq = append(c.Seq, p.Seq)
+	c.Window = append(c.Window, p.Window)
+	c.TTL = append(c.TTL, p.TTL)
+	c.Flags = append(c.Flags, p.Flags)
+	c.Ack = append(c.Ack, p.Ack)
+	c.IPLen = append(c.IPLen, p.IPLen)
+	c.MSS = append(c.MSS, p.MSS)
+	c.OptLayout = append(c.OptLayout, p.OptLayout)
+	c.IPv6 = append(c.IPv6, p.IPv6)
+	if c.SrcIp6 != nil {
+		c.SrcIp6 = append(c.SrcIp6, p.SrcIp6)
+		c.DstIp6 = append(c.DstIp6, p.DstIp6)
+	}
+}
+
+// Fills p with row i, without allocating
+func (c *PacketColumns) Row(i int, p *Packet) {
+	*p = Packet{
+		IPId:		c.IPId[i],
+		SrcIp:		c.SrcIp[i],
+		DstIp:		c.DstIp[i],
+		SrcPort:	c.SrcPort[i],
+		DstPort:	c.DstPort[i],
+		Seq:		c.Seq[i],
+		Window:		c.Window[i],
+		TTL:		c.TTL[i],
+		Flags:		c.Flags[i],
+		Ack:		c.Ack[i],
+		IPLen:		c.IPLen[i],
+		MSS:		c.MSS[i],
+		OptLayout:	c.OptLayout[i],
+		IPv6:		c.IPv6[i],
+	}
+	if c.SrcIp6 != nil {
+		p.SrcIp6, p.DstIp6 = c.SrcIp6[i], c.DstIp6[i]
+	} else {
+		p.SrcIp6, p.DstIp6 = mappedIPv4(p.SrcIp), mappedIPv4(p.DstIp)
+	}
+}
+
+// Row i as a new Packet
+func (c *PacketColumns) Packet(i int) *Packet {
+	p := &Packet{}
+	c.Row(i, p)
+	return p
+}
+
+// New columns holding the given rows, in the given order
+func (c *PacketColumns) Gather(rows []int) *PacketColumns {
+	ret := &PacketColumns{
+		IPId:		gather(c.IPId, rows),
+		SrcIp:		gather(c.SrcIp, rows),
+		DstIp:		gather(c.DstIp, rows),
+		SrcPort:	gather(c.SrcPort, rows),
+		DstPort:	gather(c.DstPort, rows),
+		Seq:		gather(c.Seq, rows),
+		Window:		gather(c.Window, rows),
+		TTL:		gather(c.TTL, rows),
+		Flags:		gather(c.Flags, rows),
+		Ack:		gather(c.Ack, rows),
+		IPLen:		gather(c.IPLen, rows),
+		MSS:		gather(c.MSS, rows),
+		OptLayout:	gather(c.OptLayout, rows),
+		IPv6:		gather(c.IPv6, rows),
+	}
+	if c.SrcIp6 != nil {
+		ret.SrcIp6 = gather(c.SrcIp6, rows)
+		ret.DstIp6 = gather(c.DstIp6, rows)
+	}
+	return ret
+}
+
+func gather[T any](column []T, rows []int) []T {
+	ret := make([]T, len(rows))
+	for i, row := range rows {
+		ret[i] = column[row]
+	}
+	return ret
+}
+
+// Keeps the first n rows
+func (c *PacketColumns) Truncate(n int) {
+	c.IPId = c.IPId[:n]
+	c.SrcIp = c.SrcIp[:n]
+	c.DstIp = c.DstIp[:n]
+	c.SrcPort = c.SrcPort[:n]
+	c.DstPort = c.DstPort[:n]
+	c.Seq = c.Seq[:n]
+	c.Window = c.Window[:n]
+	c.TTL = c.TTL[:n]
+	c.Flags = c.Flags[:n]
+	c.Ack = c.Ack[:n]
+	c.IPLen = c.IPLen[:n]
+	c.MSS = c.MSS[:n]
+	c.OptLayout = c.OptLayout[:n]
+	c.IPv6 = c.IPv6[:n]
+	if c.SrcIp6 != nil {
+		c.SrcIp6 = c.SrcIp6[:n]
+		c.DstIp6 = c.DstIp6[:n]
+	}
+}
+
+func mappedIPv4(ip uint32) (ret [16]byte) {
+	ret[10], ret[11] = 0xff, 0xff
+	binary.BigEndian.PutUint32(ret[12:], ip)
+	return
+}
+
+// Split backed by the columns of packets
+func NewSplit(time string, packets *PacketColumns) *Split {
+	return &Split{
+		packets:	packets,
+		size:		packets.Len(),
+		time:		time,
+	}
+}
+
+// Column-wise evaluation
+
+// Packet function over whole columns, writing the values of rows start up to start + len(out)
+// to out, with len(out) at most ColumnBlock. Values match those of the TypedFunction.
+type ColumnFunction func(cols *PacketColumns, start int, out []uint64)
+
+// Rows evaluated per call of a ColumnFunction
+const ColumnBlock = 1024
+
+var columnBlocks = sync.Pool{
+	New: func() any {
+		return new([ColumnBlock]uint64)
+	},
+}
+
+// Calls yield with the values of f for consecutive blocks of rows, until yield returns false
+func EvalColumns(f ColumnFunction, cols *PacketColumns, yield func(start int, values []uint64) bool) {
+	block := columnBlocks.Get().(*[ColumnBlock]uint64)
+	defer columnBlocks.Put(block)
+	n := cols.Len()
+	for start := 0; start < n; start += ColumnBlock {
+		values := block[:Min(ColumnBlock, n - start)]
+		f(cols, start, values)
+		if !yield(start, values) {
+			return
+		}
+	}
+}
+
+func widenColumn[T uint8 | uint16 | uint32](column []T, start int, out []uint64) {
+	for i, v := range column[start : start + len(out)] {
+		out[i] = uint64(v)
+	}
+}
+
+// Typed initial functions over columns
+func columns_IPId(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.IPId, start, out)
+}
+
+func columns_SrcIp(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.SrcIp, start, out)
+}
+
+func columns_DstIp(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.DstIp, start, out)
+}
+
+func columns_SrcPort(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.SrcPort, start, out)
+}
+
+func columns_DstPort(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.DstPort, start, out)
+}
+
+func columns_Seq(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.Seq, start, out)
+}
+
+func columns_Window(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.Window, start, out)
+}
+
+func columns_TTL(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.TTL, start, out)
+}
+
+func columns_Flags(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.Flags, start, out)
+}
+
+func columns_Ack(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.Ack, start, out)
+}
+
+func columns_IPLen(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.IPLen, start, out)
+}
+
+func columns_MSS(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.MSS, start, out)
+}
+
+func columns_OptLayout(c *PacketColumns, start int, out []uint64) {
+	widenColumn(c.OptLayout, start, out)
+}
+
+// Halves of IPv6 addresses, IPv4-mapped addresses have a zero high half
+func ip6Column(ip6 [][16]byte, ip []uint32, hi bool, start int, out []uint64) {
+	if ip6 == nil {
+		for i, v := range ip[start : start + len(out)] {
+			if hi {
+				out[i] = 0
+			} else {
+				out[i] = 0xffff << 32 | uint64(v)
+			}
+		}
+		return
+	}
+	for i, addr := range ip6[start : start + len(out)] {
+		if hi {
+			out[i] = binary.BigEndian.Uint64(addr[:8])
+		} else {
+			out[i] = binary.BigEndian.Uint64(addr[8:])
+		}
+	}
+}
+
+func columns_SrcIp6Hi(c *PacketColumns, start int, out []uint64) {
+	ip6Column(c.SrcIp6, c.SrcIp, true, start, out)
+}
+
+func columns_SrcIp6Lo(c *PacketColumns, start int, out []uint64) {
+	ip6Column(c.SrcIp6, c.SrcIp, false, start, out)
+}
+
+func columns_DstIp6Hi(c *PacketColumns, start int, out []uint64) {
+	ip6Column(c.DstIp6, c.DstIp, true, start, out)
+}
+
+func columns_DstIp6Lo(c *PacketColumns, start int, out []uint64) {
+	ip6Column(c.DstIp6, c.DstIp, false, start, out)
+}
+
+// Compiles comp for column-wise evaluation, returning the function and the width in bits of its value
+func CompileColumns(comp *TCPComposition) (ColumnFunction, int, error) {
+	if comp == nil {
+		return nil, 0, errors.New("Function has no composition")
+	}
+	switch len(comp.comp) {
+	case 0:
+		init := initialByName(comp.name)
+		if init == nil {
+			return nil, 0, fmt.Errorf("Unknown initial function %q", comp.name)
+		}
+		return init.columns, init.width, nil
+	case 1:
+		op, n, ok := parseFeatureName(comp.name)
+		if !ok {
+			return nil, 0, fmt.Errorf("Unknown feature extraction %q", comp.name)
+		}
+		fa, width, err := CompileColumns(comp.comp[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		out_width, err := featureWidth(op, n, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		return compileColumnFeature(op, n, fa, width, out_width), out_width, nil
+	case 2:
+		fa, width_a, err := CompileColumns(comp.comp[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		fb, width_b, err := CompileColumns(comp.comp[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		width := binaryWidth(width_a, width_b)
+		f, err := compileColumnBinary(comp.name, fa, fb, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, width, nil
+	default:
+		return nil, 0, fmt.Errorf("Composition %q has %d children", comp.name, len(comp.comp))
+	}
+}
+
+// Compiles all compositions for column-wise evaluation, keeping their order
+func CompileColumnFunctions(compositions []*TCPComposition) ([]ColumnFunction, error) {
+	functions := make([]ColumnFunction, len(compositions))
+	for i, comp := range compositions {
+		f, _, err := CompileColumns(comp)
+		if err != nil {
+			return nil, fmt.Errorf("Function %d: %w", i, err)
+		}
+		functions[i] = f
+	}
+	return functions, nil
+}
+
+// Same operations as compileBinary, a block at a time
+func compileColumnBinary(name string, fa ColumnFunction, fb ColumnFunction, width int) (ColumnFunction, error) {
+	m := widthMask(width)
+	var combine func(out []uint64, y []uint64)
+	switch name {
+	case "and":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] &= y[i]
+			}
+		}
+	case "or":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] |= y[i]
+			}
+		}
+	case "xor":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] ^= y[i]
+			}
+		}
+	case "add":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] = (out[i] + y[i]) & m
+			}
+		}
+	case "sub":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] = (out[i] - y[i]) & m
+			}
+		}
+	case "mul":
+		combine = func(out []uint64, y []uint64) {
+			for i := range out {
+				out[i] = (out[i] * y[i]) & m
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown binary operation %q", name)
+	}
+	return func(cols *PacketColumns, start int, out []uint64) {
+		block := columnBlocks.Get().(*[ColumnBlock]uint64)
+		y := block[:len(out)]
+		fa(cols, start, out)
+		fb(cols, start, y)
+		combine(out, y)
+		columnBlocks.Put(block)
+	}, nil
+}
+
+// Same operations as compileFeature, applied in place to the values of the argument
+func compileColumnFeature(op string, n uint64, fa ColumnFunction, width int, out_width int) ColumnFunction {
+	m := widthMask(width)
+	var apply func(out []uint64)
+	switch op {
+	case "lbitshift":
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] = (out[i] << n) & m
+			}
+		}
+	case "rbitshift":
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] >>= n
+			}
+		}
+	case "lbytes":
+		shift := width - out_width
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] >>= shift
+			}
+		}
+	case "rbytes":
+		out_m := widthMask(out_width)
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] &= out_m
+			}
+		}
+	case "rotl", "rotr":
+		k := int(n % uint64(width))
+		if op == "rotr" {
+			k = (width - k) % width
+		}
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] = (out[i] << k | out[i] >> (width - k)) & m
+			}
+		}
+		if width == 64 {
+			apply = func(out []uint64) {
+				for i := range out {
+					out[i] = bits.RotateLeft64(out[i], k)
+				}
+			}
+		}
+	case "mask":
+		c := n & m
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] &= c
+			}
+		}
+	case "xorc":
+		c := n & m
+		apply = func(out []uint64) {
+			for i := range out {
+				out[i] ^= c
+			}
+		}
+	default:
+		panic("Unknown feature extraction")
+	}
+	return func(cols *PacketColumns, start int, out []uint64) {
+		fa(cols, start, out)
+		apply(out)
+	}
+}
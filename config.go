@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tunables of Fgpt_ident_iterative. Defaults are the values the search was developed with,
+// a config file only needs the values it changes.
+type Config struct {
+	Workers 		WorkersConfig 		`yaml:"workers" json:"workers"`
+	Signs 			SignsConfig 		`yaml:"signs" json:"signs"`
+	Threshold 		ThresholdConfig 	`yaml:"threshold" json:"threshold"`
+	Consolidation 	ConsolidationConfig `yaml:"consolidation" json:"consolidation"`
+	Iterations 		IterationsConfig 	`yaml:"iterations" json:"iterations"`
+	Prefilter 		PrefilterConfig 	`yaml:"prefilter" json:"prefilter"`
+}
+
+type WorkersConfig struct {
+	// Functions evaluated concurrently by find_effective_signs
+	Function 		int `yaml:"function" json:"function"`
+	// Splits evaluated concurrently per function
+	Split 			int `yaml:"split" json:"split"`
+	// Workers filtering packets by sign in ConsolidateSigns
+	Filter 			int `yaml:"filter" json:"filter"`
+	// Workers searching overlapping sets of signs
+	Intersection 	int `yaml:"intersection" json:"intersection"`
+}
+
+type SignsConfig struct {
+	// Name of the SignScorer deciding which binaries are effective signs
+	Scorer 				string 	`yaml:"scorer" json:"scorer"`
+	// A sample with more effective signs is skipped, the threshold is too low
+	MaxPerSample 		int 	`yaml:"max_per_sample" json:"max_per_sample"`
+	// Signs found in the sample are checked on all packets with the threshold times this factor
+	FullThresholdFactor float64 `yaml:"full_threshold_factor" json:"full_threshold_factor"`
+	// A sign matching more destination ports in a split is dropped and its function marked bad
+	MaxPorts 			int 	`yaml:"max_ports" json:"max_ports"`
+}
+
+// Defaults are those of signs.scorer, see Scorer_thresholds
+type ThresholdConfig struct {
+	// Change of the sign threshold after samples with too many or no signs
+	Step 	float64 `yaml:"step" json:"step"`
+	// The search stops once the threshold is at or below this
+	Floor 	float64 `yaml:"floor" json:"floor"`
+}
+
+type ConsolidationConfig struct {
+	// Rounds of merging overlapping intersections
+	MaxIterations 	int 	`yaml:"max_iterations" json:"max_iterations"`
+	// Fraction of the smallest sign's packets all signs of a set have to share
+	MinOverlap 		float64 `yaml:"min_overlap" json:"min_overlap"`
+	// A sample is skipped if a sign overlaps more sets, this replaces the limit of 15 signs
+	MaxSets 		int 	`yaml:"max_sets" json:"max_sets"`
+}
+
+type IterationsConfig struct {
+	// The search stops after this many iterations in a row without fingerprints
+	MaxNothing 			int `yaml:"max_nothing" json:"max_nothing"`
+	// The search stops after this many samples in a row with too many signs, before any fingerprint, 0 never stops
+	MaxTooMany 			int `yaml:"max_too_many" json:"max_too_many"`
+	// Sampling gives up after this many duplicate draws per sampled packet
+	SampleTriesFactor 	int `yaml:"sample_tries_factor" json:"sample_tries_factor"`
+}
+
+type PrefilterConfig struct {
+	// Packets sampled from the remaining packets every iteration to estimate the entropy of every function,
+	// 0 disables the pre-filter
+	Packets 			int 	`yaml:"packets" json:"packets"`
+	// Functions with at most this many bits of entropy are near-constant and skipped for the iteration
+	MinEntropy 			float64 `yaml:"min_entropy" json:"min_entropy"`
+	// Functions with at least this fraction of the entropy of a different value per sampled packet are
+	// near-uniform and skipped for the iteration, 0 keeps them
+	MaxEntropyFraction 	float64 `yaml:"max_entropy_fraction" json:"max_entropy_fraction"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Workers: WorkersConfig{
+			Function:		56,
+			Split:			3,
+			Filter:			225,
+			Intersection:	32,
+		},
+		Signs: SignsConfig{
+			Scorer:					"variance_ratio",
+			MaxPerSample:			20,
+			FullThresholdFactor:	3,
+			MaxPorts:				20,
+		},
+		Threshold: ThresholdConfig{
+			Step:	25,
+			Floor:	50,
+		},
+		Consolidation: ConsolidationConfig{
+			MaxIterations:	10,
+			MinOverlap:		0.90,
+			MaxSets:		1 << 16,
+		},
+		Iterations: IterationsConfig{
+			MaxNothing:			20,
+			MaxTooMany:			0,
+			SampleTriesFactor:	10,
+		},
+		Prefilter: PrefilterConfig{
+			Packets:			0,
+			MinEntropy:			0.01,
+			MaxEntropyFraction:	0,
+		},
+	}
+}
+
+func (c *Config) Validate() error {
+	switch {
+	case c.Workers.Function <= 0 || c.Workers.Split <= 0 || c.Workers.Filter <= 0 || c.Workers.Intersection <= 0:
+		return errors.New("workers: every worker count must be positive")
+	case Sign_scorers[c.Signs.Scorer] == nil:
+		return fmt.Errorf("signs.scorer must be one of %s", SignScorerNames())
+	case c.Signs.MaxPerSample <= 0:
+		return errors.New("signs.max_per_sample must be positive")
+	case c.Signs.FullThresholdFactor <= 0:
+		return errors.New("signs.full_threshold_factor must be positive")
+	case c.Signs.MaxPorts <= 0:
+		return errors.New("signs.max_ports must be positive")
+	case c.Threshold.Step <= 0:
+		return errors.New("threshold.step must be positive")
+	case c.Threshold.Floor < 0:
+		return errors.New("threshold.floor must not be negative")
+	case c.Consolidation.MaxIterations <= 0:
+		return errors.New("consolidation.max_iterations must be positive")
+	case c.Consolidation.MinOverlap <= 0 || c.Consolidation.MinOverlap > 1:
+		return errors.New("consolidation.min_overlap must be above 0 and at most 1")
+	case c.Consolidation.MaxSets <= 0:
+		return errors.New("consolidation.max_sets must be positive")
+	case c.Iterations.MaxNothing < 0:
+		return errors.New("iterations.max_nothing must not be negative")
+	case c.Iterations.MaxTooMany < 0:
+		return errors.New("iterations.max_too_many must not be negative")
+	case c.Iterations.SampleTriesFactor <= 0:
+		return errors.New("iterations.sample_tries_factor must be positive")
+	case c.Prefilter.Packets < 0 || c.Prefilter.Packets == 1:
+		return errors.New("prefilter.packets must be 0 or at least 2")
+	case c.Prefilter.Packets > 0 && c.Prefilter.MinEntropy < 0:
+		return errors.New("prefilter.min_entropy must not be negative")
+	case c.Prefilter.MaxEntropyFraction < 0 || c.Prefilter.MaxEntropyFraction > 1:
+		return errors.New("prefilter.max_entropy_fraction must be from 0 to 1")
+	}
+	return nil
+}
+
+// Reads a YAML config over the defaults, rejecting unknown keys. The threshold step and floor default
+// to those of the scorer the config selects.
+func ReadConfig(r io.Reader) (*Config, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var selected struct {
+		Signs struct {
+			Scorer string `yaml:"scorer"`
+		} `yaml:"signs"`
+	}
+	if err := yaml.Unmarshal(in, &selected); err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	if thresholds, ok := Scorer_thresholds[selected.Signs.Scorer]; ok {
+		config.Threshold.Step, config.Threshold.Floor = thresholds.Step, thresholds.Floor
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(in))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config, err := ReadConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func WriteConfig(w io.Writer, c *Config) error {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
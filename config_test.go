@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Values hard-coded in the search before it was configurable. A default that changes the search
+// has to be changed here too.
+func TestDefaultConfigMatchesBaseline(t *testing.T) {
+	want := &Config{
+		// Worker counts passed to find_effective_signs, ConsolidateSigns and the intersection search
+		Workers:		WorkersConfig{Function: 56, Split: 3, Filter: 225, Intersection: 32},
+		// More than 20 signs skipped a sample, signs were checked with 3 times the threshold and
+		// dropped above 20 ports
+		Signs:			SignsConfig{Scorer: "variance_ratio", MaxPerSample: 20, FullThresholdFactor: 3, MaxPorts: 20},
+		// The threshold moved by 25 and the search stopped at 50
+		Threshold:		ThresholdConfig{Step: 25, Floor: 50},
+		// 10 rounds of merging at an overlap of 0.9. MaxSets replaces skipping samples with more than
+		// 15 signs, which the search no longer needs as it does not try every subset.
+		Consolidation:	ConsolidationConfig{MaxIterations: 10, MinOverlap: 0.9, MaxSets: 65536},
+		// The search stopped after 20 iterations without fingerprints, never on too many signs, and
+		// sampling gave up after 10 draws per packet
+		Iterations:		IterationsConfig{MaxNothing: 20, MaxTooMany: 0, SampleTriesFactor: 10},
+		// There was no pre-filter, it is off unless packets are set
+		Prefilter:		PrefilterConfig{Packets: 0, MinEntropy: 0.01, MaxEntropyFraction: 0},
+	}
+	if got := DefaultConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got default config\n%+v\nwant\n%+v", got, want)
+	}
+	if err := want.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The example config lists the defaults
+func TestExampleConfigIsDefault(t *testing.T) {
+	config, err := LoadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Errorf("Example config\n%+v\ndiffers from the defaults\n%+v", config, DefaultConfig())
+	}
+	// Every setting is listed
+	var b bytes.Buffer
+	if err := WriteConfig(&b, DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	example, err := os.ReadFile("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		// Written with four spaces of indentation, the example has two
+		key, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+		indent := strings.Repeat(" ", (len(line) - len(strings.TrimLeft(line, " "))) / 2)
+		if !strings.Contains("\n" + string(example), "\n" + indent + key + ":") {
+			t.Errorf("Example config does not list %s", key)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		change	func(c *Config)
+		err		string
+	}{
+		{func(c *Config) { c.Workers.Filter = 0 }, "workers: every worker count must be positive"},
+		{func(c *Config) { c.Signs.Scorer = "entropy" }, "signs.scorer must be one of chi_square, kl_divergence, variance_ratio, zscore"},
+		{func(c *Config) { c.Signs.MaxPerSample = 0 }, "signs.max_per_sample must be positive"},
+		{func(c *Config) { c.Signs.FullThresholdFactor = -1 }, "signs.full_threshold_factor must be positive"},
+		{func(c *Config) { c.Signs.MaxPorts = 0 }, "signs.max_ports must be positive"},
+		{func(c *Config) { c.Threshold.Step = 0 }, "threshold.step must be positive"},
+		{func(c *Config) { c.Threshold.Floor = -1 }, "threshold.floor must not be negative"},
+		{func(c *Config) { c.Consolidation.MaxIterations = 0 }, "consolidation.max_iterations must be positive"},
+		{func(c *Config) { c.Consolidation.MinOverlap = 1.5 }, "consolidation.min_overlap must be above 0 and at most 1"},
+		{func(c *Config) { c.Consolidation.MaxSets = 0 }, "consolidation.max_sets must be positive"},
+		{func(c *Config) { c.Iterations.MaxNothing = -1 }, "iterations.max_nothing must not be negative"},
+		{func(c *Config) { c.Iterations.MaxTooMany = -1 }, "iterations.max_too_many must not be negative"},
+		{func(c *Config) { c.Iterations.SampleTriesFactor = 0 }, "iterations.sample_tries_factor must be positive"},
+		{func(c *Config) { c.Prefilter.Packets = 1 }, "prefilter.packets must be 0 or at least 2"},
+		{func(c *Config) { c.Prefilter.Packets, c.Prefilter.MinEntropy = 4096, -1 }, "prefilter.min_entropy must not be negative"},
+		{func(c *Config) { c.Prefilter.MaxEntropyFraction = 1.1 }, "prefilter.max_entropy_fraction must be from 0 to 1"},
+		// Limits that are allowed
+		{func(c *Config) { c.Threshold.Floor, c.Iterations.MaxNothing = 0, 0 }, ""},
+		{func(c *Config) { c.Consolidation.MinOverlap, c.Prefilter.MaxEntropyFraction = 1, 1 }, ""},
+		// A negative minimum entropy does not matter with the pre-filter off
+		{func(c *Config) { c.Prefilter.MinEntropy = -1 }, ""},
+	} {
+		config := DefaultConfig()
+		c.change(config)
+		err := config.Validate()
+		if (err == nil) != (c.err == "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Got error %v, want %q", err, c.err)
+		}
+	}
+}
+
+func TestReadConfigRejects(t *testing.T) {
+	for _, c := range []struct {
+		yaml	string
+		err		string
+	}{
+		{"signs:\n  max_per_samples: 5\n", "field max_per_samples not found"},
+		{"sign:\n  max_per_sample: 5\n", "field sign not found"},
+		{"workers:\n  function: many\n", "cannot unmarshal"},
+		{"threshold:\n  step: 0\n", "threshold.step must be positive"},
+	} {
+		_, err := ReadConfig(strings.NewReader(c.yaml))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, want %q", c.yaml, err, c.err)
+		}
+	}
+}
+
+func TestWriteConfigRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.Workers.Split = 7
+	config.Signs.Scorer = "zscore"
+	config.Threshold = ThresholdConfig{Step: 2.5, Floor: 12}
+	config.Consolidation.MinOverlap = 0.75
+	config.Iterations.MaxTooMany = 3
+	config.Prefilter = PrefilterConfig{Packets: 4096, MinEntropy: 0.5, MaxEntropyFraction: 0.999}
+	var b bytes.Buffer
+	if err := WriteConfig(&b, config); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadConfig(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, config) {
+		t.Errorf("Read back\n%+v\nwant\n%+v", read, config)
+	}
+}
+
+func TestReadConfigScorerThresholds(t *testing.T) {
+	for _, c := range []struct {
+		yaml 	string
+		want 	ThresholdConfig
+	}{
+		{"", ThresholdConfig{25, 50}},
+		{"signs:\n  scorer: zscore\n", ThresholdConfig{5, 10}},
+		{"signs:\n  scorer: chi_square\n", ThresholdConfig{250, 500}},
+		// Given settings are kept
+		{"signs:\n  scorer: kl_divergence\nthreshold:\n  floor: 100\n", ThresholdConfig{125, 100}},
+		{"threshold:\n  step: 10\nsigns:\n  scorer: zscore\n", ThresholdConfig{10, 10}},
+	} {
+		config, err := ReadConfig(strings.NewReader(c.yaml))
+		if err != nil {
+			t.Fatalf("%q: %s", c.yaml, err)
+		}
+		if config.Threshold != c.want {
+			t.Errorf("%q: got threshold %+v, want %+v", c.yaml, config.Threshold, c.want)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// IP Id set by ZMap on every probe
+const ZMapIPId = 54321
+
+// Select expressions, in the order they are scanned into a Packet.
+// IPv4 addresses are converted so both IPv4 and UInt32 columns work, IPv6 addresses
+// are read as text and are empty, unspecified or IPv4-mapped for IPv4 packets.
+var packetColumns = []string{
+	"ip_id",
+	"toUInt32(src_ip)",
+	"toUInt32(dst_ip)",
+	"src_port",
+	"dst_port",
+	"seq",
+	"window",
+	"ttl",
+	"tcp_flags",
+	"ack",
+	"ip_len",
+	"mss",
+	"opt_layout",
+	"toString(src_ip6)",
+	"toString(dst_ip6)",
+}
+
+// Column names as written to fixtures, time first
+var fixtureColumns = []string{
+	"time",
+	"ip_id",
+	"src_ip",
+	"dst_ip",
+	"src_port",
+	"dst_port",
+	"seq",
+	"window",
+	"ttl",
+	"tcp_flags",
+	"ack",
+	"ip_len",
+	"mss",
+	"opt_layout",
+	"src_ip6",
+	"dst_ip6",
+}
+
+// Table holding one row per packet, with a DateTime column used to slice it
+type PacketTable struct {
+	name        string
+	time_column string
+	slice       time.Duration
+}
+
+// A query for all packets in [start, start + slice)
+type PacketQuery struct {
+	table *PacketTable
+	start time.Time
+	end   time.Time
+	zmap  bool
+	limit int
+}
+
+type PacketRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// Anything that can answer a PacketQuery, either ClickHouse or a recorded fixture
+type PacketSource interface {
+	QueryPackets(ctx context.Context, query *PacketQuery) (PacketRows, error)
+}
+
+// Scan targets for one row of packetColumns
+type packetRow struct {
+	p       *Packet
+	src_ip6 string
+	dst_ip6 string
+}
+
+// Row to scan into p, or to format p from
+func newPacketRow(p *Packet) *packetRow {
+	row := &packetRow{p: p}
+	if p.IPv6 {
+		row.src_ip6 = SrcAddr(p).String()
+		row.dst_ip6 = DstAddr(p).String()
+	}
+	return row
+}
+
+// Pointers to the fields of the row in the order of packetColumns
+func (row *packetRow) fields() []any {
+	p := row.p
+	return []any{
+		&p.IPId,
+		&p.SrcIp,
+		&p.DstIp,
+		&p.SrcPort,
+		&p.DstPort,
+		&p.Seq,
+		&p.Window,
+		&p.TTL,
+		&p.Flags,
+		&p.Ack,
+		&p.IPLen,
+		&p.MSS,
+		&p.OptLayout,
+		&row.src_ip6,
+		&row.dst_ip6,
+	}
+}
+
+// Sets the addresses of the packet once all fields are scanned
+func (row *packetRow) finish() error {
+	src, src_v6, err := parseIPv6Column(row.src_ip6)
+	if err != nil {
+		return err
+	}
+	dst, dst_v6, err := parseIPv6Column(row.dst_ip6)
+	if err != nil {
+		return err
+	}
+	if src_v6 || dst_v6 {
+		SetIPv6Addrs(row.p, src.As16(), dst.As16())
+	} else {
+		SetIPv4Addrs(row.p, row.p.SrcIp, row.p.DstIp)
+	}
+	return nil
+}
+
+// Parses an IPv6 column, which is only a real IPv6 address if not empty, unspecified or IPv4-mapped
+func parseIPv6Column(s string) (netip.Addr, bool, error) {
+	if s == "" {
+		return netip.IPv6Unspecified(), false, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addr, false, err
+	}
+	if addr.Is4() {
+		return netip.AddrFrom16(addr.As16()), false, nil
+	}
+	return addr, !addr.IsUnspecified() && !addr.Is4In6(), nil
+}
+
+func NewPacketTable(name string, time_column string, slice time.Duration) (*PacketTable, error) {
+	if name == "" || time_column == "" {
+		return nil, errors.New("Table and time column must be set")
+	}
+	if slices.Contains(strings.Split(name, "."), "") {
+		return nil, fmt.Errorf("Table %q has an empty name part", name)
+	}
+	if slice <= 0 {
+		return nil, errors.New("Time slice must be positive")
+	}
+	return &PacketTable{
+		name:        name,
+		time_column: time_column,
+		slice:       slice,
+	}, nil
+}
+
+// Start of every slice in [start, end), formatted as used in Split.time
+func TimeSlices(start time.Time, end time.Time, slice time.Duration) []string {
+	times := make([]string, 0, int(end.Sub(start)/slice)+1)
+	for t := start; t.Before(end); t = t.Add(slice) {
+		times = append(times, t.UTC().Format(time.DateTime))
+	}
+	return times
+}
+
+// Loads one split per time slice using n_workers concurrent queries.
+// Splits are returned in the order of times.
+func LoadSplits(
+	ctx context.Context,
+	source PacketSource,
+	table *PacketTable,
+	times []string,
+	limit bool,
+	n_limit int,
+	zmap bool,
+	n_workers int,
+) ([]*Split, error) {
+	if limit && n_limit <= 0 {
+		return nil, errors.New("Limit must be positive")
+	}
+	if n_workers <= 0 {
+		return nil, errors.New("Need at least one database worker")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tasks := make(chan *DatabaseJob, len(times))
+	results := make(chan *DatabaseResult)
+
+	for i := 0; i < n_workers; i++ {
+		go Database_worker(
+			&Worker[*DatabaseJob, *DatabaseResult]{i, tasks, results},
+		)
+	}
+
+	var wg sync.WaitGroup
+	for i, t := range times {
+		wg.Add(1)
+		tasks <- &DatabaseJob{
+			ctx:     ctx,
+			conn:    source,
+			table:   table,
+			idx:     i,
+			time:    t,
+			limit:   limit,
+			n_limit: n_limit,
+			zmap:    zmap,
+			wg:      &wg,
+		}
+	}
+	close(tasks)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	splits := make([]*Split, len(times))
+	var first_err error
+	for result := range results {
+		if result.err != nil {
+			if first_err == nil {
+				first_err = fmt.Errorf("%s: %w", times[result.idx], result.err)
+				// Stop remaining queries, but keep draining results
+				cancel()
+			}
+			continue
+		}
+		splits[result.idx] = result.split
+	}
+	if first_err != nil {
+		return nil, first_err
+	}
+	log.Printf("Loaded %d packets in %d splits\n", SplitLen(splits), len(splits))
+	return splits, nil
+}
+
+func Database_worker(
+	w *Worker[*DatabaseJob, *DatabaseResult],
+) {
+	for job := range w.tasks {
+		split, err := loadSplit(job)
+		w.results <- &DatabaseResult{
+			idx:   job.idx,
+			split: split,
+			err:   err,
+		}
+		job.wg.Done()
+	}
+}
+
+func loadSplit(job *DatabaseJob) (*Split, error) {
+	if err := job.ctx.Err(); err != nil {
+		return nil, err
+	}
+	start, err := time.ParseInLocation(time.DateTime, job.time, time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	query := &PacketQuery{
+		table: job.table,
+		start: start,
+		end:   start.Add(job.table.slice),
+		zmap:  job.zmap,
+	}
+	if job.limit {
+		query.limit = job.n_limit
+	}
+
+	rows, err := job.conn.QueryPackets(job.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	packets := NewPacketColumns(Max(query.limit, 1024))
+	for rows.Next() {
+		row := newPacketRow(&Packet{})
+		if err := rows.Scan(row.fields()...); err != nil {
+			return nil, err
+		}
+		if err := row.finish(); err != nil {
+			return nil, err
+		}
+		packets.Append(row.p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return NewSplit(job.time, packets), nil
+}
+
+// ClickHouse
+
+type ClickHouseSource struct {
+	conn driver.Conn
+}
+
+func OpenClickHouse(addr string, database string, username string, password string) (*ClickHouseSource, error) {
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr: []string{addr},
+		Auth: clickhouse.Auth{
+			Database: database,
+			Username: username,
+			Password: password,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ClickHouseSource{conn: conn}, nil
+}
+
+func (s *ClickHouseSource) Close() error {
+	return s.conn.Close()
+}
+
+func (s *ClickHouseSource) QueryPackets(ctx context.Context, query *PacketQuery) (PacketRows, error) {
+	sql, args := query.SQL()
+	rows, err := s.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Rows are ordered by time and then by every column, as ClickHouse returns them in any order otherwise
+// and both which rows the limit keeps and which ones are sampled depend on it
+func (q *PacketQuery) SQL() (string, []any) {
+	columns := strings.Join(packetColumns, ", ")
+	sql := "SELECT " + columns
+	time_column := quoteIdentifier(q.table.time_column)
+	sql += fmt.Sprintf(
+		" FROM %s WHERE %s >= ? AND %s < ?",
+		quoteIdentifier(q.table.name),
+		time_column,
+		time_column,
+	)
+	args := []any{q.start, q.end}
+	if q.zmap {
+		sql += " AND ip_id != ?"
+		args = append(args, uint16(ZMapIPId))
+	}
+	sql += fmt.Sprintf(" ORDER BY %s, %s", time_column, columns)
+	if q.limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", q.limit)
+	}
+	return sql, args
+}
+
+// Backtick-quotes every dot-separated part of a ClickHouse identifier, so database.table still works
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		part = strings.ReplaceAll(part, "\\", "\\\\")
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "\\`") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// Recorded fixtures
+//
+// A fixture is a CSV file with a header of fixtureColumns and one packet per row.
+// It stands in for ClickHouse by answering a PacketQuery in memory.
+
+type fixtureRow struct {
+	time   time.Time
+	packet *Packet
+}
+
+type FixtureSource struct {
+	rows []*fixtureRow
+}
+
+func LoadFixture(path string) (*FixtureSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFixture(file)
+}
+
+func ReadFixture(r io.Reader) (*FixtureSource, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(fixtureColumns)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading fixture header: %w", err)
+	}
+	for i, col := range fixtureColumns {
+		if header[i] != col {
+			return nil, fmt.Errorf("Fixture column %d is %q, expected %q", i, header[i], col)
+		}
+	}
+
+	source := &FixtureSource{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return source, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row, err := parseFixtureRow(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("Fixture line %d: %w", line, err)
+		}
+		source.rows = append(source.rows, row)
+	}
+}
+
+func parseFixtureRow(record []string) (*fixtureRow, error) {
+	t, err := time.ParseInLocation(time.DateTime, record[0], time.UTC)
+	if err != nil {
+		return nil, err
+	}
+	row := newPacketRow(&Packet{})
+	for i, field := range row.fields() {
+		if err := parseFixtureField(field, record[i+1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", fixtureColumns[i+1], err)
+		}
+	}
+	if err := row.finish(); err != nil {
+		return nil, err
+	}
+	return &fixtureRow{time: t, packet: row.p}, nil
+}
+
+func parseFixtureField(field any, s string) error {
+	switch f := field.(type) {
+	case *uint8:
+		v, err := strconv.ParseUint(s, 10, 8)
+		*f = uint8(v)
+		return err
+	case *uint16:
+		v, err := strconv.ParseUint(s, 10, 16)
+		*f = uint16(v)
+		return err
+	case *uint32:
+		v, err := strconv.ParseUint(s, 10, 32)
+		*f = uint32(v)
+		return err
+	case *string:
+		*f = s
+		return nil
+	default:
+		panic("Unsupported type")
+	}
+}
+
+func formatFixtureField(field any) string {
+	switch f := field.(type) {
+	case *uint8:
+		return strconv.FormatUint(uint64(*f), 10)
+	case *uint16:
+		return strconv.FormatUint(uint64(*f), 10)
+	case *uint32:
+		return strconv.FormatUint(uint64(*f), 10)
+	case *string:
+		return *f
+	default:
+		panic("Unsupported type")
+	}
+}
+
+// Records splits as a fixture, using Split.time as the time of every packet in it
+func WriteFixture(w io.Writer, splits []*Split) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(fixtureColumns); err != nil {
+		return err
+	}
+	record := make([]string, len(fixtureColumns))
+	var p Packet
+	for _, spl := range splits {
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			record[0] = spl.time
+			for i, field := range newPacketRow(&p).fields() {
+				record[i+1] = formatFixtureField(field)
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *FixtureSource) QueryPackets(ctx context.Context, query *PacketQuery) (PacketRows, error) {
+	packets := make([]*Packet, 0, 1024)
+	for _, row := range s.rows {
+		if row.time.Before(query.start) || !row.time.Before(query.end) {
+			continue
+		}
+		if query.zmap && row.packet.IPId == ZMapIPId {
+			continue
+		}
+		if query.limit > 0 && len(packets) >= query.limit {
+			break
+		}
+		packets = append(packets, row.packet)
+	}
+	return &fixtureRows{ctx: ctx, packets: packets, idx: -1}, nil
+}
+
+type fixtureRows struct {
+	ctx     context.Context
+	packets []*Packet
+	idx     int
+}
+
+func (r *fixtureRows) Next() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	r.idx++
+	return r.idx < len(r.packets)
+}
+
+func (r *fixtureRows) Scan(dest ...any) error {
+	src := newPacketRow(r.packets[r.idx]).fields()
+	if len(dest) != len(src) {
+		return fmt.Errorf("Expected %d scan targets, got %d", len(src), len(dest))
+	}
+	for i := range dest {
+		ok := false
+		switch v := src[i].(type) {
+		case *uint8:
+			var d *uint8
+			if d, ok = dest[i].(*uint8); ok {
+				*d = *v
+			}
+		case *uint16:
+			var d *uint16
+			if d, ok = dest[i].(*uint16); ok {
+				*d = *v
+			}
+		case *uint32:
+			var d *uint32
+			if d, ok = dest[i].(*uint32); ok {
+				*d = *v
+			}
+		case *string:
+			var d *string
+			if d, ok = dest[i].(*string); ok {
+				*d = *v
+			}
+		}
+		if !ok {
+			return fmt.Errorf("Unsupported scan target %T for column %s", dest[i], fixtureColumns[i+1])
+		}
+	}
+	return nil
+}
+
+func (r *fixtureRows) Err() error {
+	return r.ctx.Err()
+}
+
+func (r *fixtureRows) Close() error {
+	return nil
+}
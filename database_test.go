@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fixtureStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Fixture of n_slices hours with n_packets packets each, every fourth one sent by ZMap. The sequence
+// number of a packet is its slice times 1000 plus its position in the slice.
+func testFixture(t *testing.T, n_slices int, n_packets int) *FixtureSource {
+	t.Helper()
+	splits := make([]*Split, n_slices)
+	for i := range splits {
+		packets := NewPacketColumns(n_packets)
+		for j := 0; j < n_packets; j++ {
+			p := &Packet{Seq: uint32(i * 1000 + j), IPId: uint16(j), Flags: 2}
+			if j % 4 == 0 {
+				p.IPId = ZMapIPId
+			}
+			SetIPv4Addrs(p, uint32(j), SyntheticTelescope | uint32(i))
+			packets.Append(p)
+		}
+		splits[i] = NewSplit(fixtureStart.Add(time.Duration(i) * time.Hour).Format(time.DateTime), packets)
+	}
+	var b bytes.Buffer
+	if err := WriteFixture(&b, splits); err != nil {
+		t.Fatal(err)
+	}
+	source, err := ReadFixture(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func loadTestSplits(t *testing.T, source PacketSource, limit bool, n_limit int, zmap bool) []*Split {
+	t.Helper()
+	table, err := NewPacketTable("packets", "ts", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := TimeSlices(fixtureStart, fixtureStart.Add(5 * time.Hour), time.Hour)
+	splits, err := LoadSplits(context.Background(), source, table, times, limit, n_limit, zmap, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return splits
+}
+
+func TestLoadSplitsOrder(t *testing.T) {
+	// The fixture covers four of the five slices, the last split is empty
+	splits := loadTestSplits(t, testFixture(t, 4, 20), false, 0, false)
+	if len(splits) != 5 {
+		t.Fatalf("Got %d splits, want 5", len(splits))
+	}
+	var p Packet
+	for i, spl := range splits {
+		if want := fixtureStart.Add(time.Duration(i) * time.Hour).Format(time.DateTime); spl.time != want {
+			t.Fatalf("Split %d has time %s, want %s", i, spl.time, want)
+		}
+		want_size := 20
+		if i == 4 {
+			want_size = 0
+		}
+		if spl.size != want_size {
+			t.Fatalf("Split %d has %d packets, want %d", i, spl.size, want_size)
+		}
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			if p.Seq != uint32(i * 1000 + j) {
+				t.Fatalf("Packet %d of split %d has seq %d, want %d", j, i, p.Seq, i * 1000 + j)
+			}
+		}
+	}
+}
+
+func TestLoadSplitsLimit(t *testing.T) {
+	source := testFixture(t, 4, 20)
+	splits := loadTestSplits(t, source, true, 7, false)
+	var p Packet
+	for i, spl := range splits[:4] {
+		if spl.size != 7 {
+			t.Fatalf("Split %d has %d packets, want the limit of 7", i, spl.size)
+		}
+		spl.packets.Row(6, &p)
+		if p.Seq != uint32(i * 1000 + 6) {
+			t.Fatalf("Split %d does not start with the first packets of its slice", i)
+		}
+	}
+	// A limit above the packets of a slice keeps all of them
+	for i, spl := range loadTestSplits(t, source, true, 100, false)[:4] {
+		if spl.size != 20 {
+			t.Fatalf("Split %d has %d packets, want 20", i, spl.size)
+		}
+	}
+
+	table, _ := NewPacketTable("packets", "ts", time.Hour)
+	times := TimeSlices(fixtureStart, fixtureStart.Add(time.Hour), time.Hour)
+	if _, err := LoadSplits(context.Background(), source, table, times, true, 0, false, 1); err == nil {
+		t.Fatal("Expected an error for a limit of 0")
+	}
+}
+
+func TestLoadSplitsZMapFilter(t *testing.T) {
+	source := testFixture(t, 4, 20)
+	var p Packet
+	for i, spl := range loadTestSplits(t, source, false, 0, true)[:4] {
+		if spl.size != 15 {
+			t.Fatalf("Split %d has %d packets, want the 15 not sent by ZMap", i, spl.size)
+		}
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			if p.IPId == ZMapIPId {
+				t.Fatalf("Packet %d of split %d is from ZMap", j, i)
+			}
+		}
+	}
+	// The limit counts the packets left after filtering
+	for i, spl := range loadTestSplits(t, source, true, 6, true)[:4] {
+		spl.packets.Row(spl.size - 1, &p)
+		if spl.size != 6 || p.Seq != uint32(i * 1000 + 7) {
+			t.Fatalf("Split %d has %d packets ending with seq %d, want 6 ending with %d", i, spl.size, p.Seq, i * 1000 + 7)
+		}
+	}
+}
+
+func TestPacketQuerySQL(t *testing.T) {
+	table, err := NewPacketTable("telescope.packets", "ts", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := &PacketQuery{table: table, start: fixtureStart, end: fixtureStart.Add(time.Hour), zmap: true, limit: 10}
+	sql, args := query.SQL()
+	want := " FROM `telescope`.`packets` WHERE `ts` >= ? AND `ts` < ? AND ip_id != ? ORDER BY `ts`, " + strings.Join(packetColumns, ", ") + " LIMIT 10"
+	if !strings.HasSuffix(sql, want) {
+		t.Fatalf("Got %q, want it to end with %q", sql, want)
+	}
+	if len(args) != 3 || args[2] != uint16(ZMapIPId) {
+		t.Fatalf("Got args %v", args)
+	}
+
+	table, err = NewPacketTable("packets` WHERE 1; DROP TABLE x; --", "t`s", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, _ = (&PacketQuery{table: table, start: fixtureStart, end: fixtureStart}).SQL()
+	want = " FROM `packets\\` WHERE 1; DROP TABLE x; --` WHERE `t\\`s` >= ? AND `t\\`s` < ? ORDER BY `t\\`s`, "
+	if !strings.Contains(sql, want) {
+		t.Fatalf("Got %q, want it to end with %q", sql, want)
+	}
+
+	for _, name := range []string{"", ".packets", "telescope."} {
+		if _, err := NewPacketTable(name, "ts", time.Hour); err == nil {
+			t.Fatalf("Expected an error for table %q", name)
+		}
+	}
+}
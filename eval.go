@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Packet function compiled from a TCPComposition. Values are zero-extended to uint64,
+// so evaluating does not box or type switch, and int(f(p)) equals LiftInt of the
+// PacketFunction built by the same composition.
+type TypedFunction func(*Packet) uint64
+
+// Typed initial functions
+func eval_IPId(p *Packet) uint64 {
+	return uint64(p.IPId)
+}
+
+func eval_SrcIp(p *Packet) uint64 {
+	return uint64(p.SrcIp)
+}
+
+func eval_DstIp(p *Packet) uint64 {
+	return uint64(p.DstIp)
+}
+
+func eval_SrcPort(p *Packet) uint64 {
+	return uint64(p.SrcPort)
+}
+
+func eval_DstPort(p *Packet) uint64 {
+	return uint64(p.DstPort)
+}
+
+func eval_Seq(p *Packet) uint64 {
+	return uint64(p.Seq)
+}
+
+func eval_Window(p *Packet) uint64 {
+	return uint64(p.Window)
+}
+
+func eval_TTL(p *Packet) uint64 {
+	return uint64(p.TTL)
+}
+
+func eval_Flags(p *Packet) uint64 {
+	return uint64(p.Flags)
+}
+
+func eval_Ack(p *Packet) uint64 {
+	return uint64(p.Ack)
+}
+
+func eval_IPLen(p *Packet) uint64 {
+	return uint64(p.IPLen)
+}
+
+func eval_MSS(p *Packet) uint64 {
+	return uint64(p.MSS)
+}
+
+func eval_OptLayout(p *Packet) uint64 {
+	return uint64(p.OptLayout)
+}
+
+func eval_SrcIp6Hi(p *Packet) uint64 {
+	return binary.BigEndian.Uint64(p.SrcIp6[:8])
+}
+
+func eval_SrcIp6Lo(p *Packet) uint64 {
+	return binary.BigEndian.Uint64(p.SrcIp6[8:])
+}
+
+func eval_DstIp6Hi(p *Packet) uint64 {
+	return binary.BigEndian.Uint64(p.DstIp6[:8])
+}
+
+func eval_DstIp6Lo(p *Packet) uint64 {
+	return binary.BigEndian.Uint64(p.DstIp6[8:])
+}
+
+// All ones in the lowest width bits
+func widthMask(width int) uint64 {
+	return ^uint64(0) >> (64 - width)
+}
+
+// Compiles comp, returning the function and the width in bits of its value
+func CompileComposition(comp *TCPComposition) (TypedFunction, int, error) {
+	if comp == nil {
+		return nil, 0, errors.New("Function has no composition")
+	}
+	switch len(comp.comp) {
+	case 0:
+		init := initialByName(comp.name)
+		if init == nil {
+			return nil, 0, fmt.Errorf("Unknown initial function %q", comp.name)
+		}
+		return init.eval, init.width, nil
+	case 1:
+		op, n, ok := parseFeatureName(comp.name)
+		if !ok {
+			return nil, 0, fmt.Errorf("Unknown feature extraction %q", comp.name)
+		}
+		fa, width, err := CompileComposition(comp.comp[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		out_width, err := featureWidth(op, n, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		return compileFeature(op, n, fa, width, out_width), out_width, nil
+	case 2:
+		fa, width_a, err := CompileComposition(comp.comp[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		fb, width_b, err := CompileComposition(comp.comp[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		width := binaryWidth(width_a, width_b)
+		f, err := compileBinary(comp.name, fa, fb, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, width, nil
+	default:
+		return nil, 0, fmt.Errorf("Composition %q has %d children", comp.name, len(comp.comp))
+	}
+}
+
+// Compiles all compositions, keeping their order
+func CompileCompositions(compositions []*TCPComposition) ([]TypedFunction, error) {
+	functions := make([]TypedFunction, len(compositions))
+	for i, comp := range compositions {
+		f, _, err := CompileComposition(comp)
+		if err != nil {
+			return nil, fmt.Errorf("Function %d: %w", i, err)
+		}
+		functions[i] = f
+	}
+	return functions, nil
+}
+
+// Both arguments fit in width, so only the arithmetic operations need to wrap
+func compileBinary(name string, fa TypedFunction, fb TypedFunction, width int) (TypedFunction, error) {
+	m := widthMask(width)
+	switch name {
+	case "and":
+		return func(p *Packet) uint64 { return fa(p) & fb(p) }, nil
+	case "or":
+		return func(p *Packet) uint64 { return fa(p) | fb(p) }, nil
+	case "xor":
+		return func(p *Packet) uint64 { return fa(p) ^ fb(p) }, nil
+	case "add":
+		return func(p *Packet) uint64 { return (fa(p) + fb(p)) & m }, nil
+	case "sub":
+		return func(p *Packet) uint64 { return (fa(p) - fb(p)) & m }, nil
+	case "mul":
+		return func(p *Packet) uint64 { return (fa(p) * fb(p)) & m }, nil
+	default:
+		return nil, fmt.Errorf("Unknown binary operation %q", name)
+	}
+}
+
+// Parameters are already checked by featureWidth
+func compileFeature(op string, n uint64, fa TypedFunction, width int, out_width int) TypedFunction {
+	m := widthMask(width)
+	switch op {
+	case "lbitshift":
+		return func(p *Packet) uint64 { return (fa(p) << n) & m }
+	case "rbitshift":
+		return func(p *Packet) uint64 { return fa(p) >> n }
+	case "lbytes":
+		shift := width - out_width
+		return func(p *Packet) uint64 { return fa(p) >> shift }
+	case "rbytes":
+		out_m := widthMask(out_width)
+		return func(p *Packet) uint64 { return fa(p) & out_m }
+	case "rotl":
+		return compileRotate(fa, int(n), width)
+	case "rotr":
+		return compileRotate(fa, -int(n), width)
+	case "mask":
+		c := n & m
+		return func(p *Packet) uint64 { return fa(p) & c }
+	case "xorc":
+		c := n & m
+		return func(p *Packet) uint64 { return fa(p) ^ c }
+	default:
+		panic("Unknown feature extraction")
+	}
+}
+
+func compileRotate(fa TypedFunction, k int, width int) TypedFunction {
+	switch width {
+	case 8:
+		return func(p *Packet) uint64 { return uint64(bits.RotateLeft8(uint8(fa(p)), k)) }
+	case 16:
+		return func(p *Packet) uint64 { return uint64(bits.RotateLeft16(uint16(fa(p)), k)) }
+	case 32:
+		return func(p *Packet) uint64 { return uint64(bits.RotateLeft32(uint32(fa(p)), k)) }
+	default:
+		return func(p *Packet) uint64 { return bits.RotateLeft64(fa(p), k) }
+	}
+}
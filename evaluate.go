@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Tool that sent every packet of a dataset
+type GroundTruth struct {
+	tools 	[]string
+	// Per split and packet, the position in tools of the tool that sent it, or -1 for background
+	labels 	[][]int
+}
+
+const BackgroundLabel = "background"
+
+func (d *SyntheticData) GroundTruth() *GroundTruth {
+	return &GroundTruth{
+		tools:	Map[*SyntheticTool, string](d.tools, func(t *SyntheticTool) string {
+			return t.name
+		}),
+		labels:	d.labels,
+	}
+}
+
+// Reads labels as written by SyntheticData.WriteLabels for splits loaded from the matching fixture
+func ReadGroundTruth(r io.Reader, splits []*Split) (*GroundTruth, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	if _, err := reader.Read(); err != nil {
+		return nil, fmt.Errorf("Reading labels header: %w", err)
+	}
+	truth := &GroundTruth{
+		tools:	make([]string, 0),
+		labels:	make([][]int, len(splits)),
+	}
+	positions := make(map[string]int)
+	split_idx := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for split_idx < len(splits) && (record[0] != splits[split_idx].time || len(truth.labels[split_idx]) == splits[split_idx].size) {
+			split_idx++
+		}
+		if split_idx == len(splits) {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("Labels line %d: no packet left in a split at %s", line, record[0])
+		}
+		label := -1
+		if record[1] != BackgroundLabel {
+			pos, ok := positions[record[1]]
+			if !ok {
+				pos = len(truth.tools)
+				positions[record[1]] = pos
+				truth.tools = append(truth.tools, record[1])
+			}
+			label = pos
+		}
+		truth.labels[split_idx] = append(truth.labels[split_idx], label)
+	}
+	for i, spl := range splits {
+		if len(truth.labels[i]) != spl.size {
+			return nil, fmt.Errorf("Split at %s has %d packets but %d labels", spl.time, spl.size, len(truth.labels[i]))
+		}
+	}
+	return truth, nil
+}
+
+func LoadGroundTruth(path string, splits []*Split) (*GroundTruth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	truth, err := ReadGroundTruth(file, splits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return truth, nil
+}
+
+type FingerprintEvaluation struct {
+	// Position of the tool sending most of the matched packets, -1 if only background matches
+	tool 			int
+	matched 		int
+	true_positives 	int
+	precision 		float64
+	recall 			float64
+	f1 				float64
+}
+
+type ToolEvaluation struct {
+	packets 		int
+	// Fingerprints matched to the tool
+	fingerprints 	[]int
+	// Packets of the tool matched by any of its fingerprints
+	true_positives 	int
+	recall 			float64
+}
+
+type Evaluation struct {
+	tools 			[]string
+	fingerprints 	[]*FingerprintEvaluation
+	per_tool 		[]*ToolEvaluation
+	// Over all packets: a matched packet is a true positive if a fingerprint matched to its tool
+	// matches it and a false positive otherwise, tool packets no such fingerprint matches are false negatives
+	true_positives 	int
+	false_positives int
+	false_negatives int
+	precision 		float64
+	recall 			float64
+	f1 				float64
+	// Tools no fingerprint is matched to
+	undiscovered 	[]string
+}
+
+func ratio(x int, y int) float64 {
+	if y == 0 {
+		return 0
+	}
+	return float64(x) / float64(y)
+}
+
+func f1Score(precision float64, recall float64) float64 {
+	if precision + recall == 0 {
+		return 0
+	}
+	return 2 * precision * recall / (precision + recall)
+}
+
+// Evaluates the fingerprints of intersections, as returned by Fgpt_ident_iterative, on splits labelled by truth
+func EvaluateIntersections(
+	intersections []*Intersection,
+	functionResults []*FunctionResult,
+	splits []*Split,
+	truth *GroundTruth,
+) (*Evaluation, error) {
+	return EvaluateFingerprints(IntersectionsToFingerprints(intersections, functionResults), splits, truth)
+}
+
+// Matches every fingerprint to the tool sending most of the packets it matches and scores it against that tool
+func EvaluateFingerprints(fingerprints []*Fingerprint, splits []*Split, truth *GroundTruth) (*Evaluation, error) {
+	if len(truth.labels) != len(splits) {
+		return nil, fmt.Errorf("Ground truth has %d splits, expected %d", len(truth.labels), len(splits))
+	}
+	for i, spl := range splits {
+		if len(truth.labels[i]) != spl.size {
+			return nil, fmt.Errorf("Split %d has %d packets but %d labels", i, spl.size, len(truth.labels[i]))
+		}
+	}
+	matchers := Map[*Fingerprint, FingerprintFunc](fingerprints, func(x *Fingerprint) FingerprintFunc {
+		return FingerprintFromSigns(x.signs)
+	})
+	n_tools := len(truth.tools)
+	tool_packets := make([]int, n_tools)
+	// Per fingerprint, matched packets by label with background last
+	counts := make([][]int, len(fingerprints))
+	for i := range counts {
+		counts[i] = make([]int, n_tools + 1)
+	}
+	// Fingerprints matching each packet, so tool coverage can be computed once fingerprints are matched to tools
+	matching := make([][][]int, len(splits))
+	var p Packet
+	for i, spl := range splits {
+		matching[i] = make([][]int, spl.size)
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			label := truth.labels[i][j]
+			if label < 0 {
+				label = n_tools
+			} else {
+				tool_packets[label]++
+			}
+			for f_idx, f := range matchers {
+				if f(&p) {
+					counts[f_idx][label]++
+					matching[i][j] = append(matching[i][j], f_idx)
+				}
+			}
+		}
+	}
+
+	e := &Evaluation{
+		tools:			truth.tools,
+		fingerprints:	make([]*FingerprintEvaluation, len(fingerprints)),
+		per_tool:		make([]*ToolEvaluation, n_tools),
+	}
+	for t := range e.per_tool {
+		e.per_tool[t] = &ToolEvaluation{packets: tool_packets[t], fingerprints: make([]int, 0)}
+	}
+	for f_idx, c := range counts {
+		fe := &FingerprintEvaluation{tool: -1}
+		for t := 0; t <= n_tools; t++ {
+			fe.matched += c[t]
+			if t < n_tools && c[t] > 0 && (fe.tool < 0 || c[t] > c[fe.tool]) {
+				fe.tool = t
+			}
+		}
+		if fe.tool >= 0 {
+			fe.true_positives = c[fe.tool]
+			fe.recall = ratio(fe.true_positives, tool_packets[fe.tool])
+			e.per_tool[fe.tool].fingerprints = append(e.per_tool[fe.tool].fingerprints, f_idx)
+		}
+		fe.precision = ratio(fe.true_positives, fe.matched)
+		fe.f1 = f1Score(fe.precision, fe.recall)
+		e.fingerprints[f_idx] = fe
+	}
+
+	for i := range splits {
+		for j, f_idxs := range matching[i] {
+			label := truth.labels[i][j]
+			hit := false
+			for _, f_idx := range f_idxs {
+				if label >= 0 && e.fingerprints[f_idx].tool == label {
+					hit = true
+				}
+			}
+			switch {
+			case hit:
+				e.true_positives++
+				e.per_tool[label].true_positives++
+			case len(f_idxs) > 0:
+				e.false_positives++
+			}
+			if !hit && label >= 0 {
+				e.false_negatives++
+			}
+		}
+	}
+	for t, te := range e.per_tool {
+		te.recall = ratio(te.true_positives, te.packets)
+		if len(te.fingerprints) == 0 {
+			e.undiscovered = append(e.undiscovered, truth.tools[t])
+		}
+	}
+	e.precision = ratio(e.true_positives, e.true_positives + e.false_positives)
+	e.recall = ratio(e.true_positives, e.true_positives + e.false_negatives)
+	e.f1 = f1Score(e.precision, e.recall)
+	return e, nil
+}
+
+func SprintEvaluation(e *Evaluation, fingerprints []*Fingerprint, compositions []*TCPComposition) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Precision: %.4f, recall: %.4f, F1: %.4f\n", e.precision, e.recall, e.f1)
+	fmt.Fprintf(&b, "True positives: %d, false positives: %d, false negatives: %d\n", e.true_positives, e.false_positives, e.false_negatives)
+	for t, te := range e.per_tool {
+		fmt.Fprintf(&b, "Tool %s: %d packets, recall %.4f with fingerprints %v\n", e.tools[t], te.packets, te.recall, te.fingerprints)
+	}
+	if len(e.undiscovered) > 0 {
+		fmt.Fprintf(&b, "Undiscovered: %s\n", strings.Join(e.undiscovered, ", "))
+	}
+	for i, fe := range e.fingerprints {
+		tool := BackgroundLabel
+		if fe.tool >= 0 {
+			tool = e.tools[fe.tool]
+		}
+		fmt.Fprintf(&b, "\n%s", SprintFingerprint(fingerprints[i], i, compositions))
+		fmt.Fprintf(
+			&b, "Tool: %s, matched: %d, false positives: %d, precision: %.4f, recall: %.4f, F1: %.4f\n",
+			tool, fe.matched, fe.matched - fe.true_positives, fe.precision, fe.recall, fe.f1,
+		)
+	}
+	return b.String()
+}
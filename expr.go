@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Textual expressions for packet functions, e.g.
+//
+//	xor(xor(lbytes2(seq), seq), dst_ip) == 0x1234 && ip_id == 54321
+//
+// Leaves are the keys of Initial_set, binary operations take two arguments and
+// feature extractions take their parameter either as suffix (lbytes2(seq)) or as
+// last argument (lbytes(seq, 2)). Constants are usually written as last argument,
+// as in mask(rotl7(dst_ip), 0xffff).
+
+type exprTokenKind int
+
+const (
+	tokIdent exprTokenKind = iota
+	tokNumber
+	tokLParen
+	tokRParen
+	tokComma
+	tokEq
+	tokAnd
+	tokEOF
+)
+
+func (k exprTokenKind) String() string {
+	return [...]string{"identifier", "number", "'('", "')'", "','", "'=='", "'&&'", "end of input"}[k]
+}
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+// Syntax or type error at a position in the input
+type ExprError struct {
+	Input string
+	Pos   int
+	Msg   string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("column %d: %s\n  %s\n  %s^", e.Pos+1, e.Msg, e.Input, strings.Repeat(" ", e.Pos))
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func lexExpr(input string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0, len(input)/2)
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, exprToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, exprToken{tokRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, exprToken{tokComma, ",", i})
+			i++
+		case c == '=' && i+1 < len(input) && input[i+1] == '=':
+			tokens = append(tokens, exprToken{tokEq, "==", i})
+			i += 2
+		case c == '&' && i+1 < len(input) && input[i+1] == '&':
+			tokens = append(tokens, exprToken{tokAnd, "&&", i})
+			i += 2
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(input) && isIdentChar(input[j]) {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokNumber, input[i:j], i})
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(input) && isIdentChar(input[j]) {
+				j++
+			}
+			tokens = append(tokens, exprToken{tokIdent, input[i:j], i})
+			i = j
+		default:
+			return nil, &ExprError{input, i, fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, exprToken{tokEOF, "", len(input)}), nil
+}
+
+// Parsed function expression, with the width of its value once checked
+type exprNode struct {
+	op    string
+	n     uint64
+	has_n bool
+	args  []*exprNode
+	pos   int
+	end   int
+	width int
+}
+
+type exprParser struct {
+	input  string
+	tokens []exprToken
+	i      int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *exprParser) errorf(pos int, format string, a ...any) error {
+	return &ExprError{p.input, pos, fmt.Sprintf(format, a...)}
+}
+
+func (p *exprParser) expect(kind exprTokenKind) (exprToken, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.unexpected(tok, kind.String())
+	}
+	return tok, nil
+}
+
+func (p *exprParser) unexpected(tok exprToken, expected string) error {
+	if tok.kind == tokEOF {
+		return p.errorf(tok.pos, "expected %s, got end of input", expected)
+	}
+	return p.errorf(tok.pos, "expected %s, got %q", expected, tok.text)
+}
+
+func (p *exprParser) parseNumber() (uint64, int, error) {
+	tok := p.next()
+	if tok.kind != tokNumber {
+		return 0, tok.pos, p.unexpected(tok, "number")
+	}
+	v, err := strconv.ParseUint(tok.text, 0, 64)
+	if err != nil {
+		return 0, tok.pos, p.errorf(tok.pos, "invalid number %q", tok.text)
+	}
+	return v, tok.pos, nil
+}
+
+// Splits a trailing parameter off an operator name, as in lbytes2
+func splitSuffix(ident string) (string, uint64, bool) {
+	j := len(ident)
+	for j > 0 && ident[j-1] >= '0' && ident[j-1] <= '9' {
+		j--
+	}
+	if j == len(ident) || j == 0 {
+		return ident, 0, false
+	}
+	n, err := strconv.ParseUint(ident[j:], 10, 64)
+	if err != nil {
+		return ident, 0, false
+	}
+	return ident[:j], n, true
+}
+
+func (p *exprParser) parseFunction() (*exprNode, error) {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return nil, p.unexpected(tok, "function")
+	}
+	if init := initialByKey(tok.text); init != nil {
+		if p.peek().kind == tokLParen {
+			return nil, p.errorf(p.peek().pos, "%s is a packet field and takes no arguments", tok.text)
+		}
+		return &exprNode{op: tok.text, pos: tok.pos, end: tok.pos + len(tok.text), width: init.width}, nil
+	}
+
+	node := &exprNode{op: tok.text, pos: tok.pos}
+	_, is_binary := Binary_operations_by_name[tok.text]
+	_, is_feature := Feature_constructors[tok.text]
+	if !is_binary && !is_feature {
+		if op, n, ok := splitSuffix(tok.text); ok {
+			if _, ok := Feature_constructors[op]; ok {
+				node.op, node.n, node.has_n = op, n, true
+				is_feature = true
+			}
+		}
+	}
+	if !is_binary && !is_feature {
+		return nil, p.errorf(tok.pos, "unknown function %q", tok.text)
+	}
+
+	if _, err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	for {
+		if p.peek().kind == tokNumber {
+			if !is_feature || node.has_n || len(node.args) != 1 {
+				return nil, p.errorf(p.peek().pos, "%s does not take a number here", tok.text)
+			}
+			n, _, err := p.parseNumber()
+			if err != nil {
+				return nil, err
+			}
+			node.n, node.has_n = n, true
+		} else {
+			arg, err := p.parseFunction()
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+		}
+		tok := p.next()
+		if tok.kind == tokRParen {
+			node.end = tok.pos + 1
+			break
+		}
+		if tok.kind != tokComma {
+			return nil, p.unexpected(tok, "',' or ')'")
+		}
+	}
+	return node, p.check(node)
+}
+
+// Checks arity and computes the width of node
+func (p *exprParser) check(node *exprNode) error {
+	if _, ok := Binary_operations_by_name[node.op]; ok {
+		if len(node.args) != 2 {
+			return p.errorf(node.pos, "%s takes 2 arguments, got %d", node.op, len(node.args))
+		}
+		node.width = binaryWidth(node.args[0].width, node.args[1].width)
+		return nil
+	}
+	if len(node.args) != 1 {
+		return p.errorf(node.pos, "%s takes 1 argument, got %d", node.op, len(node.args))
+	}
+	if !node.has_n {
+		return p.errorf(node.pos, "%s needs a parameter, as in %s2(...)", node.op, node.op)
+	}
+	width, err := featureWidth(node.op, node.n, node.args[0].width)
+	if err != nil {
+		return p.errorf(node.pos, "%s", err)
+	}
+	node.width = width
+	return nil
+}
+
+func (node *exprNode) toJSON() *FunctionJSON {
+	f := &FunctionJSON{Op: node.op}
+	if node.has_n {
+		n := node.n
+		f.N = &n
+	}
+	for _, arg := range node.args {
+		f.Args = append(f.Args, arg.toJSON())
+	}
+	return f
+}
+
+func (p *exprParser) parseSign() (*Sign, *TCPComposition, error) {
+	node, err := p.parseFunction()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := p.expect(tokEq); err != nil {
+		return nil, nil, err
+	}
+	b, pos, err := p.parseNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	if node.width < 64 && b >= 1<<node.width {
+		return nil, nil, p.errorf(pos, "%d does not fit in the %d-bit value of %s", b, node.width, p.input[node.pos:node.end])
+	}
+	_, _, comp, err := FunctionFromJSON(node.toJSON())
+	if err != nil {
+		return nil, nil, p.errorf(node.pos, "%s", err)
+	}
+	f, _, err := CompileComposition(comp)
+	if err != nil {
+		return nil, nil, p.errorf(node.pos, "%s", err)
+	}
+	return &Sign{f: f, b: int(b)}, comp, nil
+}
+
+func newExprParser(input string) (*exprParser, error) {
+	tokens, err := lexExpr(input)
+	if err != nil {
+		return nil, err
+	}
+	return &exprParser{input: input, tokens: tokens}, nil
+}
+
+// Compiles a function expression such as xor(lbytes2(seq), seq)
+func ParseFunction(input string) (PacketFunction, int, *TCPComposition, error) {
+	p, err := newExprParser(input)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	node, err := p.parseFunction()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, 0, nil, p.unexpected(tok, "end of input")
+	}
+	return FunctionFromJSON(node.toJSON())
+}
+
+// Compiles a sign such as xor(lbytes2(seq), seq) == 0x1234
+func ParseSign(input string) (*Sign, *TCPComposition, error) {
+	p, err := newExprParser(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	sign, comp, err := p.parseSign()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, nil, p.unexpected(tok, "end of input")
+	}
+	return sign, comp, nil
+}
+
+// Compiles signs joined by &&, with idxs referring to the returned compositions
+func ParseFingerprint(input string) (*Fingerprint, []*TCPComposition, error) {
+	p, err := newExprParser(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	fgpt := &Fingerprint{}
+	compositions := make([]*TCPComposition, 0, 2)
+	for {
+		sign, comp, err := p.parseSign()
+		if err != nil {
+			return nil, nil, err
+		}
+		fgpt.signs = append(fgpt.signs, sign)
+		fgpt.idxs = append(fgpt.idxs, len(compositions))
+		compositions = append(compositions, comp)
+
+		tok := p.next()
+		if tok.kind == tokEOF {
+			return fgpt, compositions, nil
+		}
+		if tok.kind != tokAnd {
+			return nil, nil, p.unexpected(tok, "'&&' or end of input")
+		}
+	}
+}
+
+// Prints comp in the expression syntax, so it can be parsed back
+func TCPExpr(comp *TCPComposition) string {
+	switch len(comp.comp) {
+	case 0:
+		if init := initialByName(comp.name); init != nil {
+			return init.key
+		}
+		return comp.name
+	case 1:
+		if op, n, ok := parseFeatureName(comp.name); ok {
+			if Constant_features[op] {
+				return fmt.Sprintf("%s(%s, %#x)", op, TCPExpr(comp.comp[0]), n)
+			}
+			return fmt.Sprintf("%s%d(%s)", op, n, TCPExpr(comp.comp[0]))
+		}
+	}
+	args := Map[*TCPComposition, string](comp.comp, TCPExpr)
+	return fmt.Sprintf("%s(%s)", comp.name, strings.Join(args, ", "))
+}
+
+func SprintSignExpr(sign *Sign, comp *TCPComposition) string {
+	return fmt.Sprintf("%s == %d", TCPExpr(comp), uint64(sign.b))
+}
+
+// Prints fgpt as a single expression that ParseFingerprint accepts
+func SprintFingerprintExpr(fgpt *Fingerprint, compositions []*TCPComposition) string {
+	signs := make([]string, len(fgpt.signs))
+	for i, sign := range fgpt.signs {
+		signs[i] = SprintSignExpr(sign, compositions[fgpt.idxs[i]])
+	}
+	return strings.Join(signs, " && ")
+}
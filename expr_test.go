@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFunctionPrintsBack(t *testing.T) {
+	for _, c := range []struct {
+		input	string
+		want	string
+	}{
+		{"seq", "seq"},
+		{"xor(xor(lbytes2(seq), seq), dst_ip)", "xor(xor(lbytes2(seq), seq), dst_ip)"},
+		{"lbytes(seq, 2)", "lbytes2(seq)"},
+		{"rotl( dst_ip ,7 )", "rotl7(dst_ip)"},
+		{"mask(rotl7(dst_ip), 65535)", "mask(rotl7(dst_ip), 0xffff)"},
+		{"xorc(ip_id, 0x1234)", "xorc(ip_id, 0x1234)"},
+		{"mask(seq, 0)", "mask(seq, 0x0)"},
+		{"rbitshift3(mul(sub(ttl, window), add(ack, mss)))", "rbitshift3(mul(sub(ttl, window), add(ack, mss)))"},
+		{"and(or(rbytes1(src_port), rotr5(opt_layout)), lbitshift12(src_ip))", "and(or(rbytes1(src_port), rotr5(opt_layout)), lbitshift12(src_ip))"},
+	} {
+		_, _, comp, err := ParseFunction(c.input)
+		if err != nil {
+			t.Fatalf("%s: %s", c.input, err)
+		}
+		if got := TCPExpr(comp); got != c.want {
+			t.Errorf("%s printed as %s, want %s", c.input, got, c.want)
+		}
+	}
+}
+
+// Every generated function prints as an expression that parses to the same function
+func TestGeneratedFunctionsRoundTrip(t *testing.T) {
+	packets := RandomPackets(SeededRand(1, PacketStream), 200)
+	names := strings.Split("lbytes,rbytes,rotl,rotr,mask,xorc,lbitshift,rbitshift", ",")
+	feature_extractions, err := SelectFeatureExtractions(names, SeededRand(1, FunctionStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary_operations, err := SelectBinaryOperations(strings.Split("xor,and,or,add,sub,mul", ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, compositions := Generate_functions(SeededRand(1, FunctionStream), 2000, 0.5, Initial_set, binary_operations, feature_extractions)
+	for _, comp := range compositions {
+		expr := TCPExpr(comp)
+		_, _, parsed, err := ParseFunction(expr)
+		if err != nil {
+			t.Fatalf("%s: %s", expr, err)
+		}
+		if got := TCPExpr(parsed); got != expr {
+			t.Fatalf("%s printed back as %s", expr, got)
+		}
+		f, _, err := CompileComposition(comp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, _, err := CompileComposition(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range packets {
+			if f(p) != g(p) {
+				t.Fatalf("%s parses to a function computing %d instead of %d", expr, g(p), f(p))
+			}
+		}
+	}
+}
+
+func TestParseFunctionErrors(t *testing.T) {
+	for _, c := range []struct {
+		input	string
+		column	int
+		msg		string
+	}{
+		{"", 1, "expected function, got end of input"},
+		{"seq $", 5, "unexpected character '$'"},
+		{"seq ttl", 5, `expected end of input, got "ttl"`},
+		{"seq(ttl)", 4, "seq is a packet field and takes no arguments"},
+		{"popcount(seq)", 1, `unknown function "popcount"`},
+		{"xor(seq)", 1, "xor takes 2 arguments, got 1"},
+		{"xor(seq, ttl, ip_id)", 1, "xor takes 2 arguments, got 3"},
+		{"lbytes(seq)", 1, "lbytes needs a parameter, as in lbytes2(...)"},
+		{"xor(seq, 3)", 10, "xor does not take a number here"},
+		{"lbytes2(seq, 3)", 14, "lbytes2 does not take a number here"},
+		{"mask(7, seq)", 6, "mask does not take a number here"},
+		{"xor(seq ttl)", 9, `expected ',' or ')', got "ttl"`},
+		{"xor(seq, ttl", 13, "expected ',' or ')', got end of input"},
+		{"xor seq", 5, `expected '(', got "seq"`},
+		{"mask(seq, 0xzz)", 11, `invalid number "0xzz"`},
+		{"lbytes3(seq)", 1, "lbytes 3 of a 32-bit value gives 3 bytes, only 1, 2, 4 or 8 are supported"},
+		{"rotl16(ip_id)", 1, "rotl 16 exceeds the 16-bit value"},
+		{"xorc(ttl, 0x100)", 1, "xorc constant 0x100 does not fit in the 8-bit value"},
+	} {
+		_, _, _, err := ParseFunction(c.input)
+		expr_err, ok := err.(*ExprError)
+		if !ok {
+			t.Errorf("%q: got error %v, want an expression error", c.input, err)
+			continue
+		}
+		if expr_err.Pos + 1 != c.column || !strings.HasPrefix(expr_err.Msg, c.msg) {
+			t.Errorf("%q: got %q at column %d, want %q at column %d", c.input, expr_err.Msg, expr_err.Pos + 1, c.msg, c.column)
+		}
+	}
+}
+
+func TestParseFingerprintErrors(t *testing.T) {
+	for _, c := range []struct {
+		input	string
+		column	int
+		msg		string
+	}{
+		{"ttl", 4, "expected '==', got end of input"},
+		{"ttl = 1", 5, "unexpected character '='"},
+		{"ttl == ", 8, "expected number, got end of input"},
+		{"ttl == seq", 8, `expected number, got "seq"`},
+		{"ttl == 256", 8, "256 does not fit in the 8-bit value of ttl"},
+		{"xor(ttl, ip_id) == 65536", 20, "65536 does not fit in the 16-bit value of xor(ttl, ip_id)"},
+		{"ttl == 1 &&", 12, "expected function, got end of input"},
+		{"ttl == 1 seq == 2", 10, `expected '&&' or end of input, got "seq"`},
+	} {
+		_, _, err := ParseFingerprint(c.input)
+		expr_err, ok := err.(*ExprError)
+		if !ok {
+			t.Errorf("%q: got error %v, want an expression error", c.input, err)
+			continue
+		}
+		if expr_err.Pos + 1 != c.column || !strings.HasPrefix(expr_err.Msg, c.msg) {
+			t.Errorf("%q: got %q at column %d, want %q at column %d", c.input, expr_err.Msg, expr_err.Pos + 1, c.msg, c.column)
+		}
+	}
+	_, _, err := ParseFingerprint("ttl == 1 && seq == 0x1zz")
+	want := "column 20: invalid number \"0x1zz\"\n  ttl == 1 && seq == 0x1zz\n                     ^"
+	if err == nil || err.Error() != want {
+		t.Errorf("Got error\n%v\nwant\n%s", err, want)
+	}
+}
+
+// The fingerprint printed in the text format parses back to one matching the same packets
+func TestSprintFingerprintParses(t *testing.T) {
+	input := "xor(seq, dst_ip) == 0 && dst_port == 23 && xor(lbytes2(seq), rotl7(ip_id)) == 1234"
+	fgpt, compositions, err := ParseFingerprint(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := SprintFingerprint(fgpt, 0, compositions)
+	_, expr, ok := strings.Cut(text, "\nExpr: ")
+	if !ok {
+		t.Fatalf("No expression in\n%s", text)
+	}
+	if expr = strings.TrimSuffix(expr, "\n"); expr != input {
+		t.Errorf("Printed %s, want %s", expr, input)
+	}
+	if _, _, err := ParseFingerprint(expr); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,7 @@
 package main 
 
 import (
+	"context"
 	"errors"
 	"math/rand/v2"
 	"math"
@@ -8,17 +9,26 @@ import (
 	"log"
 	"github.com/montanaflynn/stats"
 	"reflect"
+	"slices"
+	"cmp"
+	"strings"
+	"strconv"
+	"fmt"
 )
 
+// Stops early when ctx is cancelled, returning the results found so far and the error of ctx
 func find_effective_signs(
-	functions []PacketFunction,
+	ctx context.Context,
+	functions []TypedFunction,
+	columns []ColumnFunction,
 	splits []*Split,
 	sign_thres float64,
 	max_sign int,
+	scorer SignScorer,
 	bad_functions map[int]struct{},
 	n_function_worker int,
 	n_split_worker int,
-) []*FunctionResult {
+) ([]*FunctionResult, error) {
 	// Set up channels
 	tasks := make(chan *FunctionJob, len(functions))
 	results := make(chan *FunctionResult) 
@@ -34,17 +44,23 @@ func find_effective_signs(
 	var wg sync.WaitGroup
 	// Send jobs to channel
 	for i, f := range functions {
+		if ctx.Err() != nil {
+			break
+		}
 		// If bad function, dont compute
 		if _, ok := bad_functions[i]; ok {
 			continue
 		}
 		wg.Add(1)
 		tasks <- &FunctionJob{
+			ctx: 		ctx,
 			function: 	f,
+			columns: 	columns[i],
 			index:		i,
 			splits:		&splits,
 			sign_thres:	sign_thres,
 			max_sign:	max_sign,
+			scorer:		scorer,
 			wg:			&wg,
 		}
 	}
@@ -61,15 +77,20 @@ func find_effective_signs(
 	for result := range results {
 		ret = append(ret, result)
 	}
+	// Results arrive in the order workers finish, a worker sends the signs of a function in order
+	slices.SortStableFunc(ret, func(a, b *FunctionResult) int {
+		return cmp.Compare(a.index, b.index)
+	})
 
-	return ret
+	return ret, ctx.Err()
 }
 
-func select_random(inp []interface{}) interface{} {
-	return inp[rand.IntN(len(inp))]
+func select_random(r *rand.Rand, inp []interface{}) interface{} {
+	return inp[r.IntN(len(inp))]
 }
 
 func select_function(
+	r *rand.Rand,
 	functions []PacketFunction,
 	counts []int,
 	compositions []*TCPComposition,
@@ -82,11 +103,11 @@ func select_function(
 		f_probs[i] = f_prob
 	}
 
-	r := rand.Float64() * total_prob
+	x := r.Float64() * total_prob
 	cumCount := 0.0
 	for i, c := range f_probs {
 		cumCount += c
-		if r <= cumCount {
+		if x <= cumCount {
 			return functions[i], counts[i], compositions[i]
 		}
 	}
@@ -95,6 +116,7 @@ func select_function(
 }
 
 func gen_func(
+	r *rand.Rand,
 	featext_probability float64, 
 	functions []PacketFunction, 
 	counts []int,
@@ -102,39 +124,38 @@ func gen_func(
 	binary_operations []BinaryFunction,
 	feature_extractions []FeatureFunction,
 ) (PacketFunction, int, *TCPComposition) {
-	if rand.Float64() > featext_probability {
-		fa, ca, comp_a := select_function(functions, counts, compositions)
-		fb, cb, comp_b := select_function(functions, counts, compositions)
-		bin_op := binary_operations[rand.IntN(len(binary_operations))]
+	if r.Float64() > featext_probability {
+		fa, ca, comp_a := select_function(r, functions, counts, compositions)
+		fb, cb, comp_b := select_function(r, functions, counts, compositions)
+		bin_op := binary_operations[r.IntN(len(binary_operations))]
 		return bin_op(fa, ca, comp_a, fb, cb, comp_b)
 	} else {
-		f, c, comp := select_function(functions, counts, compositions)
-		feat_ext := feature_extractions[rand.IntN(len(feature_extractions))]
+		f, c, comp := select_function(r, functions, counts, compositions)
+		feat_ext := feature_extractions[r.IntN(len(feature_extractions))]
 		return feat_ext(f, c, comp)
 	}
 }
 
+// Draws every random decision from r, so the same r and arguments give the same functions
 func Generate_functions(
+	r *rand.Rand,
 	n int, 
 	featext_probability float64, 
-	initial_set []PacketFunction,
+	initial_set []*InitialFunction,
 	binary_operations []BinaryFunction,
 	feature_extractions []FeatureFunction,
 ) ([]PacketFunction, []int, []*TCPComposition) {
-	var functions = initial_set
-	var counts = []int{1, 1, 1, 1, 1, 1, 1}
-	var compositions = []*TCPComposition{
-		&TCPComposition{"Get IP Id", []*TCPComposition{}}, 
-		&TCPComposition{"Get Src IP", []*TCPComposition{}},
-		&TCPComposition{"Get Dst IP", []*TCPComposition{}},
-		&TCPComposition{"Get Src Port", []*TCPComposition{}},
-		&TCPComposition{"Get Dst Port", []*TCPComposition{}},
-		&TCPComposition{"Get Seq", []*TCPComposition{}},
-		&TCPComposition{"Get Window", []*TCPComposition{}},
+	functions := make([]PacketFunction, 0, len(initial_set) + n)
+	counts := make([]int, 0, len(initial_set) + n)
+	compositions := make([]*TCPComposition, 0, len(initial_set) + n)
+	for _, init := range initial_set {
+		functions = append(functions, init.f)
+		counts = append(counts, 1)
+		compositions = append(compositions, &TCPComposition{init.name, []*TCPComposition{}})
 	}
 
 	for i := 0; i < n; i++ {
-		f, c, comp := gen_func(featext_probability, functions, counts, compositions, binary_operations, feature_extractions)
+		f, c, comp := gen_func(r, featext_probability, functions, counts, compositions, binary_operations, feature_extractions)
 		functions = append(functions, f)
 		counts = append(counts, c)
 		compositions = append(compositions, comp)
@@ -148,6 +169,11 @@ func effective_indicator(x float64, appearanceRatios []float64) (float64, error)
 	if len(r_less) < 1 {
 		return 1, nil
 	}
+	// Equal ratios have no variance, but the computed one is rounding noise that would give any
+	// binary seen once more than the rest, such as a collision of random values, a huge indicator
+	if slices.Min(r_less) == slices.Max(r_less) {
+		return 0.0, errors.New("r_less ratios all equal")
+	}
 	r_less_var, err := stats.SampleVariance(r_less)
 	if err != nil {
 		return 0.0, err 
@@ -166,12 +192,18 @@ func effective_indicator(x float64, appearanceRatios []float64) (float64, error)
 	}
 }
 
+// columns holds the column functions signs index, to filter the packets of every sign by
 func ConsolidateSigns(
+	ctx context.Context,
 	splits []*Split,
 	signs []*FunctionResult,
+	columns []ColumnFunction,
 	n_workers int,
+	n_intersection_workers int,
+	max_ports int,
 	max_iterations int,
 	min_overlap float64,
+	max_sets int,
 	startIndex int,
 ) ([]*Intersection, map[int]struct{}, error) {
 	tasks := make(chan *FilterPacketsJob, len(splits) * len(signs))
@@ -189,8 +221,10 @@ func ConsolidateSigns(
 		for idx, sign := range signs {
 			wg.Add(1)
 			tasks <- &FilterPacketsJob{
+				ctx: 		ctx,
 				idx:		idx,
 				f_result: 	sign,
+				columns:	columns[sign.index],
 				split_idx:	split_idx,
 				packets: 	split.packets,	
 				wg: 		&wg,
@@ -211,24 +245,21 @@ func ConsolidateSigns(
 	for result := range results {
 		// If too many ports drop sign, because it is likely a bad TCP function
 		// Also flag underlying function as "bad"
-		if result.n_ports > 20 {
+		if result.n_ports > max_ports {
 			bad_functions[result.f_idx] = struct{}{}
 			continue
 		}
 		if inter, ok := set_intersections[result.idx]; ok {
-			ps := append(inter.packets, result.packets...)
-			set_intersections[result.idx] = &Intersection{
-				idxs:		inter.idxs,
-				f_idxs:		inter.f_idxs,
-				packets:	ps,
-				size: 		len(ps),
-			}
+			inter.packets.SetSplit(result.split_idx, result.packets)
+			inter.size += result.packets.Len()
 		} else {
+			packets := NewPacketSet()
+			packets.SetSplit(result.split_idx, result.packets)
 			set_intersections[result.idx] = &Intersection{
 				idxs:		[]int{startIndex + result.idx},
 				f_idxs:		[]int{signs[result.idx].index},
-				packets: 	result.packets,
-				size:		len(result.packets),
+				packets: 	packets,
+				size:		result.packets.Len(),
 			}
 		}
 	}
@@ -237,57 +268,19 @@ func ConsolidateSigns(
 	for _, inter := range set_intersections {
 		intersections = append(intersections, inter) 
 	}
+	slices.SortFunc(intersections, func(a, b *Intersection) int {
+		return cmp.Compare(a.idxs[0], b.idxs[0])
+	})
+	// Packets of some signs were not filtered
+	if err := ctx.Err(); err != nil {
+		return []*Intersection{}, bad_functions, err
+	}
 
 	log.Printf("    Number of true signs: %d\n", len(intersections))
-	if len(intersections) > 15 {
-		return intersections, bad_functions, errors.New("Too many true signs")
-	}
 	log.Printf("    Recursively intersecting filtered packets by signs with max iterations: %d\n", max_iterations)
-	len_prev_intersections := 0
-	for ; math.Abs(float64(len_prev_intersections - len(intersections))) > 0 && max_iterations > 0; max_iterations-- {
-		log.Printf("     Iterations left: %d\n", max_iterations)
-		len_prev_intersections = len(intersections)
-
-		n_tasks := 1 << len(intersections)
-
-		intTasks := make(chan *IntersectionJob, n_tasks)
-		intResults := make(chan *Intersection, n_tasks)
-
-		for i := 0; i < 32; i++ {
-			go IntersectionWorker(
-				&Worker[*IntersectionJob, *Intersection]{i, intTasks, intResults},
-			)
-		}
-		log.Printf("STARTED WORKERS\n")
-
-		subset := make([]*Intersection, 0, len(intersections))
-		generateCombinations(&IntersectionJob{
-			xs:				intersections,
-			min_overlap: 	min_overlap,
-			wg:				&wg,
-			startIndex: 	startIndex,
-		}, subset, intTasks, 0, 0)
-		
-		close(intTasks)
-
-		log.Printf("WAITING FOR RESULTS\n")
-
-		go func() {
-			wg.Wait()
-			close(intResults)
-		}()
-
-		new_intersections := make([]*Intersection, 0, len(intersections))
-		for result := range intResults {
-			// if !intersectionInList(new_intersections, result) {
-			// 	new_intersections = append(new_intersections, result)
-			// }
-			new_intersections = AddIntersection(new_intersections, result)
-		}
-
-		log.Printf("    Got %d intersections...\n", len(new_intersections))
-
-		intersections = new_intersections // Replace old intersections with new found ones
+	intersections, err := consolidateIntersections(ctx, intersections, n_intersection_workers, max_iterations, min_overlap, max_sets)
+	if err != nil {
+		return intersections, bad_functions, err
 	}
 
 	// log.Printf("    Mapping intersections to fingerprints...\n")
@@ -315,8 +308,11 @@ func AddIntersection(list []*Intersection, item *Intersection) []*Intersection {
 	for _, existing := range list {
 		// If an intersection contains less signs then new one, then it could be the same intersection with less signs
 		if len(existing.idxs) <= len(item.idxs) && containsAll(item.idxs, existing.idxs) {
+			// Only once, it can replace several smaller intersections
+			if !added {
+				res = append(res, item)
+			}
 			added = true
-			res = append(res, item)
 		// Larger intersection could also already be added
 		} else if len(item.idxs) <= len(existing.idxs) && containsAll(existing.idxs, item.idxs) {
 			added = true 
@@ -360,23 +356,11 @@ func intersectionInList(list []*Intersection, item *Intersection) bool {
 	return false
 }
 
-func intersect(x, y []*PacketIndex) []*PacketIndex {
-	set := make(map[PacketIndex]struct{})
-	for _, idx := range x {
-		set[*idx] = struct{}{}
-	}
-
-	intersection := make([]*PacketIndex, 0, 100000)
-	for _, idx := range y {
-		if _, ok := set[*idx]; ok {
-			intersection = append(intersection, idx)
-		}
-	} 
-	
-	return intersection
+func intersect(x, y *PacketSet) *PacketSet {
+	return x.And(y)
 }
 
-func intersectAll(xs ...[]*PacketIndex) []*PacketIndex {
+func intersectAll(xs ...*PacketSet) *PacketSet {
 	inter := xs[0]
 	for i := 1; i < len(xs); i++ {
 		inter = intersect(inter, xs[i])
@@ -400,30 +384,224 @@ func appendIdxs(x, y []int) (ret []int) {
 	return
 }
 
-func generateCombinations(
-	job *IntersectionJob,
-	subset []*Intersection,
-	tasks chan *IntersectionJob,
-	index int,
-	count int,
-) {
-	temp := make([]*Intersection, len(subset))
-	copy(temp, subset)
-	if len(temp) > 0 {
-		job.wg.Add(1)
-		tasks <- &IntersectionJob{
-			xs:				temp,	
-			min_overlap:	job.min_overlap,
-			wg:				job.wg,
-			startIndex:		job.startIndex,
+// Merges overlapping intersections until their number no longer changes. Every round replaces the
+// intersections by the largest sets of them whose packets overlap the smallest member of the set.
+// When ctx is cancelled the intersections of the last finished round are returned.
+func consolidateIntersections(
+	ctx context.Context,
+	intersections []*Intersection,
+	n_workers int,
+	max_iterations int,
+	min_overlap float64,
+	max_sets int,
+) ([]*Intersection, error) {
+	len_prev_intersections := 0
+	for ; math.Abs(float64(len_prev_intersections - len(intersections))) > 0 && max_iterations > 0; max_iterations-- {
+		if err := ctx.Err(); err != nil {
+			return intersections, err
+		}
+		log.Printf("     Iterations left: %d\n", max_iterations)
+		len_prev_intersections = len(intersections)
+
+		xs := mergeEqualIntersections(intersections)
+
+		tasks := make(chan *IntersectionJob, len(xs))
+		results := make(chan *IntersectionResult, len(xs))
+
+		for i := 0; i < Min(n_workers, len(xs)); i++ {
+			go IntersectionWorker(
+				&Worker[*IntersectionJob, *IntersectionResult]{i, tasks, results},
+			)
 		}
+
+		var wg sync.WaitGroup
+		for anchor := range xs {
+			wg.Add(1)
+			tasks <- &IntersectionJob{
+				ctx:			ctx,
+				anchor:			anchor,
+				xs:				xs,
+				min_overlap:	min_overlap,
+				max_sets:		max_sets,
+				wg:				&wg,
+			}
+		}
+		close(tasks)
+
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		// Merge in anchor order, so the result does not depend on scheduling
+		by_anchor := make([][]*Intersection, len(xs))
+		var lattice_err error
+		for result := range results {
+			if result.err != nil {
+				lattice_err = result.err
+				continue
+			}
+			by_anchor[result.anchor] = result.intersections
+		}
+		if err := ctx.Err(); err != nil {
+			return intersections, err
+		}
+		if lattice_err != nil {
+			return intersections, lattice_err
+		}
+
+		new_intersections := make([]*Intersection, 0, len(intersections))
+		for _, found := range by_anchor {
+			for _, inter := range found {
+				new_intersections = AddIntersection(new_intersections, inter)
+			}
+		}
+
+		log.Printf("    Got %d intersections...\n", len(new_intersections))
+
+		intersections = new_intersections // Replace old intersections with new found ones
 	}
+	return intersections, nil
+}
 
-	for i := index; i < len(job.xs); i++ {
-		subset = append(subset, job.xs[i])
+// Sorts intersections by size and merges those with exactly the same packets, as they overlap
+// each other in every set and would otherwise make the number of sets explode
+func mergeEqualIntersections(intersections []*Intersection) []*Intersection {
+	sorted := make([]*Intersection, len(intersections))
+	copy(sorted, intersections)
+	slices.SortFunc(sorted, func(a, b *Intersection) int {
+		return cmp.Or(cmp.Compare(a.size, b.size), cmp.Compare(a.idxs[0], b.idxs[0]))
+	})
+
+	merged := make([]*Intersection, 0, len(sorted))
+	for _, inter := range sorted {
+		equal := -1
+		for i := len(merged) - 1; i >= 0 && merged[i].size == inter.size; i-- {
+			if inter.size > 0 && intersect(merged[i].packets, inter.packets).Len() == inter.size {
+				equal = i
+				break
+			}
+		}
+		if equal == -1 {
+			merged = append(merged, inter)
+			continue
+		}
+		merged[equal] = &Intersection{
+			idxs:		appendIdxs(merged[equal].idxs, inter.idxs),
+			f_idxs:		appendIdxs(merged[equal].f_idxs, inter.f_idxs),
+			packets:	merged[equal].packets,
+			size:		merged[equal].size,
+		}
+	}
+	return merged
+}
+
+// Set of intersections, as increasing positions in the sorted intersections, with the packets in all of them
+type latticeSet struct {
+	members []int
+	packets *PacketSet
+}
+
+func latticeKey(members []int) string {
+	var b strings.Builder
+	for _, m := range members {
+		b.WriteString(strconv.Itoa(m))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+func (s *latticeSet) toIntersection(xs []*Intersection) *Intersection {
+	members := Map[int, *Intersection](s.members, func(i int) *Intersection {
+		return xs[i]
+	})
+	return &Intersection{
+		idxs:		Reduce[[]int, []int](Map[*Intersection, []int](members, func(a *Intersection) []int { return a.idxs }), []int{}, appendIdxs),
+		f_idxs:		Reduce[[]int, []int](Map[*Intersection, []int](members, func(a *Intersection) []int { return a.f_idxs }), []int{}, appendIdxs),
+		packets:	s.packets,
+		size:		s.packets.Len(),
+	}
+}
+
+// Level-wise search of the sets of xs, sorted by size, whose smallest member is xs[anchor] and whose
+// packets overlap it. Adding a member can only shrink the intersection, so sets that no longer
+// overlap the anchor are not extended and a candidate is only checked if all its subsets overlap.
+// Returns the sets without an overlapping superset, or an error if more than max_sets overlap or
+// ctx is cancelled.
+func consolidateFrom(
+	ctx context.Context,
+	anchor int,
+	xs []*Intersection,
+	min_overlap float64,
+	max_sets int,
+) ([]*Intersection, error) {
+	a := xs[anchor]
+	if !overlap(min_overlap, a.packets, a) {
+		return []*Intersection{a}, nil
+	}
 
-		generateCombinations(job, subset, tasks, i+1, count + i - index)
+	level := make([]*latticeSet, 0)
+	for y := anchor + 1; y < len(xs); y++ {
+		packets := intersect(a.packets, xs[y].packets)
+		if overlap(min_overlap, packets, a) {
+			level = append(level, &latticeSet{[]int{anchor, y}, packets})
+		}
+	}
+	if len(level) == 0 {
+		return []*Intersection{a}, nil
+	}
 
-		subset = subset[:len(subset)-1]
+	maximal := make([]*Intersection, 0)
+	n_sets := 1
+	for len(level) > 0 {
+		n_sets += len(level)
+		if n_sets > max_sets {
+			return nil, fmt.Errorf("Too many true signs, more than %d overlapping sets", max_sets)
+		}
+		index := make(map[string]int, len(level))
+		for i, s := range level {
+			index[latticeKey(s.members)] = i
+		}
+		extended := make([]bool, len(level))
+		next := make([]*latticeSet, 0)
+		// Level is sorted, so sets sharing all but their last member are adjacent
+		for i := 0; i < len(level); i++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			prefix := level[i].members[:len(level[i].members) - 1]
+			for j := i + 1; j < len(level) && slices.Equal(prefix, level[j].members[:len(prefix)]); j++ {
+				last := level[j].members[len(prefix)]
+				members := append(slices.Clone(level[i].members), last)
+				// Every subset keeping the anchor has to overlap as well
+				subsets := make([]int, 0, len(members) - 1)
+				for k := 1; k < len(members); k++ {
+					sub := slices.Delete(slices.Clone(members), k, k + 1)
+					if idx, ok := index[latticeKey(sub)]; ok {
+						subsets = append(subsets, idx)
+					} else {
+						break
+					}
+				}
+				if len(subsets) != len(members) - 1 {
+					continue
+				}
+				packets := intersect(level[i].packets, xs[last].packets)
+				if !overlap(min_overlap, packets, a) {
+					continue
+				}
+				next = append(next, &latticeSet{members, packets})
+				for _, idx := range subsets {
+					extended[idx] = true
+				}
+			}
+		}
+		for i, s := range level {
+			if !extended[i] {
+				maximal = append(maximal, s.toIntersection(xs))
+			}
+		}
+		level = next
 	}
-}
\ No newline at end of file
+	return maximal, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Intersections of single signs over a few splits, built from shared cores so that many overlap and
+// some have exactly the same packets
+func randomIntersections(r *rand.Rand, n int) []*Intersection {
+	const n_splits, n_packets = 2, 48
+	cores := make([]*PacketSet, 3)
+	for i := range cores {
+		cores[i] = NewPacketSet()
+		for k := 0; k < 24; k++ {
+			cores[i].Add(r.IntN(n_splits), r.IntN(n_packets))
+		}
+	}
+	xs := make([]*Intersection, 0, n)
+	for i := 0; i < n; i++ {
+		packets := NewPacketSet()
+		if i > 0 && r.IntN(5) == 0 {
+			packets = xs[r.IntN(i)].packets
+		} else {
+			core := cores[r.IntN(len(cores))]
+			for s, b := range core.Splits() {
+				b.ForEach(func(j uint32) {
+					if r.IntN(10) != 0 {
+						packets.Add(s, int(j))
+					}
+				})
+			}
+			for k := r.IntN(4); k > 0; k-- {
+				packets.Add(r.IntN(n_splits), r.IntN(n_packets))
+			}
+		}
+		xs = append(xs, &Intersection{
+			idxs:		[]int{i},
+			f_idxs:		[]int{100 + i},
+			packets:	packets,
+			size:		packets.Len(),
+		})
+	}
+	return xs
+}
+
+// Every set of xs whose packets overlap its smallest member, keeping those without such a superset
+func bruteForceMaximal(xs []*Intersection, min_overlap float64) map[string]int {
+	overlapping := make([][]int, 0)
+	sizes := make([]int, 0)
+	for mask := 1; mask < 1 << len(xs); mask++ {
+		members := make([]int, 0, len(xs))
+		for i := range xs {
+			if mask & (1 << i) != 0 {
+				members = append(members, i)
+			}
+		}
+		smallest := xs[members[0]]
+		packets := xs[members[0]].packets
+		for _, m := range members[1:] {
+			packets = packets.And(xs[m].packets)
+			if xs[m].size < smallest.size {
+				smallest = xs[m]
+			}
+		}
+		if overlap(min_overlap, packets, smallest) {
+			overlapping = append(overlapping, members)
+			sizes = append(sizes, packets.Len())
+		}
+	}
+	maximal := make(map[string]int)
+	for i, members := range overlapping {
+		superset := false
+		for _, other := range overlapping {
+			if len(other) > len(members) && containsAll(other, members) {
+				superset = true
+				break
+			}
+		}
+		if !superset {
+			maximal[latticeKey(members)] = sizes[i]
+		}
+	}
+	return maximal
+}
+
+func TestConsolidateIntersectionsMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for _, min_overlap := range []float64{0.5, 0.75, 0.9} {
+		for trial := 0; trial < 50; trial++ {
+			xs := randomIntersections(r, 3 + r.IntN(7))
+			want := bruteForceMaximal(xs, min_overlap)
+
+			got, err := consolidateIntersections(context.Background(), xs, 4, 1, min_overlap, 1 << 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := make(map[string]int, len(got))
+			for _, inter := range got {
+				idxs := slices.Clone(inter.idxs)
+				slices.Sort(idxs)
+				key := latticeKey(idxs)
+				if _, ok := found[key]; ok {
+					t.Fatalf("min overlap %.2f, trial %d: %v found twice", min_overlap, trial, idxs)
+				}
+				found[key] = inter.size
+				if inter.size != inter.packets.Len() {
+					t.Fatalf("min overlap %.2f, trial %d: %v has size %d for %d packets", min_overlap, trial, idxs, inter.size, inter.packets.Len())
+				}
+			}
+			if len(found) != len(want) {
+				t.Fatalf("min overlap %.2f, trial %d: got %v, want %v", min_overlap, trial, found, want)
+			}
+			for key, size := range want {
+				if found_size, ok := found[key]; !ok || found_size != size {
+					t.Fatalf("min overlap %.2f, trial %d: got %v, want %v", min_overlap, trial, found, want)
+				}
+			}
+		}
+	}
+}
+
+func TestConsolidateFromTooManySets(t *testing.T) {
+	packets := NewPacketSet()
+	for j := 0; j < 10; j++ {
+		packets.Add(0, j)
+	}
+	xs := make([]*Intersection, 8)
+	for i := range xs {
+		xs[i] = &Intersection{idxs: []int{i}, f_idxs: []int{i}, packets: packets, size: packets.Len()}
+	}
+	// All 128 sets containing the anchor overlap it
+	if _, err := consolidateFrom(context.Background(), 0, xs, 0.9, 127); err == nil {
+		t.Fatal("Expected an error for 128 overlapping sets with a limit of 127")
+	}
+	got, err := consolidateFrom(context.Background(), 0, xs, 0.9, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].idxs) != len(xs) {
+		t.Fatalf("Expected one set of all intersections, got %d", len(got))
+	}
+}
+
+func TestAddIntersectionReplacesSubsetsOnce(t *testing.T) {
+	inter := func(idxs ...int) *Intersection {
+		return &Intersection{idxs: idxs, f_idxs: idxs, packets: NewPacketSet()}
+	}
+	list := []*Intersection{inter(1), inter(2, 3), inter(4)}
+	list = AddIntersection(list, inter(1, 2, 3))
+	if len(list) != 2 || !slices.Equal(list[0].idxs, []int{1, 2, 3}) || !slices.Equal(list[1].idxs, []int{4}) {
+		t.Fatalf("Got %v", Map[*Intersection, []int](list, func(x *Intersection) []int { return x.idxs }))
+	}
+	list = AddIntersection(list, inter(2, 3))
+	if len(list) != 2 {
+		t.Fatalf("A subset of an intersection was added, got %d intersections", len(list))
+	}
+}
+
+// A binary above ratios that are all equal, as for a collision of random values, is not scored as a sign
+func TestEffectiveIndicatorEqualRatios(t *testing.T) {
+	ratios := []float64{2.0 / 700}
+	for i := 0; i < 698; i++ {
+		ratios = append(ratios, 1.0 / 700)
+	}
+	if ef, err := effective_indicator(ratios[0], ratios); err == nil || ef != 0 {
+		t.Fatalf("Got indicator %g for equal ratios below, want an error", ef)
+	}
+
+	ratios = []float64{0.3, 0.002, 0.001, 0.001}
+	ef, err := effective_indicator(ratios[0], ratios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ef <= 1 || math.IsInf(ef, 0) {
+		t.Fatalf("Got indicator %g for a binary above varying ratios", ef)
+	}
+}
+
+// A function with a single binary scoring above the threshold gives that binary as its sign
+func TestFindEffectiveSignsKeepsLastSign(t *testing.T) {
+	packets := make([]*Packet, 1000)
+	for j := range packets {
+		p := &Packet{IPId: uint16(j)}
+		switch {
+		case j < 300:
+			p.IPId = ZMapIPId
+		case j >= 800:
+			p.IPId = uint16(10000 + j / 2)
+		}
+		packets[j] = p
+	}
+	compositions := []*TCPComposition{{"Get IP Id", []*TCPComposition{}}}
+	functions, err := CompileCompositions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	splits := []*Split{NewSplit("0", PacketsToColumns(packets))}
+	results, err := find_effective_signs(
+		context.Background(),
+		functions,
+		columns,
+		splits,
+		500,
+		10,
+		VarianceRatioScorer{},
+		map[int]struct{}{},
+		1,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].sign.b != ZMapIPId {
+		t.Fatalf("Got %d signs, want only ip_id %d", len(results), ZMapIPId)
+	}
+}
+
+// The packets filtered by a sign over columns are those its function matches row by row
+func TestConsolidateSignsFiltersColumns(t *testing.T) {
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.2), MasscanTool(0.2)}, 3, 3000, 8, fixtureStart, time.Hour)
+	compositions := []*TCPComposition{
+		{"Get IP Id", []*TCPComposition{}},
+		{"Get TTL", []*TCPComposition{}},
+	}
+	functions, err := CompileCompositions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signs := []*FunctionResult{
+		{sign: &Sign{f: functions[0], b: ZMapIPId}, index: 0},
+		{sign: &Sign{f: functions[1], b: 255}, index: 1},
+	}
+	intersections, _, err := ConsolidateSigns(context.Background(), data.splits, signs, columns, 2, 1, 100, 0, 0.9, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inter := range intersections {
+		sign := signs[inter.idxs[0]].sign
+		var p Packet
+		for split_idx, spl := range data.splits {
+			for j := 0; j < spl.size; j++ {
+				spl.packets.Row(j, &p)
+				if (int(sign.f(&p)) == sign.b) != inter.packets.Contains(split_idx, j) {
+					t.Fatalf("Sign %d, split %d, packet %d filtered wrongly", inter.idxs[0], split_idx, j)
+				}
+			}
+		}
+	}
+	if len(intersections) != 2 {
+		t.Fatalf("Got %d intersections, want one per sign", len(intersections))
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math/rand/v2"
 	"errors"
 )
 
+// Returns the fingerprints found so far and the error of ctx if ctx is cancelled before the iterations are done,
+// and no compositions if the functions cannot be generated or compiled.
+// Functions are generated from r, which sampled feature_extractions should share, and samples are drawn from
+// seed, so the same r, seed and splits give the same fingerprints.
+// With a checkpoint_path the state is written there after every successful iteration, and with resume
+// the search continues from such a checkpoint, taking its functions, parameters, seed and config.
 func Fgpt_ident_iterative(
+	ctx context.Context,
 	splits []*Split,
 	n_functions int,
 	featext_probability float64,
-	initial_set []PacketFunction,
+	initial_set []*InitialFunction,
 	binary_operations []BinaryFunction,
 	feature_extractions []FeatureFunction,
 	n_samples int,
@@ -18,40 +27,93 @@ func Fgpt_ident_iterative(
 	max_sign int,
 	n_iterations int,
 	n_packets int,
-	seed1 uint64,
-	seed2 uint64,
-) ([]*Intersection, []*FunctionResult, []*TCPComposition) {
-
-	
-	log.Printf("Generating %d functions...\n", n_functions)
-	// Generate n functions
-	functions, _, compositions := Generate_functions(
-		n_functions,
-		featext_probability,
-		initial_set,
-		binary_operations,
-		feature_extractions,
-	)
+	r *rand.Rand,
+	seed uint64,
+	config *Config,
+	checkpoint_path string,
+	resume *Checkpoint,
+) ([]*Intersection, []*FunctionResult, []*TCPComposition, error) {
+
+	var compositions []*TCPComposition
+	all_bad_functions := make(map[int]struct{})
+	if resume != nil {
+		compositions = resume.compositions
+	} else {
+		var err error
+		compositions, all_bad_functions, err = Generate_compositions(
+			r,
+			n_functions,
+			featext_probability,
+			initial_set,
+			binary_operations,
+			feature_extractions,
+		)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	// Evaluate the typed functions, the generated closures box every value
+	functions, err := CompileCompositions(compositions)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	log.Printf("Starting %d iterations)\n", n_iterations)
 	all_intersections := make([]*Intersection, 0, 50)
 	all_functionResults := make([]*FunctionResult, 0, 100)
-	all_bad_functions := make(map[int]struct{})
 
 	var prev_sample []*Split 
 
-	max_samples_tries := n_samples * 10
+	max_samples_tries := n_samples * config.Iterations.SampleTriesFactor
 
 	too_many_c := 0
 	too_little_c := 0
 	n_nothing := 0
+	// Samples in a row with too many signs, raising the threshold extends the iterations
+	n_too_many := 0
 	n_fingerprinted_packets := 0
 
 	threshold_set := false
 
+	split_sizes := Map[*Split, int](splits, func(s *Split) int {
+		return s.size
+	})
+	filtered := make([]*PacketSet, 0)
+
+	if resume != nil {
+		splits, err = resume.restoreSplits(splits)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		n_samples, max_sign, n_packets = resume.n_samples, resume.max_sign, resume.n_packets
+		seed, config = resume.seed, resume.config
+		n_iterations, sign_thres = resume.n_iterations, resume.sign_thres
+		too_many_c, too_little_c, n_nothing = resume.too_many_c, resume.too_little_c, resume.n_nothing
+		n_fingerprinted_packets, threshold_set = resume.n_fingerprinted_packets, resume.threshold_set
+		max_samples_tries = n_samples * config.Iterations.SampleTriesFactor
+		all_intersections = resume.intersections
+		all_functionResults = resume.functionResults
+		for _, result := range all_functionResults {
+			result.sign.f = functions[result.index]
+		}
+		all_bad_functions = resume.bad_functions
+		filtered = resume.filtered
+		log.Printf("Resuming with %d iterations left and %d fingerprinted packets\n", n_iterations, n_fingerprinted_packets)
+	}
+
+	seed1, seed2 := SampleSeeds(seed)
+
 	for ; n_iterations > 0; n_iterations-- {
-		if sign_thres <= 50.0 {
-			log.Printf("SIGN THRESHOLD TOO LOW: 150.0")
+		if err := ctx.Err(); err != nil {
+			log.Printf("Cancelled: %s\nReturning results...\n", err)
+			return all_intersections, all_functionResults, compositions, err
+		}
+		if sign_thres <= config.Threshold.Floor {
+			log.Printf("SIGN THRESHOLD TOO LOW: %.0f", config.Threshold.Floor)
 			break
 		}
 
@@ -62,7 +124,7 @@ func Fgpt_ident_iterative(
 
 		log.Printf("  Iterations left: %d\n", n_iterations)
 
-		visited := make(map[PacketIndex]struct{})
+		visited := NewPacketSet()
 		
 		log.Printf("  Sampling %d packets...\n", n_samples)
 		sampled_splits, err := Sample_splitsv2(
@@ -77,7 +139,7 @@ func Fgpt_ident_iterative(
 		log.Printf("    Got %d samples\n", SplitLen(sampled_splits))
 		if err != nil {
 			log.Printf("Exceeded max sample tries (%d)\n", max_samples_tries)
-			return all_intersections, all_functionResults, compositions
+			return all_intersections, all_functionResults, compositions, nil
 		}
 
 		if prev_sample != nil {
@@ -85,36 +147,80 @@ func Fgpt_ident_iterative(
 		}
 		prev_sample = sampled_splits
 
-		if n_nothing > 20 && threshold_set {
-			log.Printf("Found nothing 20 times. Returning...\n")
-			return all_intersections, all_functionResults, compositions
+		if n_nothing > config.Iterations.MaxNothing && threshold_set {
+			log.Printf("Found nothing %d times. Returning...\n", config.Iterations.MaxNothing)
+			return all_intersections, all_functionResults, compositions, nil
+		}
+		if config.Iterations.MaxTooMany > 0 && n_too_many > config.Iterations.MaxTooMany {
+			log.Printf("Found too many signs %d times, raise signs.max_per_sample. Returning...\n", config.Iterations.MaxTooMany)
+			return all_intersections, all_functionResults, compositions, nil
 		}
 		if too_many_c > 1 {
-			sign_thres += 25
+			sign_thres += config.Threshold.Step
 			n_iterations += too_many_c
 			too_many_c = 0
 		}
 		if too_little_c > 1 {
-			sign_thres -= 25
+			sign_thres -= config.Threshold.Step
 			too_little_c = 0
 		}
 
+		// Packets fingerprinted so far are filtered out, so the pre-filter is estimated on what is left every
+		// iteration and its skipped functions are not marked bad
+		iteration_bad_functions := all_bad_functions
+		if config.Prefilter.Packets > 0 {
+			skipped, err := Prefilter_functions(
+				ctx,
+				columns,
+				sample_packets(
+					SeededRand(WrapRightShift(seed, n_iterations, 64), PrefilterStream),
+					splits,
+					config.Prefilter.Packets,
+				),
+				config.Prefilter.MinEntropy,
+				config.Prefilter.MaxEntropyFraction,
+				all_bad_functions,
+				config.Workers.Function,
+			)
+			if err != nil {
+				log.Printf("Cancelled: %s\nReturning results...\n", err)
+				return all_intersections, all_functionResults, compositions, err
+			}
+			iteration_bad_functions = make(map[int]struct{}, len(all_bad_functions) + len(skipped))
+			for f_idx := range all_bad_functions {
+				iteration_bad_functions[f_idx] = struct{}{}
+			}
+			for f_idx := range skipped {
+				iteration_bad_functions[f_idx] = struct{}{}
+			}
+		}
+
 		log.Printf("  Computing for sample...\n")
 		intersections, functionResults, bad_functions, err := ComputeForSample(
+			ctx,
+			config,
 			sampled_splits,
 			splits,
 			functions,
+			columns,
 			sign_thres,
 			max_sign,
-			all_bad_functions,
+			iteration_bad_functions,
 			len(all_functionResults), // Use len of all_functionResults to make sure intersection.idxs line up with actual functionResults
 		)
+		// Results of a cancelled sample are incomplete, so only return those of earlier ones
+		if err := ctx.Err(); err != nil {
+			log.Printf("Cancelled: %s\nReturning results...\n", err)
+			return all_intersections, all_functionResults, compositions, err
+		}
 
 		if !threshold_set {
 			if err != nil {
 				too_many_c++
+				n_too_many++
 				continue
 			}
+			n_too_many = 0
 			if len(intersections) == 0 {
 				too_little_c++
 				continue
@@ -143,7 +249,7 @@ func Fgpt_ident_iterative(
 		}
 
 		for _, inter := range intersections {
-			visited = AddToSet[PacketIndex](visited, inter.packets...)
+			visited = visited.Or(inter.packets)
 		}
 
 		splits = filterSplits(
@@ -151,44 +257,88 @@ func Fgpt_ident_iterative(
 			splits,
 		)
 
-		n_fingerprinted_packets += len(visited)
+		n_fingerprinted_packets += visited.Len()
 		log.Printf("  Currently fingerprinted %d packets\n", n_fingerprinted_packets)
+
+		if checkpoint_path == "" {
+			continue
+		}
+		filtered = append(filtered, visited)
+		err = WriteCheckpoint(checkpoint_path, &Checkpoint{
+			n_samples:					n_samples,
+			max_sign:					max_sign,
+			n_packets:					n_packets,
+			seed:						seed,
+			config:						config,
+			n_iterations:				n_iterations - 1,
+			sign_thres:					sign_thres,
+			too_many_c:					too_many_c,
+			too_little_c:				too_little_c,
+			n_nothing:					n_nothing,
+			n_fingerprinted_packets:	n_fingerprinted_packets,
+			threshold_set:				threshold_set,
+			split_sizes:				split_sizes,
+			compositions:				compositions,
+			intersections:				all_intersections,
+			functionResults:			all_functionResults,
+			bad_functions:				all_bad_functions,
+			filtered:					filtered,
+		})
+		if err != nil {
+			return all_intersections, all_functionResults, compositions, fmt.Errorf("Writing checkpoint: %w", err)
+		}
 	}
 
-	return all_intersections, all_functionResults, compositions
+	return all_intersections, all_functionResults, compositions, nil
+}
+
+// Generates the functions of a search from r and merges duplicates. Also returns the positions of
+// the constant functions, kept when others are built from them but unable to have signs.
+func Generate_compositions(
+	r *rand.Rand,
+	n_functions int,
+	featext_probability float64,
+	initial_set []*InitialFunction,
+	binary_operations []BinaryFunction,
+	feature_extractions []FeatureFunction,
+) ([]*TCPComposition, map[int]struct{}, error) {
+	log.Printf("Generating %d functions...\n", n_functions)
+	_, _, compositions := Generate_functions(
+		r,
+		n_functions,
+		featext_probability,
+		initial_set,
+		binary_operations,
+		feature_extractions,
+	)
+	return DeduplicateFunctions(compositions)
 }
 
 func filterSplits(
-	visited map[PacketIndex]struct{},
+	visited *PacketSet,
 	splits []*Split,
 ) []*Split {
 	filtered := make([]*Split, len(splits))
 	for i, spl := range splits {
-		ps := make([]*Packet, 0, spl.size)
-		for p_idx, p := range spl.packets {
-			if !InSet[PacketIndex](
-				visited,
-				&PacketIndex{
-					split_idx: 	i,
-					packet_idx:	p_idx,
-				},
-			) {
-				ps = append(ps, p)
+		rows := make([]int, 0, spl.size)
+		matched := visited.Split(i)
+		for p_idx := 0; p_idx < spl.size; p_idx++ {
+			if !matched.Contains(uint32(p_idx)) {
+				rows = append(rows, p_idx)
 			}
 		}
-		filtered[i] = &Split{
-			packets:	ps,
-			size:		len(ps),
-			time:		spl.time,
-		}
+		filtered[i] = NewSplit(spl.time, spl.packets.Gather(rows))
 	}
 	return filtered
 }
 
 func ComputeForSample(
+	ctx context.Context,
+	config *Config,
 	sampled_splits []*Split,
 	full_splits []*Split,
-	functions []PacketFunction,
+	functions []TypedFunction,
+	columns []ColumnFunction,
 	sign_thres float64,
 	max_sign int,
 	bad_functions map[int]struct{},
@@ -196,53 +346,85 @@ func ComputeForSample(
 ) ([]*Intersection, []*FunctionResult, map[int]struct{}, error) {
 	
 	log.Printf("    Finding effective signs with threshold: %.0f\n", sign_thres)
-	functionResults := find_effective_signs(
+	functionResults, err := find_effective_signs(
+		ctx,
 		functions, 
+		columns,
 		sampled_splits,
 		sign_thres,
 		max_sign,
+		Sign_scorers[config.Signs.Scorer],
 		bad_functions,
-		56, 
-		3,
+		config.Workers.Function,
+		config.Workers.Split,
 	)
+	if err != nil {
+		return []*Intersection{}, functionResults, bad_functions, err
+	}
 
-	if len(functionResults) > 20 {
+	if len(functionResults) > config.Signs.MaxPerSample {
 		log.Printf("Found too many possible signs: %d\n", len(functionResults))
 		return []*Intersection{}, functionResults, bad_functions, errors.New("Found too many signs")
 	}
 
-	ef_functions := Map[*FunctionResult, PacketFunction](
+	ef_functions := Map[*FunctionResult, TypedFunction](
 		functionResults,
-		func(x *FunctionResult) PacketFunction {
+		func(x *FunctionResult) TypedFunction {
 			return functions[x.index]
 		},
 	)
+	ef_columns := Map[*FunctionResult, ColumnFunction](
+		functionResults,
+		func(x *FunctionResult) ColumnFunction {
+			return columns[x.index]
+		},
+	)
 
-	functionResultsFull := find_effective_signs(
+	// ef_functions is indexed by position in functionResults, so bad_functions does not apply here
+	functionResultsFull, err := find_effective_signs(
+		ctx,
 		ef_functions,
+		ef_columns,
 		full_splits,
-		sign_thres * 3,
+		sign_thres * config.Signs.FullThresholdFactor,
 		max_sign,
-		bad_functions,
-		56,
-		3,
+		Sign_scorers[config.Signs.Scorer],
+		make(map[int]struct{}),
+		config.Workers.Function,
+		config.Workers.Split,
 	)
+	if err != nil {
+		return []*Intersection{}, functionResultsFull, bad_functions, err
+	}
+	// Map indices back to positions in functions
+	for _, result := range functionResultsFull {
+		result.index = functionResults[result.index].index
+	}
 
 	log.Printf("    Consolidating %d signs...\n", len(functionResults))
 	intersections, bad_functions, err := ConsolidateSigns(
+		ctx,
 		full_splits,
 		functionResultsFull,
-		225,
-		10,
-		0.90,
+		columns,
+		config.Workers.Filter,
+		config.Workers.Intersection,
+		config.Signs.MaxPorts,
+		config.Consolidation.MaxIterations,
+		config.Consolidation.MinOverlap,
+		config.Consolidation.MaxSets,
 		startIndex,
 	)
 
+	// Intersection idxs refer to functionResultsFull, so return those
+	if ctx.Err() != nil {
+		return intersections, functionResultsFull, bad_functions, ctx.Err()
+	}
 	if err != nil {
-		return intersections, functionResults, bad_functions, errors.New("Found too many true signs")
+		return intersections, functionResultsFull, bad_functions, errors.New("Found too many true signs")
 	}
 
-	return intersections, functionResults, bad_functions, nil
+	return intersections, functionResultsFull, bad_functions, nil
 }
 
 func Sample_splitsv2(
@@ -258,7 +440,7 @@ func Sample_splitsv2(
 	r2 := rand.New(s2)
 	for _, split := range splits {
 		n_samples := n * split.size / n_packets
-		samples := make([]*Packet, 0, n_samples)
+		samples := make([]int, 0, n_samples)
 		seen := make(map[int]struct{})
 		for i := 0; i < n_samples; i++ {
 			if max_tries < 0 {
@@ -274,18 +456,13 @@ func Sample_splitsv2(
 
 			samples = append(
 				samples,
-				split.packets[r],
+				r,
 			)
 			seen[r] = struct{}{}
 		}
-		new_split := &Split{
-			packets:	samples,
-			size:		len(samples),
-			time:		split.time,
-		}
 		ret = append(
 			ret,
-			new_split,
+			NewSplit(split.time, split.packets.Gather(samples)),
 		)
 	}
 	return ret, nil
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A search on samples that always have too many signs stops after iterations.max_too_many of them
+func TestFgptIdentIterativeStopsOnTooManySigns(t *testing.T) {
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.5)}, 1, 2000, 8, fixtureStart, time.Hour)
+	config := DefaultConfig()
+	config.Signs.MaxPerSample = 1
+	config.Iterations.MaxTooMany = 2
+	binary_operations, err := SelectBinaryOperations([]string{"xor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := SeededRand(1, FunctionStream)
+	feature_extractions, err := SelectFeatureExtractions([]string{"lbytes1"}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the stop the threshold is raised step by step for a very long time
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	intersections, _, _, err := Fgpt_ident_iterative(
+		ctx,
+		data.splits,
+		100,
+		0.5,
+		Initial_set,
+		binary_operations,
+		feature_extractions,
+		1000,
+		500,
+		10,
+		1 << 30,
+		SplitLen(data.splits),
+		r,
+		1,
+		config,
+		"",
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intersections) != 0 {
+		t.Fatalf("Got %d fingerprints from samples with too many signs", len(intersections))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Version of the JSON fingerprint format, bumped on incompatible changes
+const FingerprintFormatVersion = 1
+
+// A TCPComposition tree. Leaves use the key of an initial function,
+// binary operations have two args and feature extractions have n and one arg.
+type FunctionJSON struct {
+	Op   string          `json:"op"`
+	N    *uint64         `json:"n,omitempty"`
+	Args []*FunctionJSON `json:"args,omitempty"`
+}
+
+type SignJSON struct {
+	Function *FunctionJSON `json:"function"`
+	Value    int           `json:"value"`
+}
+
+// A known fingerprint matching most packets of a discovered one
+type KnownMatchJSON struct {
+	Name       string  `json:"name"`
+	Tool       string  `json:"tool"`
+	Confidence string  `json:"confidence"`
+	Overlap    float64 `json:"overlap"`
+}
+
+type FingerprintJSON struct {
+	Signs []*SignJSON       `json:"signs"`
+	Known []*KnownMatchJSON `json:"known,omitempty"`
+}
+
+type FingerprintFileJSON struct {
+	Version      int                `json:"version"`
+	Seed         *uint64            `json:"seed,omitempty"`
+	Config       *Config            `json:"config,omitempty"`
+	Fingerprints []*FingerprintJSON `json:"fingerprints"`
+}
+
+// Splits a feature extraction name such as "lbytes: 2" into its operator and parameter
+func parseFeatureName(name string) (string, uint64, bool) {
+	op, param, ok := strings.Cut(name, ": ")
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return op, n, true
+}
+
+func initialByName(name string) *InitialFunction {
+	for _, init := range Initial_set {
+		if init.name == name {
+			return init
+		}
+	}
+	return nil
+}
+
+func initialByKey(key string) *InitialFunction {
+	for _, init := range Initial_set {
+		if init.key == key {
+			return init
+		}
+	}
+	return nil
+}
+
+func CompositionToJSON(comp *TCPComposition) (*FunctionJSON, error) {
+	if comp == nil {
+		return nil, errors.New("Function has no composition")
+	}
+	switch len(comp.comp) {
+	case 0:
+		init := initialByName(comp.name)
+		if init == nil {
+			return nil, fmt.Errorf("Unknown initial function %q", comp.name)
+		}
+		return &FunctionJSON{Op: init.key}, nil
+	case 1:
+		op, n, ok := parseFeatureName(comp.name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown feature extraction %q", comp.name)
+		}
+		if _, ok := Feature_constructors[op]; !ok {
+			return nil, fmt.Errorf("Unknown feature extraction %q", op)
+		}
+		arg, err := CompositionToJSON(comp.comp[0])
+		if err != nil {
+			return nil, err
+		}
+		return &FunctionJSON{Op: op, N: &n, Args: []*FunctionJSON{arg}}, nil
+	case 2:
+		if _, ok := Binary_operations_by_name[comp.name]; !ok {
+			return nil, fmt.Errorf("Unknown binary operation %q", comp.name)
+		}
+		a, err := CompositionToJSON(comp.comp[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := CompositionToJSON(comp.comp[1])
+		if err != nil {
+			return nil, err
+		}
+		return &FunctionJSON{Op: comp.name, Args: []*FunctionJSON{a, b}}, nil
+	default:
+		return nil, fmt.Errorf("Composition %q has %d children", comp.name, len(comp.comp))
+	}
+}
+
+// Rebuilds the executable function, its count and composition from JSON
+func FunctionFromJSON(node *FunctionJSON) (PacketFunction, int, *TCPComposition, error) {
+	if node == nil {
+		return nil, 0, nil, errors.New("Missing function")
+	}
+	if init := initialByKey(node.Op); init != nil {
+		if len(node.Args) != 0 || node.N != nil {
+			return nil, 0, nil, fmt.Errorf("%s takes no arguments", node.Op)
+		}
+		return init.f, 1, &TCPComposition{init.name, []*TCPComposition{}}, nil
+	}
+	if bin_op, ok := Binary_operations_by_name[node.Op]; ok {
+		if len(node.Args) != 2 || node.N != nil {
+			return nil, 0, nil, fmt.Errorf("%s takes exactly two arguments", node.Op)
+		}
+		fa, ca, comp_a, err := FunctionFromJSON(node.Args[0])
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		fb, cb, comp_b, err := FunctionFromJSON(node.Args[1])
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		f, c, comp := bin_op(fa, ca, comp_a, fb, cb, comp_b)
+		return f, c, comp, nil
+	}
+	if constructor, ok := Feature_constructors[node.Op]; ok {
+		if len(node.Args) != 1 || node.N == nil {
+			return nil, 0, nil, fmt.Errorf("%s takes n and exactly one argument", node.Op)
+		}
+		fa, ca, comp_a, err := FunctionFromJSON(node.Args[0])
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		width, err := CompositionWidth(comp_a)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if _, err := featureWidth(node.Op, *node.N, width); err != nil {
+			return nil, 0, nil, err
+		}
+		f, c, comp := constructor(*node.N)(fa, ca, comp_a)
+		return f, c, comp, nil
+	}
+	return nil, 0, nil, fmt.Errorf("Unknown operation %q", node.Op)
+}
+
+func FingerprintsToJSON(fingerprints []*Fingerprint, compositions []*TCPComposition) (*FingerprintFileJSON, error) {
+	file := &FingerprintFileJSON{
+		Version:      FingerprintFormatVersion,
+		Fingerprints: make([]*FingerprintJSON, 0, len(fingerprints)),
+	}
+	for i, fgpt := range fingerprints {
+		fgpt_json := &FingerprintJSON{Signs: make([]*SignJSON, 0, len(fgpt.signs))}
+		for j, sign := range fgpt.signs {
+			function, err := CompositionToJSON(compositions[fgpt.idxs[j]])
+			if err != nil {
+				return nil, fmt.Errorf("Fingerprint %d: %w", i, err)
+			}
+			fgpt_json.Signs = append(fgpt_json.Signs, &SignJSON{
+				Function: function,
+				Value:    sign.b,
+			})
+		}
+		file.Fingerprints = append(file.Fingerprints, fgpt_json)
+	}
+	return file, nil
+}
+
+// Rebuilds fingerprints, with idxs referring to the returned compositions
+func FingerprintsFromJSON(file *FingerprintFileJSON) ([]*Fingerprint, []*TCPComposition, error) {
+	if file.Version != FingerprintFormatVersion {
+		return nil, nil, fmt.Errorf("Unsupported fingerprint format version %d", file.Version)
+	}
+	fingerprints := make([]*Fingerprint, 0, len(file.Fingerprints))
+	compositions := make([]*TCPComposition, 0, len(file.Fingerprints))
+	for i, fgpt_json := range file.Fingerprints {
+		if len(fgpt_json.Signs) == 0 {
+			return nil, nil, fmt.Errorf("Fingerprint %d has no signs", i)
+		}
+		fgpt := &Fingerprint{}
+		for j, sign_json := range fgpt_json.Signs {
+			_, _, comp, err := FunctionFromJSON(sign_json.Function)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Fingerprint %d, sign %d: %w", i, j, err)
+			}
+			f, _, err := CompileComposition(comp)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Fingerprint %d, sign %d: %w", i, j, err)
+			}
+			fgpt.signs = append(fgpt.signs, &Sign{f: f, b: sign_json.Value})
+			fgpt.idxs = append(fgpt.idxs, len(compositions))
+			compositions = append(compositions, comp)
+		}
+		fingerprints = append(fingerprints, fgpt)
+	}
+	return fingerprints, compositions, nil
+}
+
+// Seed and config are those of the run that found the fingerprints, if any, and known holds the
+// known fingerprints matching each of them, if checked
+func WriteFingerprints(
+	w io.Writer,
+	fingerprints []*Fingerprint,
+	compositions []*TCPComposition,
+	seed *uint64,
+	config *Config,
+	known [][]*KnownMatch,
+) error {
+	file, err := FingerprintsToJSON(fingerprints, compositions)
+	if err != nil {
+		return err
+	}
+	file.Seed, file.Config = seed, config
+	for i, matches := range known {
+		for _, match := range matches {
+			file.Fingerprints[i].Known = append(file.Fingerprints[i].Known, &KnownMatchJSON{
+				Name:       match.known.name,
+				Tool:       match.known.tool,
+				Confidence: match.known.confidence,
+				Overlap:    match.overlap,
+			})
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
+
+func ReadFingerprints(r io.Reader) ([]*Fingerprint, []*TCPComposition, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var file FingerprintFileJSON
+	if err := decoder.Decode(&file); err != nil {
+		return nil, nil, err
+	}
+	return FingerprintsFromJSON(&file)
+}
+
+func LoadFingerprints(path string) ([]*Fingerprint, []*TCPComposition, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	fingerprints, compositions, err := ReadFingerprints(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fingerprints, compositions, nil
+}
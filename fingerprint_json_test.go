@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprintsRoundTrip(t *testing.T) {
+	exprs := []string{
+		"ip_id == 54321 && ttl == 255",
+		"xor(seq, dst_ip) == 0 && dst_port == 23",
+		"xor(lbytes2(seq), rotl7(mask(ip_id, 0xff00))) == 1234",
+		"add(rbitshift3(xorc(window, 0x5a5a)), mul(rbytes1(src_port), lbitshift2(ttl))) == 77 && sub(rotr5(ack), or(mss, opt_layout)) == 4",
+	}
+	var fingerprints []*Fingerprint
+	var compositions []*TCPComposition
+	for _, expr := range exprs {
+		fgpt, comps, err := ParseFingerprint(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fgpt.idxs {
+			fgpt.idxs[j] += len(compositions)
+		}
+		fingerprints = append(fingerprints, fgpt)
+		compositions = append(compositions, comps...)
+	}
+
+	var b bytes.Buffer
+	seed := uint64(7)
+	if err := WriteFingerprints(&b, fingerprints, compositions, &seed, DefaultConfig(), nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, loaded_compositions, err := ReadFingerprints(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(exprs) {
+		t.Fatalf("Loaded %d fingerprints, want %d", len(loaded), len(exprs))
+	}
+	for i, expr := range exprs {
+		if got := SprintFingerprintExpr(loaded[i], loaded_compositions); got != expr {
+			t.Errorf("Loaded %s, want %s", got, expr)
+		}
+	}
+
+	// Fingerprints only matching some packets, on packets as found and on random ones
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.1), MiraiTool(0.1)}, 1, 5000, 8, fixtureStart, time.Hour)
+	packets := RandomPackets(SeededRand(2, PacketStream), 5000)
+	var p Packet
+	for j := 0; j < data.splits[0].size; j++ {
+		data.splits[0].packets.Row(j, &p)
+		q := p
+		packets = append(packets, &q)
+	}
+	for i := range fingerprints {
+		f, g := FingerprintFromSigns(fingerprints[i].signs), FingerprintFromSigns(loaded[i].signs)
+		n_matched := 0
+		for _, p := range packets {
+			if f(p) != g(p) {
+				t.Fatalf("Loaded %s matches %+v differently", exprs[i], p)
+			}
+			if f(p) {
+				n_matched++
+			}
+		}
+		// The tools' fingerprints have to match for the comparison to mean anything
+		if i < 2 && n_matched == 0 {
+			t.Errorf("%s matches no packets", exprs[i])
+		}
+	}
+}
+
+func TestReadFingerprintsRejects(t *testing.T) {
+	for _, c := range []struct {
+		json	string
+		err		string
+	}{
+		{`{"version": 2, "fingerprints": []}`, "Unsupported fingerprint format version 2"},
+		{`{"version": 0, "fingerprints": []}`, "Unsupported fingerprint format version 0"},
+		{`{"version": 1, "fingerprints": [{"signs": [{"function": {"op": "popcount", "args": [{"op": "seq"}]}, "value": 1}]}]}`, `Unknown operation "popcount"`},
+		{`{"version": 1, "fingerprints": [{"signs": [{"function": {"op": "xor", "args": [{"op": "seq"}]}, "value": 1}]}]}`, "xor takes exactly two arguments"},
+		{`{"version": 1, "fingerprints": [{"signs": [{"function": {"op": "lbytes", "args": [{"op": "seq"}]}, "value": 1}]}]}`, "lbytes takes n and exactly one argument"},
+		{`{"version": 1, "fingerprints": [{"signs": [{"function": {"op": "ttl", "n": 1}, "value": 1}]}]}`, "ttl takes no arguments"},
+		{`{"version": 1, "fingerprints": [{"signs": [{"value": 1}]}]}`, "Missing function"},
+		{`{"version": 1, "fingerprints": [{"signs": []}]}`, "Fingerprint 0 has no signs"},
+		{`{"version": 1, "fingerprints": [], "extra": 1}`, "unknown field"},
+	} {
+		_, _, err := ReadFingerprints(strings.NewReader(c.json))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, want %q", c.json, err, c.err)
+		}
+	}
+}
@@ -2,13 +2,35 @@ package main
 
 import (
 	"math"
+	"math/rand/v2"
 	"fmt"
+	"net/netip"
 	"reflect"
 	"sync"
+	"encoding/binary"
 )
 
 const MaxInt = int(^uint(0) >> 1)
 
+// Independent random streams drawn from the single seed of a run
+const (
+	FunctionStream uint64 = iota + 1
+	SampleStream
+	PacketStream
+	PrefilterStream
+	SweepStream
+)
+
+func SeededRand(seed uint64, stream uint64) *rand.Rand {
+	return rand.New(rand.NewPCG(seed, stream))
+}
+
+// Seeds Sample_splitsv2 is derived from in every iteration
+func SampleSeeds(seed uint64) (uint64, uint64) {
+	r := SeededRand(seed, SampleStream)
+	return r.Uint64(), r.Uint64()
+}
+
 func Reverse[S ~[]E, E any](s S)  {
     for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
         s[i], s[j] = s[j], s[i]
@@ -120,13 +142,15 @@ func LiftInt(x interface{}) int {
 		return int(x.(uint16))
 	case uint32:
 		return int(x.(uint32))
+	case uint64:
+		// Wraps around above MaxInt, which keeps distinct values distinct
+		return int(x.(uint64))
 	case int:
 		return x.(int)
 	default:
 		fmt.Println(reflect.TypeOf(v))
 		panic("Unsupported type")
 	}
-	panic("Huh")
 }
 
 func InSet[T comparable](
@@ -158,16 +182,19 @@ func SplitLen(x []*Split) (size int) {
 
 func SplitSimilarity(x, y []*Split, size int) float64 {
 	seen := make(map[Packet]struct{}) 
+	var p Packet
 	for _, spl := range x {
-		for _, p := range spl.packets {
-			seen[*p] = struct{}{}
+		for i := 0; i < spl.size; i++ {
+			spl.packets.Row(i, &p)
+			seen[p] = struct{}{}
 		}
 	}
 	
 	c := 0.0
 	for _, spl := range y {
-		for _, p := range spl.packets {
-			if InSet[Packet](seen, p) {
+		for i := 0; i < spl.size; i++ {
+			spl.packets.Row(i, &p)
+			if InSet[Packet](seen, &p) {
 				c += 1.0
 			}
 		}
@@ -187,4 +214,39 @@ func WrapLeftShift(n uint64, k int, bits int) uint64 {
 	shift := n << k
 	wrap := n >> (bits - k)
 	return shift | wrap
+}
+
+// Sets both address representations of an IPv4 packet, the 128-bit ones as IPv4-mapped addresses
+func SetIPv4Addrs(p *Packet, src uint32, dst uint32) {
+	p.IPv6 = false
+	p.SrcIp, p.DstIp = src, dst
+	p.SrcIp6 = netip.AddrFrom4(uint32ToBytes(src)).As16()
+	p.DstIp6 = netip.AddrFrom4(uint32ToBytes(dst)).As16()
+}
+
+// Sets both address representations of an IPv6 packet, the 32-bit ones as the lowest 32 bits
+func SetIPv6Addrs(p *Packet, src [16]byte, dst [16]byte) {
+	p.IPv6 = true
+	p.SrcIp6, p.DstIp6 = src, dst
+	p.SrcIp = binary.BigEndian.Uint32(src[12:])
+	p.DstIp = binary.BigEndian.Uint32(dst[12:])
+}
+
+func SrcAddr(p *Packet) netip.Addr {
+	if p.IPv6 {
+		return netip.AddrFrom16(p.SrcIp6)
+	}
+	return netip.AddrFrom4(uint32ToBytes(p.SrcIp))
+}
+
+func DstAddr(p *Packet) netip.Addr {
+	if p.IPv6 {
+		return netip.AddrFrom16(p.DstIp6)
+	}
+	return netip.AddrFrom4(uint32ToBytes(p.DstIp))
+}
+
+func uint32ToBytes(ip uint32) (ret [4]byte) {
+	binary.BigEndian.PutUint32(ret[:], ip)
+	return
 }
\ No newline at end of file
@@ -0,0 +1,292 @@
+package main
+
+import (
+	_ "embed"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Known scanner fingerprints
+//
+// A named, versioned library of fingerprints of known tools, each written as an expression.
+// The built-in library is known_fingerprints.json, others are read from files of the same format.
+// Tools deriving a header field from a secret drawn per scan, such as Unicornscan, give functions
+// with one value per scan instead of a known one; these are listed as keys without a value.
+
+//go:embed known_fingerprints.json
+var builtinKnownFingerprints []byte
+
+// Version of the known fingerprint file format, bumped on incompatible changes. Version 2 adds keys,
+// files of version 1 are still read.
+const KnownFormatVersion = 2
+
+var KnownConfidences = []string{"high", "medium", "low"}
+
+// Key lists functions taking one value over all packets of a scan, which value is not known
+type KnownFingerprintJSON struct {
+	Name       string   `json:"name"`
+	Tool       string   `json:"tool"`
+	Reference  string   `json:"reference"`
+	Confidence string   `json:"confidence"`
+	Expr       string   `json:"expr,omitempty"`
+	Key        []string `json:"key,omitempty"`
+}
+
+type KnownFileJSON struct {
+	Format       int                     `json:"format"`
+	Name         string                  `json:"name"`
+	Version      string                  `json:"version"`
+	Fingerprints []*KnownFingerprintJSON `json:"fingerprints"`
+}
+
+type KnownFingerprint struct {
+	name 			string
+	tool 			string
+	// Where the derivation is documented
+	reference 		string
+	confidence 		string
+	fgpt 			*Fingerprint
+	compositions 	[]*TCPComposition
+	// Matches the signs with a known value, the keys are compared per fingerprint in MatchKnown
+	match 			FingerprintFunc
+	keys 			[]TypedFunction
+	key_compositions	[]*TCPComposition
+}
+
+type KnownRegistry struct {
+	name 			string
+	version 		string
+	fingerprints 	[]*KnownFingerprint
+}
+
+func KnownFromJSON(file *KnownFileJSON) (*KnownRegistry, error) {
+	if file.Format < 1 || file.Format > KnownFormatVersion {
+		return nil, fmt.Errorf("Unsupported known fingerprint format %d", file.Format)
+	}
+	if file.Name == "" || file.Version == "" {
+		return nil, errors.New("Known fingerprint library needs a name and a version")
+	}
+	registry := &KnownRegistry{
+		name:			file.Name,
+		version:		file.Version,
+		fingerprints:	make([]*KnownFingerprint, 0, len(file.Fingerprints)),
+	}
+	for i, known_json := range file.Fingerprints {
+		if known_json.Name == "" {
+			return nil, fmt.Errorf("Known fingerprint %d has no name", i)
+		}
+		if registry.Lookup(known_json.Name) != nil {
+			return nil, fmt.Errorf("Known fingerprint %q is defined twice", known_json.Name)
+		}
+		if !slices.Contains(KnownConfidences, known_json.Confidence) {
+			return nil, fmt.Errorf("Known fingerprint %q: confidence must be one of %v", known_json.Name, KnownConfidences)
+		}
+		if known_json.Expr == "" && len(known_json.Key) == 0 {
+			return nil, fmt.Errorf("Known fingerprint %q needs an expr or a key", known_json.Name)
+		}
+		if len(known_json.Key) > 0 && file.Format < 2 {
+			return nil, fmt.Errorf("Known fingerprint %q: keys need format 2", known_json.Name)
+		}
+		fgpt, compositions := &Fingerprint{}, []*TCPComposition{}
+		if known_json.Expr != "" {
+			var err error
+			fgpt, compositions, err = ParseFingerprint(known_json.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("Known fingerprint %q: %w", known_json.Name, err)
+			}
+		}
+		known := &KnownFingerprint{
+			name:			known_json.Name,
+			tool:			known_json.Tool,
+			reference:		known_json.Reference,
+			confidence:		known_json.Confidence,
+			fgpt:			fgpt,
+			compositions:	compositions,
+			match:			FingerprintFromSigns(fgpt.signs),
+		}
+		for _, key := range known_json.Key {
+			_, _, comp, err := ParseFunction(key)
+			if err != nil {
+				return nil, fmt.Errorf("Known fingerprint %q, key %q: %w", known_json.Name, key, err)
+			}
+			f, _, err := CompileComposition(comp)
+			if err != nil {
+				return nil, fmt.Errorf("Known fingerprint %q, key %q: %w", known_json.Name, key, err)
+			}
+			known.keys = append(known.keys, f)
+			known.key_compositions = append(known.key_compositions, comp)
+		}
+		registry.fingerprints = append(registry.fingerprints, known)
+	}
+	return registry, nil
+}
+
+func ReadKnownRegistry(r io.Reader) (*KnownRegistry, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var file KnownFileJSON
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	return KnownFromJSON(&file)
+}
+
+func LoadKnownRegistry(path string) (*KnownRegistry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	registry, err := ReadKnownRegistry(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return registry, nil
+}
+
+func BuiltinKnownRegistry() (*KnownRegistry, error) {
+	return ReadKnownRegistry(bytes.NewReader(builtinKnownFingerprints))
+}
+
+func (k *KnownRegistry) Lookup(name string) *KnownFingerprint {
+	for _, known := range k.fingerprints {
+		if known.name == name {
+			return known
+		}
+	}
+	return nil
+}
+
+// Values of the keys of k on p, equal for packets of the same scan
+func (k *KnownFingerprint) keyValue(p *Packet) string {
+	value := make([]byte, 0, 8 * len(k.keys))
+	for _, f := range k.keys {
+		value = binary.LittleEndian.AppendUint64(value, f(p))
+	}
+	return string(value)
+}
+
+// Whether k has keys, the packets of one scan match its signs and share the values of its keys
+func (k *KnownFingerprint) Keyed() bool {
+	return len(k.keys) > 0
+}
+
+type KnownMatch struct {
+	known 	*KnownFingerprint
+	// Fraction of the packets of the fingerprint the known one matches too
+	overlap float64
+}
+
+// For every fingerprint, the known fingerprints matching at least min_overlap of the packets it matches
+// in splits, by decreasing overlap. A known fingerprint with keys matches the packets sharing the most
+// common values of its keys.
+func MatchKnown(fingerprints []*Fingerprint, registry *KnownRegistry, splits []*Split, min_overlap float64) [][]*KnownMatch {
+	matchers := Map[*Fingerprint, FingerprintFunc](fingerprints, func(x *Fingerprint) FingerprintFunc {
+		return FingerprintFromSigns(x.signs)
+	})
+	n_matched := make([]int, len(fingerprints))
+	// Per fingerprint, packets each known fingerprint matches too
+	n_shared := make([][]int, len(fingerprints))
+	for i := range n_shared {
+		n_shared[i] = make([]int, len(registry.fingerprints))
+	}
+	// Per fingerprint and keyed known fingerprint, packets by the values of its keys
+	n_keyed := make([][]map[string]int, len(fingerprints))
+	for i := range n_keyed {
+		n_keyed[i] = make([]map[string]int, len(registry.fingerprints))
+		for k_idx, known := range registry.fingerprints {
+			if known.Keyed() {
+				n_keyed[i][k_idx] = make(map[string]int)
+			}
+		}
+	}
+	known_matched := make([]bool, len(registry.fingerprints))
+	key_values := make([]string, len(registry.fingerprints))
+	var p Packet
+	for _, spl := range splits {
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			evaluated := false
+			for f_idx, f := range matchers {
+				if !f(&p) {
+					continue
+				}
+				// Known fingerprints are only evaluated on packets some fingerprint matches
+				if !evaluated {
+					for k_idx, known := range registry.fingerprints {
+						known_matched[k_idx] = known.match(&p)
+						if known_matched[k_idx] && known.Keyed() {
+							key_values[k_idx] = known.keyValue(&p)
+						}
+					}
+					evaluated = true
+				}
+				n_matched[f_idx]++
+				for k_idx, ok := range known_matched {
+					switch {
+					case ok && n_keyed[f_idx][k_idx] != nil:
+						n_keyed[f_idx][k_idx][key_values[k_idx]]++
+					case ok:
+						n_shared[f_idx][k_idx]++
+					}
+				}
+			}
+		}
+	}
+
+	matches := make([][]*KnownMatch, len(fingerprints))
+	for f_idx := range fingerprints {
+		matches[f_idx] = make([]*KnownMatch, 0)
+		if n_matched[f_idx] == 0 {
+			continue
+		}
+		for k_idx, known := range registry.fingerprints {
+			for _, n := range n_keyed[f_idx][k_idx] {
+				n_shared[f_idx][k_idx] = Max(n_shared[f_idx][k_idx], n)
+			}
+			overlap := float64(n_shared[f_idx][k_idx]) / float64(n_matched[f_idx])
+			if overlap >= min_overlap {
+				matches[f_idx] = append(matches[f_idx], &KnownMatch{known, overlap})
+			}
+		}
+		slices.SortStableFunc(matches[f_idx], func(a, b *KnownMatch) int {
+			return -cmp.Compare(a.overlap, b.overlap)
+		})
+	}
+	return matches
+}
+
+func SprintKnownMatches(matches []*KnownMatch) string {
+	var b strings.Builder
+	for _, match := range matches {
+		fmt.Fprintf(
+			&b, "Known: %s (%s, %s confidence), matches %.1f%% of its packets\n",
+			match.known.name, match.known.tool, match.known.confidence, 100 * match.overlap,
+		)
+	}
+	return b.String()
+}
+
+func SprintKnownRegistry(k *KnownRegistry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s, %d fingerprints\n", k.name, k.version, len(k.fingerprints))
+	for _, known := range k.fingerprints {
+		fmt.Fprintf(&b, "\n%s: %s, %s confidence\n", known.name, known.tool, known.confidence)
+		if len(known.fgpt.signs) > 0 {
+			fmt.Fprintf(&b, "  %s\n", SprintFingerprintExpr(known.fgpt, known.compositions))
+		}
+		if known.Keyed() {
+			fmt.Fprintf(&b, "  key %s\n", strings.Join(Map[*TCPComposition, string](known.key_compositions, TCPExpr), ", "))
+		}
+		fmt.Fprintf(&b, "  %s\n", known.reference)
+	}
+	return b.String()
+}
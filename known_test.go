@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Emulations of the derivation every built-in known fingerprint describes, by name
+var knownTestTools = map[string]func(share float64) *SyntheticTool{
+	"zmap":		ZMapTool,
+	"masscan":	MasscanTool,
+	"mirai":	MiraiTool,
+	"mirai-tr069": func(share float64) *SyntheticTool {
+		mirai := MiraiTool(share)
+		return &SyntheticTool{"mirai-tr069", share, nil, func(r *rand.Rand, p *Packet) {
+			mirai.apply(r, p)
+			p.DstPort = 7547
+		}}
+	},
+	"nmap-syn":	NmapTool,
+	"unicornscan":	UnicornscanTool,
+}
+
+// Every built-in known fingerprint matches all packets of its tool and hardly any background, for
+// fingerprints with keys only the packets with the key values of the tool
+func TestBuiltinKnownMatchesSyntheticTools(t *testing.T) {
+	registry, err := BuiltinKnownRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, known := range registry.fingerprints {
+		tool, ok := knownTestTools[known.name]
+		if !ok {
+			t.Errorf("Known fingerprint %s has no emulated tool", known.name)
+			continue
+		}
+		data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{tool(0.1)}, 2, 10000, 8, fixtureStart, time.Hour)
+		var p Packet
+		tool_key := ""
+		for i, spl := range data.splits {
+			for j := 0; j < spl.size && tool_key == ""; j++ {
+				if data.labels[i][j] >= 0 {
+					spl.packets.Row(j, &p)
+					tool_key = known.keyValue(&p)
+				}
+			}
+		}
+		n_tool, matched, false_positives := 0, 0, 0
+		for i, spl := range data.splits {
+			for j := 0; j < spl.size; j++ {
+				spl.packets.Row(j, &p)
+				from_tool := data.labels[i][j] >= 0
+				if from_tool {
+					n_tool++
+				}
+				ok := known.match(&p) && known.keyValue(&p) == tool_key
+				switch {
+				case ok && from_tool:
+					matched++
+				case ok:
+					false_positives++
+				}
+			}
+		}
+		if n_tool == 0 || matched != n_tool {
+			t.Errorf("Known fingerprint %s matches %d of %d packets of its tool", known.name, matched, n_tool)
+		}
+		if false_positives > n_tool / 100 {
+			t.Errorf("Known fingerprint %s matches %d background packets", known.name, false_positives)
+		}
+	}
+}
+
+// A known fingerprint with keys is flagged for a fingerprint of one scan, not of two scans with other keys
+func TestMatchKnownKeyed(t *testing.T) {
+	registry, err := BuiltinKnownRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &SyntheticTool{"unicornscan-2", 0.1, nil, func(r *rand.Rand, p *Packet) {
+		bareSyn(p, 64, 1024)
+		p.DstPort = 80
+		p.Seq = ^unicornscanSynKey ^ p.DstIp ^ (uint32(p.DstPort) << 16 + uint32(p.SrcPort))
+	}}
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{UnicornscanTool(0.1), other}, 2, 10000, 8, fixtureStart, time.Hour)
+	one, _, err := ParseFingerprint("window == 4096 && ttl == 64 && opt_layout == 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	both, _, err := ParseFingerprint("ttl == 64 && opt_layout == 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := MatchKnown([]*Fingerprint{one, both}, registry, data.splits, 0.9)
+	flagged := func(matches []*KnownMatch) bool {
+		return slices.ContainsFunc(matches, func(m *KnownMatch) bool { return m.known.name == "unicornscan" })
+	}
+	if !flagged(matches[0]) {
+		t.Fatalf("unicornscan not flagged for the fingerprint of one scan, got %s", SprintKnownMatches(matches[0]))
+	}
+	if flagged(matches[1]) {
+		t.Fatalf("unicornscan flagged for the fingerprint of two scans")
+	}
+}
+
+func TestReadKnownRegistryKeys(t *testing.T) {
+	for _, c := range []struct {
+		file	string
+		ok		bool
+	}{
+		{`{"format": 1, "name": "a", "version": "1", "fingerprints": [{"name": "z", "confidence": "high", "expr": "ip_id == 54321"}]}`, true},
+		{`{"format": 2, "name": "a", "version": "1", "fingerprints": [{"name": "u", "confidence": "low", "key": ["xor(seq, dst_ip)"]}]}`, true},
+		{`{"format": 1, "name": "a", "version": "1", "fingerprints": [{"name": "u", "confidence": "low", "key": ["xor(seq, dst_ip)"]}]}`, false},
+		{`{"format": 2, "name": "a", "version": "1", "fingerprints": [{"name": "u", "confidence": "low"}]}`, false},
+		{`{"format": 2, "name": "a", "version": "1", "fingerprints": [{"name": "u", "confidence": "low", "key": ["xor(seq)"]}]}`, false},
+		{`{"format": 3, "name": "a", "version": "1", "fingerprints": []}`, false},
+	} {
+		_, err := ReadKnownRegistry(strings.NewReader(c.file))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.file, err)
+		}
+	}
+}
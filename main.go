@@ -0,0 +1,1055 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes
+const (
+	ExitOK    = 0
+	ExitError = 1
+	ExitUsage = 2
+)
+
+const usage = `Usage: fgpt <command> [flags]
+
+Commands:
+  discover  Iteratively discover fingerprints in a dataset
+  apply     Write the packets matching any of a set of fingerprints as a fixture
+  inspect   Summarise the packets matching each of a set of fingerprints
+  synth     Generate a labelled fixture of background radiation and emulated scanners
+  evaluate  Score a set of fingerprints against the labels of a synthetic fixture
+  sweep     Compare discovery runs over a grid or random search of search parameters
+  known     List a library of known scanner fingerprints
+  classify  Label every packet with the fingerprints matching it and summarise each label
+
+Run 'fgpt <command> -h' for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return ExitUsage
+	}
+	var cmd func([]string, io.Writer, io.Writer) error
+	switch args[0] {
+	case "discover":
+		cmd = runDiscover
+	case "apply":
+		cmd = runApply
+	case "inspect":
+		cmd = runInspect
+	case "synth":
+		cmd = runSynth
+	case "evaluate":
+		cmd = runEvaluate
+	case "sweep":
+		cmd = runSweep
+	case "known":
+		cmd = runKnown
+	case "classify":
+		cmd = runClassify
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return ExitOK
+	default:
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", args[0], usage)
+		return ExitUsage
+	}
+
+	err := cmd(args[1:], stdout, stderr)
+	var uerr *usageError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, flag.ErrHelp):
+		return ExitOK
+	case errors.As(err, &uerr):
+		fmt.Fprintf(stderr, "%s: %s\n", args[0], uerr.msg)
+		return ExitUsage
+	default:
+		fmt.Fprintf(stderr, "%s: %s\n", args[0], err)
+		return ExitError
+	}
+}
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, a ...any) error {
+	return &usageError{fmt.Sprintf(format, a...)}
+}
+
+func newFlagSet(name string, summary string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: fgpt %s [flags]\n\n%s\n\nFlags:\n", name, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Parses flags, turning flag errors into usage errors
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{err.Error()}
+	}
+	if fs.NArg() > 0 {
+		return usagef("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
+// Dataset flags, shared by all commands
+
+type datasetFlags struct {
+	pcaps       string
+	bucket      time.Duration
+	fixture     string
+	clickhouse  string
+	database    string
+	username    string
+	password    string
+	table       string
+	time_column string
+	slice       time.Duration
+	start       string
+	end         string
+	limit       int
+	zmap        bool
+	db_workers  int
+}
+
+func (d *datasetFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&d.pcaps, "pcap", "", "comma separated pcap/pcapng files to read")
+	fs.DurationVar(&d.bucket, "bucket", time.Hour, "time bucket per split when reading captures")
+	fs.StringVar(&d.fixture, "fixture", "", "recorded CSV fixture to read instead of ClickHouse")
+	fs.StringVar(&d.clickhouse, "clickhouse", "", "ClickHouse address (host:port)")
+	fs.StringVar(&d.database, "database", "default", "ClickHouse database")
+	fs.StringVar(&d.username, "user", "default", "ClickHouse user")
+	fs.StringVar(&d.password, "password", "", "ClickHouse password")
+	fs.StringVar(&d.table, "table", "packets", "table holding one row per packet")
+	fs.StringVar(&d.time_column, "time-column", "ts", "DateTime column of the table")
+	fs.DurationVar(&d.slice, "slice", time.Hour, "time slice per split when querying")
+	fs.StringVar(&d.start, "start", "", "start of the first slice (YYYY-MM-DD hh:mm:ss, UTC)")
+	fs.StringVar(&d.end, "end", "", "end of the last slice, exclusive (YYYY-MM-DD hh:mm:ss, UTC)")
+	fs.IntVar(&d.limit, "limit", 0, "maximum number of packets per split, 0 for no limit")
+	fs.BoolVar(&d.zmap, "filter-zmap", false, "drop packets with the ZMap IP Id")
+	fs.IntVar(&d.db_workers, "db-workers", 8, "concurrent queries")
+}
+
+func (d *datasetFlags) validate() error {
+	n_sources := 0
+	for _, s := range []string{d.pcaps, d.fixture, d.clickhouse} {
+		if s != "" {
+			n_sources++
+		}
+	}
+	if n_sources != 1 {
+		return usagef("exactly one of -pcap, -fixture or -clickhouse is required")
+	}
+	if d.limit < 0 {
+		return usagef("-limit must not be negative")
+	}
+	if d.pcaps != "" {
+		if d.bucket <= 0 {
+			return usagef("-bucket must be positive")
+		}
+		return nil
+	}
+	if d.start == "" || d.end == "" {
+		return usagef("-start and -end are required with -fixture and -clickhouse")
+	}
+	start, err := time.ParseInLocation(time.DateTime, d.start, time.UTC)
+	if err != nil {
+		return usagef("invalid -start: %s", err)
+	}
+	end, err := time.ParseInLocation(time.DateTime, d.end, time.UTC)
+	if err != nil {
+		return usagef("invalid -end: %s", err)
+	}
+	if !start.Before(end) {
+		return usagef("-start must be before -end")
+	}
+	if d.slice <= 0 {
+		return usagef("-slice must be positive")
+	}
+	if d.db_workers <= 0 {
+		return usagef("-db-workers must be positive")
+	}
+	if d.table == "" || d.time_column == "" {
+		return usagef("-table and -time-column must not be empty")
+	}
+	return nil
+}
+
+func (d *datasetFlags) load(ctx context.Context) ([]*Split, error) {
+	if d.pcaps != "" {
+		splits, err := ReadCaptureFiles(strings.Split(d.pcaps, ","), d.bucket)
+		if err != nil {
+			return nil, err
+		}
+		return trimSplits(splits, d.limit, d.zmap), nil
+	}
+
+	var source PacketSource
+	if d.fixture != "" {
+		fixture, err := LoadFixture(d.fixture)
+		if err != nil {
+			return nil, err
+		}
+		source = fixture
+	} else {
+		conn, err := OpenClickHouse(d.clickhouse, d.database, d.username, d.password)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		source = conn
+	}
+
+	table, err := NewPacketTable(d.table, d.time_column, d.slice)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := time.ParseInLocation(time.DateTime, d.start, time.UTC)
+	end, _ := time.ParseInLocation(time.DateTime, d.end, time.UTC)
+	return LoadSplits(
+		ctx,
+		source,
+		table,
+		TimeSlices(start, end, d.slice),
+		d.limit > 0,
+		d.limit,
+		d.zmap,
+		d.db_workers,
+	)
+}
+
+// Applies limit and ZMap filtering to splits that did not come from a query
+func trimSplits(splits []*Split, limit int, zmap bool) []*Split {
+	if zmap {
+		splits = FilterSplitsBy(splits, func(p *Packet) bool {
+			return p.IPId != ZMapIPId
+		})
+	}
+	if limit > 0 {
+		for _, spl := range splits {
+			if spl.size > limit {
+				spl.packets.Truncate(limit)
+				spl.size = limit
+			}
+		}
+	}
+	return splits
+}
+
+func createOutput(path string, stdout io.Writer) (io.Writer, func() error, error) {
+	if path == "" || path == "-" {
+		return stdout, func() error { return nil }, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file.Close, nil
+}
+
+// discover
+
+func runDiscover(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("discover", "Runs Fgpt_ident_iterative on a dataset and prints the fingerprints found.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	n_functions := fs.Int("functions", 10000, "number of functions to generate on top of the initial set")
+	featext_probability := fs.Float64("featext-probability", 0.5, "probability of generating a feature extraction instead of a binary operation")
+	binary_ops := fs.String("binary-ops", "xor", "comma separated binary operations to generate functions from: and, or, xor, add, sub, mul")
+	feature_exts := fs.String("feature-exts", "lbytes1,lbytes2,rbytes1,rbytes2", "comma separated feature extractions to generate functions from: lbytes, rbytes, lbitshift, rbitshift, rotl, rotr, mask, xorc; with a suffix such as rotl7 the parameter is fixed, otherwise it is sampled")
+	n_samples := fs.Int("samples", 100000, "packets sampled per iteration")
+	sign_thres := fs.Float64("sign-thres", 0, "initial effective sign threshold, 0 for the default of the scorer: 500 for variance_ratio")
+	max_sign := fs.Int("max-sign", 10, "maximum number of signs considered per function")
+	n_iterations := fs.Int("iterations", 50, "maximum number of iterations")
+	n_packets := fs.Int("packets", 0, "expected number of packets, 0 to count the dataset")
+	seed := fs.Uint64("seed", 1, "seed of every random choice, the same seed and dataset give the same fingerprints")
+	out := fs.String("out", "", "write fingerprints to this file instead of stdout")
+	format := fs.String("format", "text", "output format: text, json, or expr for one expression per line")
+	timeout := fs.Duration("timeout", 0, "stop after this long and write the fingerprints found so far, 0 for no limit")
+	checkpoint := fs.String("checkpoint", "", "write the search state to this file after every successful iteration")
+	resume := fs.Bool("resume", false, "continue from -checkpoint, taking functions, seed, config and search parameters from it, so the flags setting them cannot be given")
+	config_path := fs.String("config", "", "YAML file overriding the default worker counts, limits and thresholds of the search")
+	known_path := fs.String("known", "", "library of known fingerprints to flag matches with, the built-in one if empty, none to skip")
+	known_overlap := fs.Float64("known-overlap", 0.9, "a known fingerprint is flagged if it matches this fraction of the packets of a found one")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	// These are taken from the checkpoint when resuming
+	var overridden []string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "functions", "featext-probability", "binary-ops", "feature-exts", "samples", "sign-thres",
+			"max-sign", "iterations", "packets", "seed", "config":
+			overridden = append(overridden, "-" + f.Name)
+		}
+	})
+
+	switch {
+	case *format != "text" && *format != "json" && *format != "expr":
+		return usagef("-format must be text, json or expr")
+	case *timeout < 0:
+		return usagef("-timeout must not be negative")
+	case *resume && *checkpoint == "":
+		return usagef("-resume requires -checkpoint")
+	case *resume && len(overridden) > 0:
+		return usagef("-resume uses the search parameters of the checkpoint, %s cannot be given", strings.Join(overridden, ", "))
+	case *n_functions <= 0:
+		return usagef("-functions must be positive")
+	case *featext_probability < 0 || *featext_probability > 1:
+		return usagef("-featext-probability must be between 0 and 1")
+	case *n_samples <= 0:
+		return usagef("-samples must be positive")
+	case *sign_thres < 0:
+		return usagef("-sign-thres must not be negative")
+	case *max_sign <= 0:
+		return usagef("-max-sign must be positive")
+	case *n_iterations <= 0:
+		return usagef("-iterations must be positive")
+	case *n_packets < 0:
+		return usagef("-packets must not be negative")
+	case *known_overlap <= 0 || *known_overlap > 1:
+		return usagef("-known-overlap must be above 0 and at most 1")
+	}
+	binary_operations, err := SelectBinaryOperations(strings.Split(*binary_ops, ","))
+	if err != nil {
+		return usagef("-binary-ops: %s", err)
+	}
+	registry, err := loadKnown(*known_path)
+	if err != nil {
+		return err
+	}
+	// Sampled feature parameters are drawn while generating, so both share r
+	r := SeededRand(*seed, FunctionStream)
+	feature_extractions, err := SelectFeatureExtractions(strings.Split(*feature_exts, ","), r)
+	if err != nil {
+		return usagef("-feature-exts: %s", err)
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+	config := DefaultConfig()
+	if *config_path != "" {
+		config, err = LoadConfig(*config_path)
+		if err != nil {
+			return err
+		}
+	}
+	var resume_from *Checkpoint
+	if *resume {
+		resume_from, err = LoadCheckpoint(*checkpoint)
+		if err != nil {
+			return err
+		}
+		*seed, config = resume_from.seed, resume_from.config
+	}
+	if *sign_thres == 0 {
+		*sign_thres = Scorer_thresholds[config.Signs.Scorer].Initial
+	}
+
+	// Interrupting stops the search, the fingerprints found so far are still written
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	splits, err := data.load(ctx)
+	if err != nil {
+		return err
+	}
+	if *n_packets == 0 {
+		*n_packets = SplitLen(splits)
+	}
+
+	intersections, functionResults, compositions, search_err := Fgpt_ident_iterative(
+		ctx,
+		splits,
+		*n_functions,
+		*featext_probability,
+		InitialSetFor(splits),
+		binary_operations,
+		feature_extractions,
+		*n_samples,
+		*sign_thres,
+		*max_sign,
+		*n_iterations,
+		*n_packets,
+		r,
+		*seed,
+		config,
+		*checkpoint,
+		resume_from,
+	)
+	if compositions == nil {
+		return search_err
+	}
+	if search_err != nil {
+		log.Printf("Stopped early: %s\n", search_err)
+	}
+	log.Printf("Found %d fingerprints\n", len(intersections))
+
+	w, closeOutput, err := createOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	fingerprints := IntersectionsToFingerprints(intersections, functionResults)
+	var known [][]*KnownMatch
+	if registry != nil {
+		known = MatchKnown(fingerprints, registry, splits, *known_overlap)
+		for i, matches := range known {
+			for _, match := range matches {
+				log.Printf("Fingerprint %d matches known fingerprint %s (%s) on %.1f%% of its packets\n", i, match.known.name, match.known.tool, 100 * match.overlap)
+			}
+		}
+	}
+	if *format == "json" {
+		if err := WriteFingerprints(w, fingerprints, compositions, seed, config, known); err != nil {
+			closeOutput()
+			return err
+		}
+		return errors.Join(closeOutput(), search_err)
+	}
+	if *format == "text" {
+		var b strings.Builder
+		if err := WriteConfig(&b, config); err != nil {
+			closeOutput()
+			return err
+		}
+		fmt.Fprintf(w, "Seed: %d\nConfig:\n  %s\n", *seed, strings.ReplaceAll(strings.TrimSpace(b.String()), "\n", "\n  "))
+	}
+	for i, fgpt := range fingerprints {
+		if *format == "expr" {
+			fmt.Fprintf(w, "%s\n", SprintFingerprintExpr(fgpt, compositions))
+		} else if known != nil {
+			fmt.Fprintf(w, "%s%s\n", SprintFingerprint(fgpt, i, compositions), SprintKnownMatches(known[i]))
+		} else {
+			fmt.Fprintf(w, "%s\n", SprintFingerprint(fgpt, i, compositions))
+		}
+	}
+	return errors.Join(closeOutput(), search_err)
+}
+
+// Built-in library if path is empty, nil for none
+func loadKnown(path string) (*KnownRegistry, error) {
+	switch path {
+	case "none":
+		return nil, nil
+	case "":
+		return BuiltinKnownRegistry()
+	}
+	return LoadKnownRegistry(path)
+}
+
+// apply and inspect
+
+// Repeatable -expr flag, every value is one fingerprint
+type exprFlags struct {
+	fingerprints []*Fingerprint
+	compositions []*TCPComposition
+}
+
+func (e *exprFlags) String() string {
+	return fmt.Sprintf("%d fingerprints", len(e.fingerprints))
+}
+
+func (e *exprFlags) Set(v string) error {
+	fgpt, comps, err := ParseFingerprint(v)
+	if err != nil {
+		return err
+	}
+	// Shift idxs past the compositions of earlier fingerprints
+	for i := range fgpt.idxs {
+		fgpt.idxs[i] += len(e.compositions)
+	}
+	e.fingerprints = append(e.fingerprints, fgpt)
+	e.compositions = append(e.compositions, comps...)
+	return nil
+}
+
+// Fingerprints given by a JSON file and/or -expr flags
+type fingerprintFlags struct {
+	path  string
+	index int
+	exprs exprFlags
+}
+
+func (f *fingerprintFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.path, "fingerprints", "", "JSON fingerprint file, as written by discover -format json")
+	fs.IntVar(&f.index, "index", -1, "only use the fingerprint at this index of -fingerprints")
+	fs.Var(&f.exprs, "expr", "fingerprint as expression, e.g. 'xor(lbytes2(seq), seq) == 0 && ip_id == 54321'; repeatable")
+}
+
+func (f *fingerprintFlags) validate() error {
+	if f.index >= 0 && f.path == "" {
+		return usagef("-index requires -fingerprints")
+	}
+	if f.index < -1 {
+		return usagef("-index must not be negative")
+	}
+	return nil
+}
+
+func (f *fingerprintFlags) load() ([]*Fingerprint, []*TCPComposition, error) {
+	fingerprints := make([]*Fingerprint, 0)
+	compositions := make([]*TCPComposition, 0)
+	if f.path != "" {
+		loaded, comps, err := LoadFingerprints(f.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.index >= len(loaded) {
+			return nil, nil, usagef("-index %d out of range, file has %d fingerprints", f.index, len(loaded))
+		}
+		if f.index >= 0 {
+			loaded = loaded[f.index : f.index+1]
+		}
+		fingerprints, compositions = loaded, comps
+	}
+	for _, fgpt := range f.exprs.fingerprints {
+		idxs := Map[int, int](fgpt.idxs, func(i int) int {
+			return i + len(compositions)
+		})
+		fingerprints = append(fingerprints, &Fingerprint{signs: fgpt.signs, idxs: idxs})
+	}
+	compositions = append(compositions, f.exprs.compositions...)
+	return fingerprints, compositions, nil
+}
+
+// Packet matches if any of the fingerprints matches
+func matchAny(fingerprints []*Fingerprint) FingerprintFunc {
+	fs := Map[*Fingerprint, FingerprintFunc](fingerprints, func(x *Fingerprint) FingerprintFunc {
+		return FingerprintFromSigns(x.signs)
+	})
+	return func(p *Packet) bool {
+		for _, f := range fs {
+			if f(p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func runApply(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("apply", "Writes every packet matching any of the given fingerprints as a CSV fixture.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	var fgpts fingerprintFlags
+	fgpts.register(fs)
+	out := fs.String("out", "", "write matching packets to this file instead of stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fgpts.path == "" && len(fgpts.exprs.fingerprints) == 0 {
+		return usagef("-fingerprints or -expr is required")
+	}
+	if err := fgpts.validate(); err != nil {
+		return err
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	fingerprints, _, err := fgpts.load()
+	if err != nil {
+		return err
+	}
+	splits, err := data.load(context.Background())
+	if err != nil {
+		return err
+	}
+	matched := FilterSplitsBy(splits, matchAny(fingerprints))
+	log.Printf("Matched %d of %d packets\n", SplitLen(matched), SplitLen(splits))
+
+	w, closeOutput, err := createOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	if err := WriteFixture(w, matched); err != nil {
+		closeOutput()
+		return err
+	}
+	return closeOutput()
+}
+
+func runInspect(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("inspect", "Prints sources and ports of the packets matching each given fingerprint, or of the whole dataset without fingerprints.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	var fgpts fingerprintFlags
+	fgpts.register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := fgpts.validate(); err != nil {
+		return err
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	fingerprints, compositions, err := fgpts.load()
+	if err != nil {
+		return err
+	}
+	splits, err := data.load(context.Background())
+	if err != nil {
+		return err
+	}
+	size := SplitLen(splits)
+	if len(fingerprints) == 0 {
+		fgpt_data := GetPackets(splits, func(p *Packet) bool { return true })
+		fmt.Fprint(stdout, SprintFingerprintData(fgpt_data, float64(size)))
+		return nil
+	}
+	for i, fgpt := range fingerprints {
+		fgpt_data := GetPackets(splits, FingerprintFromSigns(fgpt.signs))
+		fmt.Fprintf(stdout, "%s%s\n", SprintFingerprint(fgpt, i, compositions), SprintFingerprintData(fgpt_data, float64(size)))
+	}
+	return nil
+}
+
+// synth
+
+func runSynth(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("synth", "Writes a fixture of background radiation mixed with emulated scanning tools, and the tool that sent each packet.", stderr)
+	tools_spec := fs.String("tools", "zmap,masscan,mirai", "comma separated tools to emulate: zmap, masscan, mirai, nmap, unicornscan, or rules such as xor:ip_id=dst_port^4660")
+	share := fs.Float64("share", 0.01, "fraction of the packets sent by each tool")
+	n_splits := fs.Int("splits", 4, "number of splits")
+	n_packets := fs.Int("packets", 50000, "packets per split")
+	n_sources := fs.Int("sources", 8, "source addresses per tool")
+	start_s := fs.String("start", "2024-01-01 00:00:00", "time of the first split (YYYY-MM-DD hh:mm:ss, UTC)")
+	slice := fs.Duration("slice", time.Hour, "time between splits")
+	seed := fs.Uint64("seed", 1, "seed of the generated traffic")
+	out := fs.String("out", "", "write the fixture to this file instead of stdout")
+	labels := fs.String("labels", "", "write the tool of every packet, in fixture order, to this CSV file")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	start, err := time.ParseInLocation(time.DateTime, *start_s, time.UTC)
+	switch {
+	case err != nil:
+		return usagef("invalid -start: %s", err)
+	case *n_splits <= 0:
+		return usagef("-splits must be positive")
+	case *n_packets <= 0:
+		return usagef("-packets must be positive")
+	case *n_sources <= 0:
+		return usagef("-sources must be positive")
+	case *slice <= 0:
+		return usagef("-slice must be positive")
+	case *share < 0:
+		return usagef("-share must not be negative")
+	}
+	specs := strings.Split(*tools_spec, ",")
+	if *tools_spec == "" {
+		specs = nil
+	}
+	if float64(len(specs)) * *share > 1 {
+		return usagef("-share of %d tools exceeds all packets", len(specs))
+	}
+	tools := make([]*SyntheticTool, 0, len(specs))
+	for _, spec := range specs {
+		tool, err := ParseSyntheticTool(spec, *share)
+		if err != nil {
+			return usagef("-tools: %s", err)
+		}
+		tools = append(tools, tool)
+	}
+
+	data := GenerateSynthetic(SeededRand(*seed, PacketStream), tools, *n_splits, *n_packets, *n_sources, start, *slice)
+	w, closeOutput, err := createOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	if err := WriteFixture(w, data.splits); err != nil {
+		closeOutput()
+		return err
+	}
+	if err := closeOutput(); err != nil {
+		return err
+	}
+	if *labels != "" {
+		file, err := os.Create(*labels)
+		if err != nil {
+			return err
+		}
+		if err := data.WriteLabels(file); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	if *out != "" {
+		end := start.Add(time.Duration(*n_splits) * *slice)
+		fmt.Fprintf(stderr, "Read with -fixture %s -start %q -end %q -slice %s\n", *out, start.Format(time.DateTime), end.Format(time.DateTime), *slice)
+	}
+	return nil
+}
+
+// evaluate
+
+func runEvaluate(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("evaluate", "Matches each fingerprint to the tool sending most of its packets and reports precision, recall and F1 against the labels.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	var fgpts fingerprintFlags
+	fgpts.register(fs)
+	labels := fs.String("labels", "", "labels of the dataset, as written by synth -labels")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := fgpts.validate(); err != nil {
+		return err
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+	if *labels == "" {
+		return usagef("-labels is required")
+	}
+
+	fingerprints, compositions, err := fgpts.load()
+	if err != nil {
+		return err
+	}
+	splits, err := data.load(context.Background())
+	if err != nil {
+		return err
+	}
+	truth, err := LoadGroundTruth(*labels, splits)
+	if err != nil {
+		return err
+	}
+	evaluation, err := EvaluateFingerprints(fingerprints, splits, truth)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, SprintEvaluation(evaluation, fingerprints, compositions))
+	return nil
+}
+
+// sweep
+
+// Comma separated numbers of a list flag
+func parseInts(name string, s string) ([]int, error) {
+	values := make([]int, 0)
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, usagef("invalid -%s: %s", name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func parseFloats(name string, s string) ([]float64, error) {
+	values := make([]float64, 0)
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, usagef("invalid -%s: %s", name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func runSweep(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("sweep", "Runs discover once per combination of the given search parameters and writes a table comparing the runs.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	n_functions := fs.Int("functions", 10000, "number of functions to generate on top of the initial set")
+	binary_ops := fs.String("binary-ops", "xor", "comma separated binary operations to generate functions from: and, or, xor, add, sub, mul")
+	feature_exts := fs.String("feature-exts", "lbytes1,lbytes2,rbytes1,rbytes2", "comma separated feature extractions to generate functions from, as for discover")
+	samples_s := fs.String("samples", "100000", "comma separated packets sampled per iteration")
+	sign_thres_s := fs.String("sign-thres", "", "comma separated initial effective sign thresholds, half, once and twice the default of the scorer if empty: 250,500,1000 for variance_ratio")
+	max_sign_s := fs.String("max-sign", "10", "comma separated maximum numbers of signs considered per function")
+	featext_s := fs.String("featext-probability", "0.5", "comma separated probabilities of generating a feature extraction")
+	n_random := fs.Int("random", 0, "draw this many runs with every parameter uniform between its least and greatest value instead of the grid")
+	n_iterations := fs.Int("iterations", 50, "maximum number of iterations per run")
+	n_packets := fs.Int("packets", 0, "expected number of packets, 0 to count the dataset")
+	seed := fs.Uint64("seed", 1, "seed of every run, and of the random search")
+	config_path := fs.String("config", "", "YAML file overriding the default worker counts, limits and thresholds of the search")
+	labels := fs.String("labels", "", "labels of the dataset, as written by synth -labels, to add precision, recall and F1 per run")
+	out := fs.String("out", "", "write the table to this file instead of stdout")
+	format := fs.String("format", "csv", "output format: csv, or json with the fingerprints of every run")
+	timeout := fs.Duration("timeout", 0, "stop after this long and write the runs done so far, 0 for no limit")
+	run_timeout := fs.Duration("run-timeout", 0, "stop every run after this long and keep the fingerprints it found, 0 for no limit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	n_samples, err := parseInts("samples", *samples_s)
+	if err != nil {
+		return err
+	}
+	var sign_thres []float64
+	if *sign_thres_s != "" {
+		if sign_thres, err = parseFloats("sign-thres", *sign_thres_s); err != nil {
+			return err
+		}
+	}
+	max_sign, err := parseInts("max-sign", *max_sign_s)
+	if err != nil {
+		return err
+	}
+	featext_probability, err := parseFloats("featext-probability", *featext_s)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *format != "csv" && *format != "json":
+		return usagef("-format must be csv or json")
+	case *timeout < 0 || *run_timeout < 0:
+		return usagef("-timeout and -run-timeout must not be negative")
+	case *n_functions <= 0:
+		return usagef("-functions must be positive")
+	case slices.Min(n_samples) <= 0:
+		return usagef("-samples must be positive")
+	case len(sign_thres) > 0 && slices.Min(sign_thres) <= 0:
+		return usagef("-sign-thres must be positive")
+	case slices.Min(max_sign) <= 0:
+		return usagef("-max-sign must be positive")
+	case slices.Min(featext_probability) < 0 || slices.Max(featext_probability) > 1:
+		return usagef("-featext-probability must be between 0 and 1")
+	case *n_random < 0:
+		return usagef("-random must not be negative")
+	case *n_iterations <= 0:
+		return usagef("-iterations must be positive")
+	case *n_packets < 0:
+		return usagef("-packets must not be negative")
+	}
+	binary_operations, err := SelectBinaryOperations(strings.Split(*binary_ops, ","))
+	if err != nil {
+		return usagef("-binary-ops: %s", err)
+	}
+	// Every run selects the feature extractions again, as sampled parameters are drawn from its functions seed
+	if _, err := SelectFeatureExtractions(strings.Split(*feature_exts, ","), SeededRand(*seed, FunctionStream)); err != nil {
+		return usagef("-feature-exts: %s", err)
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+	config := DefaultConfig()
+	if *config_path != "" {
+		config, err = LoadConfig(*config_path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sign_thres) == 0 {
+		initial := Scorer_thresholds[config.Signs.Scorer].Initial
+		sign_thres = []float64{initial / 2, initial, initial * 2}
+	}
+
+	runs := SweepGrid(n_samples, sign_thres, max_sign, featext_probability)
+	if *n_random > 0 {
+		runs = SweepRandom(SeededRand(*seed, SweepStream), *n_random, n_samples, sign_thres, max_sign, featext_probability)
+	}
+
+	// Interrupting stops the sweep, the runs done so far are still written
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	splits, err := data.load(ctx)
+	if err != nil {
+		return err
+	}
+	if *n_packets == 0 {
+		*n_packets = SplitLen(splits)
+	}
+	var truth *GroundTruth
+	if *labels != "" {
+		truth, err = LoadGroundTruth(*labels, splits)
+		if err != nil {
+			return err
+		}
+	}
+
+	results, sweep_err := Sweep(
+		ctx,
+		splits,
+		runs,
+		*run_timeout,
+		*n_functions,
+		InitialSetFor(splits),
+		binary_operations,
+		strings.Split(*feature_exts, ","),
+		*n_iterations,
+		*n_packets,
+		*seed,
+		config,
+		data.zmap,
+		truth,
+	)
+	if sweep_err != nil {
+		log.Printf("Stopped after %d of %d runs: %s\n", len(results), len(runs), sweep_err)
+	}
+
+	w, closeOutput, err := createOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		err = WriteSweepJSON(w, results, *seed, config)
+	} else {
+		err = WriteSweepCSV(w, results)
+	}
+	if err != nil {
+		closeOutput()
+		return err
+	}
+	return errors.Join(closeOutput(), sweep_err)
+}
+
+// known
+
+func runKnown(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("known", "Lists the known scanner fingerprints discover flags matches with, checking a library file if given.", stderr)
+	known_path := fs.String("known", "", "library of known fingerprints, the built-in one if empty")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *known_path == "none" {
+		return usagef("-known none lists nothing")
+	}
+	registry, err := loadKnown(*known_path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, SprintKnownRegistry(registry))
+	return nil
+}
+
+// classify
+
+func runClassify(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("classify", "Labels every packet with all fingerprints matching it in one pass, and summarises each label and the unclassified packets.", stderr)
+	var data datasetFlags
+	data.register(fs)
+	var fgpts fingerprintFlags
+	fgpts.register(fs)
+	names := fs.String("names", "", "comma separated labels of the given fingerprints, fingerprint-<i> if empty")
+	known_path := fs.String("known", "none", "also classify by this library of known fingerprints, labelled by their names; empty for the built-in one")
+	first_match := fs.Bool("first-match", false, "give every packet only the first matching label, given fingerprints before known ones")
+	n_workers := fs.Int("workers", 8, "splits classified concurrently")
+	format := fs.String("format", "text", "output format: text, or csv with one row per label")
+	out := fs.String("out", "", "write the summary to this file instead of stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	switch {
+	case *format != "text" && *format != "csv":
+		return usagef("-format must be text or csv")
+	case *n_workers <= 0:
+		return usagef("-workers must be positive")
+	}
+	if err := fgpts.validate(); err != nil {
+		return err
+	}
+	if err := data.validate(); err != nil {
+		return err
+	}
+
+	fingerprints, _, err := fgpts.load()
+	if err != nil {
+		return err
+	}
+	labels := make([]string, len(fingerprints))
+	for i := range labels {
+		labels[i] = fmt.Sprintf("fingerprint-%d", i)
+	}
+	if *names != "" {
+		labels = strings.Split(*names, ",")
+		if len(labels) != len(fingerprints) {
+			return usagef("-names has %d labels for %d fingerprints", len(labels), len(fingerprints))
+		}
+	}
+	registry, err := loadKnown(*known_path)
+	if err != nil {
+		return err
+	}
+	if registry != nil {
+		for _, known := range registry.fingerprints {
+			// A single packet does not tell the value of a key
+			if known.Keyed() {
+				log.Printf("Known fingerprint %s has a per scan key, not classifying by it\n", known.name)
+				continue
+			}
+			fingerprints = append(fingerprints, known.fgpt)
+			labels = append(labels, known.name)
+		}
+	}
+	if len(fingerprints) == 0 {
+		return usagef("-fingerprints, -expr or -known is required")
+	}
+	if err := ValidateLabels(labels); err != nil {
+		return usagef("%s", err)
+	}
+
+	splits, err := data.load(context.Background())
+	if err != nil {
+		return err
+	}
+	classification, err := ClassifySplits(context.Background(), splits, labels, fingerprints, *first_match, *n_workers)
+	if err != nil {
+		return err
+	}
+
+	w, closeOutput, err := createOutput(*out, stdout)
+	if err != nil {
+		return err
+	}
+	if *format == "csv" {
+		if err := WriteClassificationCSV(w, classification); err != nil {
+			closeOutput()
+			return err
+		}
+	} else {
+		fmt.Fprint(w, SprintClassification(classification))
+	}
+	return closeOutput()
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"slices"
+	"time"
+)
+
+// Link types we know how to strip down to the IP header
+const (
+	LinkTypeEthernet  = 1
+	LinkTypeRaw       = 101
+	LinkTypeRawAlt    = 12
+	LinkTypeIPv4      = 228
+	LinkTypeIPv6      = 229
+	LinkTypeLinuxSLL  = 113
+	LinkTypeLinuxSLL2 = 276
+)
+
+const (
+	pcapMagicMicro        = 0xa1b2c3d4
+	pcapMagicNano         = 0xa1b23c4d
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngOptionEnd       = 0
+	pcapngOptionTsResol   = 9
+	etherTypeIPv4         = 0x0800
+	etherTypeIPv6         = 0x86dd
+	etherTypeVLAN         = 0x8100
+	etherTypeQinQ         = 0x88a8
+	ipProtocolTCP         = 6
+	ipv6HopByHop          = 0
+	ipv6Routing           = 43
+	ipv6Fragment          = 44
+	ipv6DestOptions       = 60
+	tcpOptionEnd          = 0
+	tcpOptionNop          = 1
+	tcpOptionMSS          = 2
+	maxCaptureRecordBytes = 1 << 18
+	// Room for the fields and options of a pcapng block around a frame of the largest snaplen
+	maxPcapngBlockBytes = maxCaptureRecordBytes + 1<<16
+)
+
+// Raw frame as read from a capture file, before decoding
+type captureRecord struct {
+	ts       time.Time
+	linktype int
+	data     []byte
+}
+
+type captureReader interface {
+	next() (*captureRecord, error)
+}
+
+// Reads pcap and pcapng files and groups all TCP packets in time buckets of size bucket.
+// Every bucket becomes one split, ordered by time, with Split.time set to the bucket start.
+func ReadCaptureFiles(paths []string, bucket time.Duration) ([]*Split, error) {
+	if bucket <= 0 {
+		return nil, errors.New("Bucket size must be positive")
+	}
+	buckets := make(map[int64]*PacketColumns)
+	for _, path := range paths {
+		if err := readCaptureFile(path, bucket, buckets); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return bucketsToSplits(buckets, bucket), nil
+}
+
+func ReadCaptureFile(path string, bucket time.Duration) ([]*Split, error) {
+	return ReadCaptureFiles([]string{path}, bucket)
+}
+
+func readCaptureFile(
+	path string,
+	bucket time.Duration,
+	buckets map[int64]*PacketColumns,
+) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 1<<20)
+	reader, err := newCaptureReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, ok := DecodeFrame(record.linktype, record.data)
+		if !ok {
+			continue
+		}
+		key := record.ts.UnixNano() / int64(bucket)
+		if record.ts.UnixNano() < 0 && record.ts.UnixNano()%int64(bucket) != 0 {
+			key--
+		}
+		if buckets[key] == nil {
+			buckets[key] = NewPacketColumns(1024)
+		}
+		buckets[key].Append(p)
+	}
+}
+
+func bucketsToSplits(buckets map[int64]*PacketColumns, bucket time.Duration) []*Split {
+	keys := make([]int64, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	splits := make([]*Split, 0, len(keys))
+	for _, k := range keys {
+		splits = append(splits, NewSplit(time.Unix(0, k*int64(bucket)).UTC().Format(time.DateTime), buckets[k]))
+	}
+	return splits
+}
+
+func newCaptureReader(r *bufio.Reader) (captureReader, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errors.New("Not a capture file")
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		return &pcapngReader{r: r}, nil
+	}
+	return newPcapReader(r)
+}
+
+// Classic libpcap format
+
+type pcapReader struct {
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linktype int
+	header   [16]byte
+}
+
+func newPcapReader(r *bufio.Reader) (*pcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("Truncated pcap header")
+	}
+	reader := &pcapReader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicMicro:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagicMicro:
+		reader.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == pcapMagicNano:
+		reader.order, reader.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == pcapMagicNano:
+		reader.order, reader.nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("Unknown capture file magic")
+	}
+	reader.linktype = int(reader.order.Uint32(header[20:24]) & 0x0fffffff)
+	return reader, nil
+}
+
+func (reader *pcapReader) next() (*captureRecord, error) {
+	if _, err := io.ReadFull(reader.r, reader.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated pcap record header")
+		}
+		return nil, err
+	}
+	sec := int64(reader.order.Uint32(reader.header[0:4]))
+	frac := int64(reader.order.Uint32(reader.header[4:8]))
+	incl_len := reader.order.Uint32(reader.header[8:12])
+	if incl_len > maxCaptureRecordBytes {
+		return nil, fmt.Errorf("Pcap record too large: %d bytes", incl_len)
+	}
+	data := make([]byte, incl_len)
+	if _, err := io.ReadFull(reader.r, data); err != nil {
+		return nil, errors.New("Truncated pcap record")
+	}
+	if !reader.nano {
+		frac *= 1000
+	}
+	return &captureRecord{
+		ts:       time.Unix(sec, frac),
+		linktype: reader.linktype,
+		data:     data,
+	}, nil
+}
+
+// pcapng format, supporting multiple sections and interfaces
+
+type pcapngInterface struct {
+	linktype int
+	// Timestamp units per second
+	resolution uint64
+}
+
+type pcapngReader struct {
+	r          *bufio.Reader
+	order      binary.ByteOrder
+	interfaces []*pcapngInterface
+}
+
+func (reader *pcapngReader) next() (*captureRecord, error) {
+	for {
+		block_type, body, err := reader.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch block_type {
+		case pcapngInterfaceDesc:
+			if len(body) < 8 {
+				return nil, errors.New("Truncated pcapng interface block")
+			}
+			iface := &pcapngInterface{
+				linktype:   int(reader.order.Uint16(body[0:2])),
+				resolution: 1000000,
+			}
+			if err := reader.parseInterfaceOptions(iface, body[8:]); err != nil {
+				return nil, err
+			}
+			reader.interfaces = append(reader.interfaces, iface)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errors.New("Truncated pcapng packet block")
+			}
+			iface_id := int(reader.order.Uint32(body[0:4]))
+			if iface_id >= len(reader.interfaces) {
+				return nil, fmt.Errorf("Packet references unknown interface %d", iface_id)
+			}
+			iface := reader.interfaces[iface_id]
+			ts := uint64(reader.order.Uint32(body[4:8]))<<32 | uint64(reader.order.Uint32(body[8:12]))
+			cap_len := int(reader.order.Uint32(body[12:16]))
+			if 20+cap_len > len(body) {
+				return nil, errors.New("Truncated pcapng packet data")
+			}
+			sec := ts / iface.resolution
+			// The remainder times 1e9 overflows for resolutions finer than about 1e10 per second
+			hi, lo := bits.Mul64(ts%iface.resolution, 1000000000)
+			nsec, _ := bits.Div64(hi, lo, iface.resolution)
+			return &captureRecord{
+				ts:       time.Unix(int64(sec), int64(nsec)),
+				linktype: iface.linktype,
+				data:     body[20 : 20+cap_len],
+			}, nil
+		}
+		// Other block types carry no packets we can use
+	}
+}
+
+// Reads the next block, handling section headers (which may switch byte order) transparently
+func (reader *pcapngReader) readBlock() (uint32, []byte, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(reader.r, head); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, nil, errors.New("Truncated pcapng block header")
+			}
+			return 0, nil, err
+		}
+
+		if binary.LittleEndian.Uint32(head[0:4]) == pcapngSectionHeader {
+			bom, err := reader.r.Peek(4)
+			if err != nil {
+				return 0, nil, errors.New("Truncated pcapng section header")
+			}
+			if binary.LittleEndian.Uint32(bom) == pcapngByteOrderMagic {
+				reader.order = binary.LittleEndian
+			} else if binary.BigEndian.Uint32(bom) == pcapngByteOrderMagic {
+				reader.order = binary.BigEndian
+			} else {
+				return 0, nil, errors.New("Invalid pcapng byte order magic")
+			}
+			// Interface ids are scoped to their section
+			reader.interfaces = reader.interfaces[:0]
+		}
+		if reader.order == nil {
+			return 0, nil, errors.New("pcapng block before section header")
+		}
+
+		block_type := reader.order.Uint32(head[0:4])
+		total_len := reader.order.Uint32(head[4:8])
+		if total_len < 12 || total_len%4 != 0 || total_len > maxPcapngBlockBytes {
+			return 0, nil, fmt.Errorf("Invalid pcapng block length: %d", total_len)
+		}
+		rest := make([]byte, total_len-8)
+		if _, err := io.ReadFull(reader.r, rest); err != nil {
+			return 0, nil, errors.New("Truncated pcapng block")
+		}
+		if block_type == pcapngSectionHeader {
+			continue
+		}
+		// Strip the trailing copy of the block length
+		return block_type, rest[:len(rest)-4], nil
+	}
+}
+
+// Resolutions of 10^20 or 2^64 per second and above do not fit the uint64 of timestamp units
+func (reader *pcapngReader) parseInterfaceOptions(iface *pcapngInterface, options []byte) error {
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options[0:2])
+		length := int(reader.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			return nil
+		}
+		if code == pcapngOptionTsResol && length >= 1 {
+			resol := options[4]
+			exp := int(resol & 0x7f)
+			var base uint64 = 10
+			max_exp := 19
+			if resol&0x80 != 0 {
+				base, max_exp = 2, 63
+			}
+			if exp > max_exp {
+				return fmt.Errorf("Invalid pcapng timestamp resolution: %d^-%d seconds", base, exp)
+			}
+			iface.resolution = 1
+			for i := 0; i < exp; i++ {
+				iface.resolution *= base
+			}
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(options) {
+			return nil
+		}
+		options = options[4+padded:]
+	}
+	return nil
+}
+
+// Frame decoding
+
+// Decodes a single link layer frame into a Packet. Returns false for anything that is not TCP over IPv4 or IPv6.
+func DecodeFrame(linktype int, data []byte) (*Packet, bool) {
+	switch linktype {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		ether_type := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for ether_type == etherTypeVLAN || ether_type == etherTypeQinQ {
+			if len(data) < 4 {
+				return nil, false
+			}
+			ether_type = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if !isIPEtherType(ether_type) {
+			return nil, false
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 || !isIPEtherType(binary.BigEndian.Uint16(data[14:16])) {
+			return nil, false
+		}
+		data = data[16:]
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 || !isIPEtherType(binary.BigEndian.Uint16(data[0:2])) {
+			return nil, false
+		}
+		data = data[20:]
+	case LinkTypeRaw, LinkTypeRawAlt, LinkTypeIPv4, LinkTypeIPv6:
+	default:
+		return nil, false
+	}
+	return DecodeIP(data)
+}
+
+func isIPEtherType(ether_type uint16) bool {
+	return ether_type == etherTypeIPv4 || ether_type == etherTypeIPv6
+}
+
+// Decodes an IPv4 or IPv6 packet carrying TCP into a Packet
+func DecodeIP(data []byte) (*Packet, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	default:
+		return nil, false
+	}
+}
+
+func decodeIPv4(data []byte) (*Packet, bool) {
+	if len(data) < 20 {
+		return nil, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return nil, false
+	}
+	// Only the first fragment carries the TCP header
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 || data[9] != ipProtocolTCP {
+		return nil, false
+	}
+	tcp := data[ihl:]
+	if len(tcp) < 20 {
+		return nil, false
+	}
+	p := &Packet{
+		IPId:  binary.BigEndian.Uint16(data[4:6]),
+		TTL:   data[8],
+		IPLen: binary.BigEndian.Uint16(data[2:4]),
+	}
+	SetIPv4Addrs(p, binary.BigEndian.Uint32(data[12:16]), binary.BigEndian.Uint32(data[16:20]))
+	decodeTCP(p, tcp)
+	return p, true
+}
+
+// IPv6 has no IP Id, so IPId is taken from a fragment header if present.
+// IPLen is the payload length plus the fixed header, like the IPv4 total length.
+func decodeIPv6(data []byte) (*Packet, bool) {
+	if len(data) < 40 {
+		return nil, false
+	}
+	p := &Packet{
+		TTL:   data[7],
+		IPLen: binary.BigEndian.Uint16(data[4:6]) + 40,
+	}
+	SetIPv6Addrs(p, [16]byte(data[8:24]), [16]byte(data[24:40]))
+
+	next := data[6]
+	rest := data[40:]
+	for next != ipProtocolTCP {
+		if len(rest) < 8 {
+			return nil, false
+		}
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			length := (int(rest[1]) + 1) * 8
+			if len(rest) < length {
+				return nil, false
+			}
+			next, rest = rest[0], rest[length:]
+		case ipv6Fragment:
+			if binary.BigEndian.Uint16(rest[2:4])&0xfff8 != 0 {
+				return nil, false
+			}
+			p.IPId = uint16(binary.BigEndian.Uint32(rest[4:8]))
+			next, rest = rest[0], rest[8:]
+		default:
+			return nil, false
+		}
+	}
+	if len(rest) < 20 {
+		return nil, false
+	}
+	decodeTCP(p, rest)
+	return p, true
+}
+
+// Fills the TCP fields of p from a TCP header of at least 20 bytes
+func decodeTCP(p *Packet, tcp []byte) {
+	p.SrcPort = binary.BigEndian.Uint16(tcp[0:2])
+	p.DstPort = binary.BigEndian.Uint16(tcp[2:4])
+	p.Seq = binary.BigEndian.Uint32(tcp[4:8])
+	p.Ack = binary.BigEndian.Uint32(tcp[8:12])
+	p.Flags = tcp[13]
+	p.Window = binary.BigEndian.Uint16(tcp[14:16])
+
+	data_offset := Min(int(tcp[12]>>4)*4, len(tcp))
+	if data_offset > 20 {
+		p.MSS, p.OptLayout = decodeTCPOptions(tcp[20:data_offset])
+	}
+}
+
+// Returns the MSS option, if any, and the option layout as stored in Packet.OptLayout
+func decodeTCPOptions(options []byte) (uint16, uint32) {
+	var mss uint16
+	var layout uint32
+	n := 0
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if n < 8 {
+			layout |= uint32(Min(int(kind), 15)) << (28 - 4*n)
+			n++
+		}
+		if kind == tcpOptionEnd {
+			break
+		}
+		if kind == tcpOptionNop {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		length := int(options[i+1])
+		if kind == tcpOptionMSS && length == 4 {
+			mss = binary.BigEndian.Uint16(options[i+2 : i+4])
+		}
+		i += length
+	}
+	return mss, layout
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendPcapngBlock(b *bytes.Buffer, block_type uint32, body []byte) {
+	padded := (len(body) + 3) &^ 3
+	total_len := uint32(12 + padded)
+	binary.Write(b, binary.LittleEndian, block_type)
+	binary.Write(b, binary.LittleEndian, total_len)
+	b.Write(body)
+	b.Write(make([]byte, padded-len(body)))
+	binary.Write(b, binary.LittleEndian, total_len)
+}
+
+// Ethernet frame of a SYN from 1.2.3.4 to 10.0.0.1 with IP Id 54321, padded with zeros to size bytes
+func testFrame(size int) []byte {
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0], ip[8], ip[9] = 0x45, 64, ipProtocolTCP
+	binary.BigEndian.PutUint16(ip[2:4], 40)
+	binary.BigEndian.PutUint16(ip[4:6], ZMapIPId)
+	binary.BigEndian.PutUint32(ip[12:16], 0x01020304)
+	binary.BigEndian.PutUint32(ip[16:20], 0x0a000001)
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	tcp[12], tcp[13] = 0x50, 0x02
+	return frame
+}
+
+// pcapng section with one Ethernet interface, with an if_tsresol option of tsresol unless it is
+// negative, and an enhanced packet block per frame at the timestamp of the same index
+func testPcapng(tsresol int, frames [][]byte, timestamps []uint64) []byte {
+	var b bytes.Buffer
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	appendPcapngBlock(&b, pcapngSectionHeader, shb)
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], LinkTypeEthernet)
+	binary.LittleEndian.PutUint32(idb[4:8], maxCaptureRecordBytes)
+	if tsresol >= 0 {
+		idb = binary.LittleEndian.AppendUint16(idb, pcapngOptionTsResol)
+		idb = binary.LittleEndian.AppendUint16(idb, 1)
+		idb = append(idb, byte(tsresol), 0, 0, 0)
+	}
+	appendPcapngBlock(&b, pcapngInterfaceDesc, idb)
+
+	// Every frame with a comment option after it
+	for i, frame := range frames {
+		epb := make([]byte, 20, 20+len(frame)+16)
+		binary.LittleEndian.PutUint32(epb[4:8], uint32(timestamps[i]>>32))
+		binary.LittleEndian.PutUint32(epb[8:12], uint32(timestamps[i]))
+		binary.LittleEndian.PutUint32(epb[12:16], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(epb[16:20], uint32(len(frame)))
+		epb = append(epb, frame...)
+		epb = binary.LittleEndian.AppendUint16(epb, 1)
+		epb = binary.LittleEndian.AppendUint16(epb, 7)
+		epb = append(epb, "comment\x00"...)
+		epb = append(epb, 0, 0, 0, 0)
+		appendPcapngBlock(&b, pcapngEnhancedPacket, epb)
+	}
+	return b.Bytes()
+}
+
+func TestPcapngFullSnaplen(t *testing.T) {
+	// A frame of the full snaplen
+	frames := [][]byte{testFrame(60), testFrame(maxCaptureRecordBytes)}
+	path := filepath.Join(t.TempDir(), "full.pcapng")
+	if err := os.WriteFile(path, testPcapng(-1, frames, []uint64{1000000, 1000000}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	splits, err := ReadCaptureFile(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(splits) != 1 || splits[0].size != 2 {
+		t.Fatalf("Got %d splits, want one of 2 packets", len(splits))
+	}
+	var p Packet
+	for j := 0; j < 2; j++ {
+		splits[0].packets.Row(j, &p)
+		if p.IPId != ZMapIPId || p.DstPort != 80 || p.DstIp != 0x0a000001 {
+			t.Fatalf("Packet %d decoded as %+v", j, p)
+		}
+	}
+}
+
+func TestPcapngTimestampResolution(t *testing.T) {
+	for _, c := range []struct {
+		tsresol int
+		ts      uint64
+		want    time.Time
+	}{
+		{-1, 1700000000123456, time.Unix(1700000000, 123456000)},
+		{9, 1700000000123456789, time.Unix(1700000000, 123456789)},
+		// Picoseconds, where the remainder times 1e9 does not fit a uint64
+		{12, 10000000*1000000000000 + 123456789012, time.Unix(10000000, 123456789)},
+		{19, 1*10000000000000000000 + 5000000000000000000, time.Unix(1, 500000000)},
+		{0x80 | 30, 5<<30 + 1<<29, time.Unix(5, 500000000)},
+		{0x80 | 63, 1<<63 + 1<<62, time.Unix(1, 500000000)},
+	} {
+		reader, err := newCaptureReader(bufio.NewReader(bytes.NewReader(testPcapng(c.tsresol, [][]byte{testFrame(60)}, []uint64{c.ts}))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := reader.next()
+		if err != nil {
+			t.Fatalf("if_tsresol %#x: %s", c.tsresol, err)
+		}
+		if !record.ts.Equal(c.want) {
+			t.Errorf("if_tsresol %#x: got %s, want %s", c.tsresol, record.ts.UTC(), c.want.UTC())
+		}
+	}
+
+	// 10^20 and 2^64 units per second overflow the resolution
+	for _, tsresol := range []int{20, 0x7f, 0x80 | 64, 0xff} {
+		reader, err := newCaptureReader(bufio.NewReader(bytes.NewReader(testPcapng(tsresol, [][]byte{testFrame(60)}, []uint64{1}))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.next(); err == nil {
+			t.Errorf("Expected an error for if_tsresol %#x", tsresol)
+		}
+	}
+}
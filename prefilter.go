@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+)
+
+// Draws n distinct packets from all splits, or takes all of them if there are not more than n
+func sample_packets(r *rand.Rand, splits []*Split, n int) *PacketColumns {
+	total := SplitLen(splits)
+	n = Min(n, total)
+	// Floyd's algorithm, rows are sorted so the sample does not depend on map order
+	seen := make(map[int]struct{}, n)
+	rows := make([]int, 0, n)
+	for j := total - n; j < total; j++ {
+		row := r.IntN(j + 1)
+		if _, ok := seen[row]; ok {
+			row = j
+		}
+		seen[row] = struct{}{}
+		rows = append(rows, row)
+	}
+	slices.Sort(rows)
+
+	sample := NewPacketColumns(n)
+	var p Packet
+	offset, split_idx := 0, 0
+	for _, row := range rows {
+		for row >= offset + splits[split_idx].size {
+			offset += splits[split_idx].size
+			split_idx++
+		}
+		splits[split_idx].packets.Row(row - offset, &p)
+		sample.Append(&p)
+	}
+	return sample
+}
+
+// Shannon entropy in bits of the values f takes on packets
+func column_entropy(ctx context.Context, f ColumnFunction, packets *PacketColumns) float64 {
+	counts := make(map[uint64]int)
+	EvalColumns(f, packets, func(_ int, values []uint64) bool {
+		for _, v := range values {
+			counts[v] += 1
+		}
+		return ctx.Err() == nil
+	})
+	// Summed in a fixed order, so the same packets give the same entropy
+	sorted := make([]int, 0, len(counts))
+	for _, count := range counts {
+		sorted = append(sorted, count)
+	}
+	slices.Sort(sorted)
+	entropy := 0.0
+	n := float64(packets.Len())
+	for _, count := range sorted {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Estimates the entropy of every function not in bad_functions on packets and returns the near-constant
+// ones with at most min_entropy bits, which cannot have effective signs on packets like these. With
+// max_entropy_fraction above 0 it also returns the near-uniform ones above that fraction of the entropy
+// of a different value per packet. These are only skipped when asked for, a scanner sending a small
+// share of the packets can be the only thing such a function does not spread evenly.
+func Prefilter_functions(
+	ctx context.Context,
+	columns []ColumnFunction,
+	packets *PacketColumns,
+	min_entropy float64,
+	max_entropy_fraction float64,
+	bad_functions map[int]struct{},
+	n_workers int,
+) (map[int]struct{}, error) {
+	tasks := make(chan *EntropyJob, len(columns))
+	results := make(chan *EntropyResult)
+
+	for i := 0; i < n_workers; i++ {
+		go EntropyWorker(
+			&Worker[*EntropyJob, *EntropyResult]{i, tasks, results},
+		)
+	}
+
+	var wg sync.WaitGroup
+	for i, f := range columns {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := bad_functions[i]; ok {
+			continue
+		}
+		wg.Add(1)
+		tasks <- &EntropyJob{
+			ctx:		ctx,
+			index:		i,
+			columns:	f,
+			packets:	packets,
+			wg:			&wg,
+		}
+	}
+	close(tasks)
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	max_entropy := math.Inf(1)
+	if max_entropy_fraction > 0 {
+		max_entropy = max_entropy_fraction * math.Log2(float64(packets.Len()))
+	}
+	skipped := make(map[int]struct{})
+	n_constant, n_uniform := 0, 0
+	for result := range results {
+		switch {
+		case result.entropy <= min_entropy:
+			n_constant++
+		case result.entropy >= max_entropy:
+			n_uniform++
+		default:
+			continue
+		}
+		skipped[result.index] = struct{}{}
+	}
+	if err := ctx.Err(); err != nil {
+		return skipped, err
+	}
+	log.Printf(
+		"    Pre-filter skipped %d of %d functions, %d near-constant and %d near-uniform\n",
+		len(skipped), len(columns), n_constant, n_uniform,
+	)
+	return skipped, nil
+}
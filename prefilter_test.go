@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPrefilterFunctions(t *testing.T) {
+	// ZMap's IP Id is a sign in a tenth of the packets, the sequence numbers are random in all of them
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.1)}, 2, 5000, 8, fixtureStart, time.Hour)
+	exprs := []string{"ip_id", "seq", "xor(ttl, ttl)", "ttl", "dst_port"}
+	compositions := make([]*TCPComposition, len(exprs))
+	for i, expr := range exprs {
+		_, _, comp, err := ParseFunction(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compositions[i] = comp
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := sample_packets(SeededRand(1, PrefilterStream), data.splits, 4096)
+	if packets.Len() != 4096 {
+		t.Fatalf("Sampled %d packets, want 4096", packets.Len())
+	}
+
+	for _, c := range []struct {
+		max_entropy_fraction	float64
+		bad_functions			map[int]struct{}
+		want					[]int
+	}{
+		// Only the constant one by default
+		{0, nil, []int{2}},
+		// Random sequence numbers are near-uniform, the IP Id and port are not with ZMap's packets
+		{0.999, nil, []int{1, 2}},
+		{0.999, map[int]struct{}{1: {}}, []int{2}},
+	} {
+		skipped, err := Prefilter_functions(context.Background(), columns, packets, 0.01, c.max_entropy_fraction, c.bad_functions, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]int, 0, len(skipped))
+		for f_idx := range skipped {
+			got = append(got, f_idx)
+		}
+		slices.Sort(got)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("Max entropy fraction %g skipped %v, want %v", c.max_entropy_fraction, got, c.want)
+		}
+	}
+}
@@ -2,81 +2,117 @@ package main
 
 import (
 	"fmt"
+	"net/netip"
 )
 
 type FingerprintFunc func(*Packet) bool
 
-var (
-	l2bSeq, _, _ = lnbyte_(2)(get_Seq, 0, nil)
-	xorl2bSeqSeq, _, _ = xor_(l2bSeq, 0, nil, get_Seq, 0, nil)
-	xorxorl2bSeqSeqDstIp, _, _ = xor_(xorl2bSeqSeq, 0, nil, get_DstIp, 0, nil)
+// Packet matches if it matches all signs
+func FingerprintFromSigns(signs []*Sign) FingerprintFunc {
+	return func(p *Packet) bool {
+		for _, sign := range signs {
+			if int(sign.f(p)) != sign.b {
+				return false
+			}
+		}
+		return true
+	}
+}
 
-	r2bSeq, _, _ = rnbyte_(1)(get_Seq, 0, nil)
-	xorIpIdR2bSeq, _, _ = xor_(r2bSeq, 0, nil, get_IPId, 0, nil)
-	xorxorIpIdR2bSeqSeq, _, _ = xor_(xorIpIdR2bSeq, 0, nil, get_Seq, 0, nil)
+// Turns intersections into fingerprints, where intersection idxs refer to functionResults
+func IntersectionsToFingerprints(
+	intersections []*Intersection,
+	functionResults []*FunctionResult,
+) []*Fingerprint {
+	return Map[*Intersection, *Fingerprint](
+		intersections,
+		func(x *Intersection) *Fingerprint {
+			return &Fingerprint{
+				signs:	Map[int, *Sign](x.idxs, func(a int) *Sign {
+					return functionResults[a].sign
+				}),
+				idxs:	Map[int, int](x.idxs, func(a int) int {
+					return functionResults[a].index
+				}),
+			}
+		},
+	)
+}
 
-	fgpts = []FingerprintFunc{fgpt1}
-)
+// Keeps only packets matching f, preserving splits
+func FilterSplitsBy(splits []*Split, f FingerprintFunc) []*Split {
+	filtered := make([]*Split, len(splits))
+	var p Packet
+	for i, spl := range splits {
+		rows := make([]int, 0, spl.size / 10)
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			if f(&p) {
+				rows = append(rows, j)
+			}
+		}
+		filtered[i] = NewSplit(spl.time, spl.packets.Gather(rows))
+	}
+	return filtered
+}
+
+func NewFingerprintData() *FingerprintData {
+	return &FingerprintData{
+		sources:	make(map[netip.Addr]int),
+		ports:		make(map[uint16]int),
+	}
+}
+
+// Counts p, which is not kept so a row read into the same packet can be added
+func (d *FingerprintData) add(p *Packet) {
+	d.n_packets++
+	d.sources[SrcAddr(p)] += 1
+	d.ports[p.DstPort] += 1
+	d.n_sources, d.n_ports = len(d.sources), len(d.ports)
+}
+
+// Adds the counts of o to those of d
+func (d *FingerprintData) merge(o *FingerprintData) {
+	d.n_packets += o.n_packets
+	for src, count := range o.sources {
+		d.sources[src] += count
+	}
+	for port, count := range o.ports {
+		d.ports[port] += count
+	}
+	d.n_sources, d.n_ports = len(d.sources), len(d.ports)
+}
 
 func GetPackets(
 	splits []*Split,
 	f FingerprintFunc,
-	n_packets int,
 ) *FingerprintData {
-	packets := make([]*Packet, 0, n_packets)
+	data := NewFingerprintData()
+	var p Packet
 	for _, spl := range splits {
-		for _, p := range spl.packets {
-			if f(p) {
-				packets = append(packets, p)
+		for i := 0; i < spl.size; i++ {
+			spl.packets.Row(i, &p)
+			if f(&p) {
+				data.add(&p)
 			}
 		}
 	}
-
-	sources := make(map[uint32]int)
-	ports := make(map[uint16]int)
-	for _, p := range packets {
-		if _, ok := sources[p.SrcIp]; ok {
-			sources[p.SrcIp] += 1
-		} else {
-			sources[p.SrcIp] = 1
-		}
-		if _, ok := ports[p.DstPort]; ok {
-			ports[p.DstPort] += 1
-		} else {
-			ports[p.DstPort] = 1
-		}
-	}
-
-	return &FingerprintData{
-		packets:	packets,
-		sources:	sources,
-		n_sources:	len(sources),
-		ports:		ports,
-		n_ports:	len(ports),
-	}
+	return data
 }
 
 func SprintFingerprintData(data *FingerprintData, size float64) (str string) {
-	str += fmt.Sprintf("N packets: %d, fraction: %f\n", len(data.packets), float64(len(data.packets)) / size)
+	str += fmt.Sprintf("N packets: %d, fraction: %f\n", data.n_packets, float64(data.n_packets) / size)
 	str += fmt.Sprintf("N sources: %d\n", data.n_sources)
 	if data.n_sources < 50 {
 		for source, count := range data.sources {
-			str += fmt.Sprintf("  %s: %d\n", uint32ToIP(source), count)
+			str += fmt.Sprintf("  %s: %d\n", source, count)
 		}
 	}
 	str += fmt.Sprintf("N ports: %d\n", data.n_ports)
 	if data.n_ports < 20 {
 		for port, count := range data.ports {
-			str += fmt.Sprintf("  %s: %d\n", port, count)
+			str += fmt.Sprintf("  %d: %d\n", port, count)
 		}
 	}
 	return
 }
-
-func uint32ToIP(ip uint32) string {
-	return fmt.Sprintf("%d.%d.%d.%d",
-		byte(ip>>24),
-		byte(ip>>16),
-		byte(ip>>8),
-		byte(ip))
-}
\ No newline at end of file
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/montanaflynn/stats"
+)
+
+// Scores the appearance ratio at position i of ratios, sorted in decreasing order, against the
+// ratios of all binaries of a function over size packets. Function_worker keeps the binaries up to and
+// including the last of the first max_sign that score above the sign threshold, so thresholds depend on
+// the scorer.
+type SignScorer interface {
+	Score(i int, ratios []float64, size int) (float64, error)
+}
+
+// Scorers selectable in the config by name
+var Sign_scorers = map[string]SignScorer{
+	"variance_ratio":	VarianceRatioScorer{},
+	"zscore":			ZScoreScorer{},
+	"chi_square":		ChiSquareScorer{},
+	"kl_divergence":	KLDivergenceScorer{},
+}
+
+// Initial sign threshold, threshold step and floor a scorer is used with unless set, in its own scale.
+// A threshold step is a twentieth of the initial threshold and the floor a tenth, as for the variance ratio.
+type ScorerThresholds struct {
+	Initial float64
+	Step 	float64
+	Floor 	float64
+}
+
+// Chosen on synthetic splits of 100000 packets with scanners sending 2% of them each: above what
+// fields with a different value per packet score, below what the fields a scanner sets score
+var Scorer_thresholds = map[string]ScorerThresholds{
+	"variance_ratio":	{500, 25, 50},
+	"zscore":			{100, 5, 10},
+	"chi_square":		{5000, 250, 500},
+	"kl_divergence":	{2500, 125, 250},
+}
+
+func SignScorerNames() string {
+	names := make([]string, 0, len(Sign_scorers))
+	for name := range Sign_scorers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// Squared ratio of the variance of the ratios up to and including ratios[i] to that of the ratios below it
+type VarianceRatioScorer struct{}
+
+func (VarianceRatioScorer) Score(i int, ratios []float64, size int) (float64, error) {
+	return effective_indicator(ratios[i], ratios)
+}
+
+// Standard deviations ratios[i] lies above the mean ratio
+type ZScoreScorer struct{}
+
+func (ZScoreScorer) Score(i int, ratios []float64, size int) (float64, error) {
+	variance, err := stats.SampleVariance(ratios)
+	if err != nil {
+		return 0.0, err
+	}
+	if variance <= 0 {
+		return 0.0, errors.New("No variance in appearance ratios")
+	}
+	mean := 0.0
+	for _, r := range ratios {
+		mean += r
+	}
+	mean /= float64(len(ratios))
+	return (ratios[i] - mean) / math.Sqrt(variance), nil
+}
+
+// Contribution of the binary to the chi-square statistic of its count against a uniform
+// distribution over the observed binaries, 0 if it appears less often than expected
+type ChiSquareScorer struct{}
+
+func (ChiSquareScorer) Score(i int, ratios []float64, size int) (float64, error) {
+	if len(ratios) < 2 {
+		return 0.0, errors.New("Need at least two binaries")
+	}
+	expected := float64(size) / float64(len(ratios))
+	observed := ratios[i] * float64(size)
+	if observed <= expected {
+		return 0.0, nil
+	}
+	return math.Pow(observed - expected, 2) / expected, nil
+}
+
+// Contribution of the binary to the KL divergence of the ratios from a uniform distribution over the
+// observed binaries, times size so that it grows with the evidence like the chi-square score
+type KLDivergenceScorer struct{}
+
+func (KLDivergenceScorer) Score(i int, ratios []float64, size int) (float64, error) {
+	if len(ratios) < 2 {
+		return 0.0, errors.New("Need at least two binaries")
+	}
+	if ratios[i] <= 0 {
+		return 0.0, nil
+	}
+	return float64(size) * ratios[i] * math.Log(ratios[i] * float64(len(ratios))), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Appearance ratios of six binaries over 1000 packets, sorted in decreasing order
+var scorerTestRatios = []float64{0.5, 0.2, 0.1, 0.1, 0.06, 0.04}
+
+func testScorer(t *testing.T, scorer SignScorer, want []float64) {
+	t.Helper()
+	for i, w := range want {
+		got, err := scorer.Score(i, scorerTestRatios, 1000)
+		if math.IsNaN(w) {
+			if err == nil {
+				t.Errorf("Binary %d scored %g, want an error", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Binary %d: %s", i, err)
+		}
+		if math.Abs(got - w) > 1e-9 * math.Max(1, math.Abs(w)) {
+			t.Errorf("Binary %d scored %.12g, want %.12g", i, got, w)
+		}
+	}
+}
+
+func TestVarianceRatioScorer(t *testing.T) {
+	// Binary 4 leaves a single ratio below it, which has no sample variance, and binary 5 none
+	testScorer(t, VarianceRatioScorer{}, []float64{61.11399199753768, 17.827160493827158, 20.25, 20.25, math.NaN(), 1})
+}
+
+func TestZScoreScorer(t *testing.T) {
+	testScorer(t, ZScoreScorer{}, []float64{
+		1.9339791323230255, 0.19339791323230265, -0.386795826464605, -0.386795826464605, -0.618873322343368, -0.7349120702827495,
+	})
+	if _, err := (ZScoreScorer{}).Score(0, []float64{0.5, 0.5}, 1000); err == nil {
+		t.Error("Equal ratios scored without error")
+	}
+}
+
+func TestChiSquareScorer(t *testing.T) {
+	// 1000 / 6 packets are expected per binary, binaries seen less often score 0
+	testScorer(t, ChiSquareScorer{}, []float64{666.6666666666669, 6.666666666666671, 0, 0, 0, 0})
+	if _, err := (ChiSquareScorer{}).Score(0, []float64{1}, 1000); err == nil {
+		t.Error("A single binary scored without error")
+	}
+}
+
+func TestKLDivergenceScorer(t *testing.T) {
+	testScorer(t, KLDivergenceScorer{}, []float64{
+		549.3061443340549, 36.46431135879096, -51.08256237659905, -51.08256237659905, -61.29907485191889, -57.08465422560583,
+	})
+	if _, err := (KLDivergenceScorer{}).Score(0, []float64{1}, 1000); err == nil {
+		t.Error("A single binary scored without error")
+	}
+}
+
+func TestScorerThresholds(t *testing.T) {
+	for name := range Sign_scorers {
+		thresholds, ok := Scorer_thresholds[name]
+		if !ok {
+			t.Errorf("Scorer %s has no thresholds", name)
+			continue
+		}
+		if thresholds.Floor <= 0 || thresholds.Floor >= thresholds.Initial || thresholds.Step <= 0 || thresholds.Step >= thresholds.Initial {
+			t.Errorf("Scorer %s has thresholds %+v", name, thresholds)
+		}
+	}
+	// The defaults of the config are those of its scorer
+	config := DefaultConfig()
+	thresholds := Scorer_thresholds[config.Signs.Scorer]
+	if config.Threshold.Step != thresholds.Step || config.Threshold.Floor != thresholds.Floor {
+		t.Errorf("Default config has threshold %+v, its scorer %+v", config.Threshold, thresholds)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hyperparameter sweep
+//
+// Runs Fgpt_ident_iterative once per combination of search parameters on the same splits and seed,
+// and tabulates what every run found to pick the parameters for a new telescope.
+
+type SweepParameters struct {
+	n_samples 				int
+	sign_thres 				float64
+	max_sign 				int
+	featext_probability 	float64
+}
+
+// Every combination of the given values
+func SweepGrid(
+	n_samples []int,
+	sign_thres []float64,
+	max_sign []int,
+	featext_probability []float64,
+) []*SweepParameters {
+	runs := make([]*SweepParameters, 0, len(n_samples) * len(sign_thres) * len(max_sign) * len(featext_probability))
+	for _, p := range featext_probability {
+		for _, n := range n_samples {
+			for _, m := range max_sign {
+				for _, t := range sign_thres {
+					runs = append(runs, &SweepParameters{n, t, m, p})
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// n combinations with every parameter drawn uniformly between the least and greatest of its values
+func SweepRandom(
+	r *rand.Rand,
+	n int,
+	n_samples []int,
+	sign_thres []float64,
+	max_sign []int,
+	featext_probability []float64,
+) []*SweepParameters {
+	uniformInt := func(values []int) int {
+		lo, hi := slices.Min(values), slices.Max(values)
+		return lo + r.IntN(hi - lo + 1)
+	}
+	uniformFloat := func(values []float64) float64 {
+		lo, hi := slices.Min(values), slices.Max(values)
+		return lo + r.Float64() * (hi - lo)
+	}
+	runs := make([]*SweepParameters, n)
+	for i := range runs {
+		runs[i] = &SweepParameters{
+			n_samples:				uniformInt(n_samples),
+			sign_thres:				uniformFloat(sign_thres),
+			max_sign:				uniformInt(max_sign),
+			featext_probability:	uniformFloat(featext_probability),
+		}
+	}
+	return runs
+}
+
+// Counts the functions with at least one effective sign on n_samples packets sampled from splits. With
+// the pre-filter on, the functions the first of n_iterations iterations of the search skips are not counted.
+func CountEffectiveFunctions(
+	ctx context.Context,
+	splits []*Split,
+	compositions []*TCPComposition,
+	bad_functions map[int]struct{},
+	n_samples int,
+	sign_thres float64,
+	max_sign int,
+	n_iterations int,
+	seed uint64,
+	config *Config,
+) (*CountEffectiveFunctionsResult, error) {
+	functions, err := CompileCompositions(compositions)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		return nil, err
+	}
+	if config.Prefilter.Packets > 0 {
+		skipped, err := Prefilter_functions(
+			ctx,
+			columns,
+			sample_packets(
+				SeededRand(WrapRightShift(seed, n_iterations, 64), PrefilterStream),
+				splits,
+				config.Prefilter.Packets,
+			),
+			config.Prefilter.MinEntropy,
+			config.Prefilter.MaxEntropyFraction,
+			bad_functions,
+			config.Workers.Function,
+		)
+		if err != nil {
+			return nil, err
+		}
+		prefiltered := make(map[int]struct{}, len(bad_functions)+len(skipped))
+		maps.Copy(prefiltered, bad_functions)
+		maps.Copy(prefiltered, skipped)
+		bad_functions = prefiltered
+	}
+	sample := NewSplit(splits[0].time, sample_packets(SeededRand(seed, SweepStream), splits, n_samples))
+	functionResults, err := find_effective_signs(
+		ctx,
+		functions,
+		columns,
+		[]*Split{sample},
+		sign_thres,
+		max_sign,
+		Sign_scorers[config.Signs.Scorer],
+		bad_functions,
+		config.Workers.Function,
+		config.Workers.Split,
+	)
+	if err != nil {
+		return nil, err
+	}
+	effective := make(map[int]struct{})
+	for _, result := range functionResults {
+		effective[result.index] = struct{}{}
+	}
+	return &CountEffectiveFunctionsResult{sign_thres: sign_thres, n_func: len(effective)}, nil
+}
+
+// Runs the search once per entry of runs, every run generating its functions from seed. Stops when ctx is
+// cancelled, returning the runs done so far and the error of ctx. A run stopped by run_timeout keeps the
+// fingerprints found until then. With truth every run is evaluated on it.
+func Sweep(
+	ctx context.Context,
+	splits []*Split,
+	runs []*SweepParameters,
+	run_timeout time.Duration,
+	n_functions int,
+	initial_set []*InitialFunction,
+	binary_operations []BinaryFunction,
+	feature_exts []string,
+	n_iterations int,
+	n_packets int,
+	seed uint64,
+	config *Config,
+	zmap bool,
+	truth *GroundTruth,
+) ([]*HyperparametersResult, error) {
+	results := make([]*HyperparametersResult, 0, len(runs))
+	for i, run := range runs {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		log.Printf(
+			"Sweep run %d of %d: samples %d, sign threshold %.0f, max signs %d, feature extraction probability %.2f\n",
+			i + 1, len(runs), run.n_samples, run.sign_thres, run.max_sign, run.featext_probability,
+		)
+		started := time.Now()
+		result := &HyperparametersResult{
+			n_samples:				run.n_samples,
+			sign_thres:				run.sign_thres,
+			max_sign:				run.max_sign,
+			featext_probability:	run.featext_probability,
+			zmap:					zmap,
+		}
+
+		// Generated as the search generates them, to count the functions it can find signs on
+		r := SeededRand(seed, FunctionStream)
+		feature_extractions, err := SelectFeatureExtractions(feature_exts, r)
+		if err != nil {
+			return results, err
+		}
+		compositions, bad_functions, err := Generate_compositions(
+			r,
+			n_functions,
+			run.featext_probability,
+			initial_set,
+			binary_operations,
+			feature_extractions,
+		)
+		if err != nil {
+			return results, err
+		}
+		result.effective, err = CountEffectiveFunctions(
+			ctx,
+			splits,
+			compositions,
+			bad_functions,
+			run.n_samples,
+			run.sign_thres,
+			run.max_sign,
+			n_iterations,
+			seed,
+			config,
+		)
+		if err != nil {
+			return results, err
+		}
+
+		r = SeededRand(seed, FunctionStream)
+		feature_extractions, _ = SelectFeatureExtractions(feature_exts, r)
+		run_ctx, cancel := ctx, context.CancelFunc(func() {})
+		if run_timeout > 0 {
+			run_ctx, cancel = context.WithTimeout(ctx, run_timeout)
+		}
+		intersections, functionResults, compositions, search_err := Fgpt_ident_iterative(
+			run_ctx,
+			splits,
+			n_functions,
+			run.featext_probability,
+			initial_set,
+			binary_operations,
+			feature_extractions,
+			run.n_samples,
+			run.sign_thres,
+			run.max_sign,
+			n_iterations,
+			n_packets,
+			r,
+			seed,
+			config,
+			"",
+			nil,
+		)
+		cancel()
+		// A cancelled run is incomplete, so it is not compared to the others
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		result.err = search_err
+		result.fgpts = IntersectionsToFingerprints(intersections, functionResults)
+		result.compositions = compositions
+		result.signs = functionResults
+		for _, fgpt := range result.fgpts {
+			result.n_signs += len(fgpt.signs)
+		}
+		result.n_fingerprinted = countMatching(splits, matchAny(result.fgpts))
+		if truth != nil {
+			result.evaluation, err = EvaluateFingerprints(result.fgpts, splits, truth)
+			if err != nil {
+				return results, err
+			}
+		}
+		result.duration = time.Since(started)
+		log.Printf(
+			"Sweep run %d found %d fingerprints matching %d packets in %s\n",
+			i + 1, len(result.fgpts), result.n_fingerprinted, result.duration.Round(time.Second),
+		)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func countMatching(splits []*Split, f FingerprintFunc) int {
+	n := 0
+	var p Packet
+	for _, spl := range splits {
+		for j := 0; j < spl.size; j++ {
+			spl.packets.Row(j, &p)
+			if f(&p) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+var sweepColumns = []string{
+	"n_samples", "sign_thres", "max_sign", "featext_probability", "zmap", "effective_functions",
+	"fingerprints", "signs", "fingerprinted_packets", "seconds", "precision", "recall", "f1", "undiscovered", "error",
+}
+
+func formatFloat(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// One row per run in the columns of sweepColumns, evaluation columns are empty without labels
+func WriteSweepCSV(w io.Writer, results []*HyperparametersResult) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(sweepColumns); err != nil {
+		return err
+	}
+	for _, result := range results {
+		record := []string{
+			strconv.Itoa(result.n_samples),
+			formatFloat(result.sign_thres),
+			strconv.Itoa(result.max_sign),
+			formatFloat(result.featext_probability),
+			strconv.FormatBool(result.zmap),
+			strconv.Itoa(result.effective.n_func),
+			strconv.Itoa(len(result.fgpts)),
+			strconv.Itoa(result.n_signs),
+			strconv.Itoa(result.n_fingerprinted),
+			formatFloat(result.duration.Round(time.Millisecond).Seconds()),
+			"", "", "", "", "",
+		}
+		if e := result.evaluation; e != nil {
+			record[10], record[11], record[12] = formatFloat(e.precision), formatFloat(e.recall), formatFloat(e.f1)
+			record[13] = strings.Join(e.undiscovered, " ")
+		}
+		if result.err != nil {
+			record[14] = result.err.Error()
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type SweepEvaluationJSON struct {
+	Precision    float64  `json:"precision"`
+	Recall       float64  `json:"recall"`
+	F1           float64  `json:"f1"`
+	Undiscovered []string `json:"undiscovered"`
+}
+
+type SweepRunJSON struct {
+	NSamples             int                  `json:"n_samples"`
+	SignThres            float64              `json:"sign_thres"`
+	MaxSign              int                  `json:"max_sign"`
+	FeatextProbability   float64              `json:"featext_probability"`
+	Zmap                 bool                 `json:"zmap"`
+	EffectiveFunctions   int                  `json:"effective_functions"`
+	Signs                int                  `json:"signs"`
+	FingerprintedPackets int                  `json:"fingerprinted_packets"`
+	Seconds              float64              `json:"seconds"`
+	Evaluation           *SweepEvaluationJSON `json:"evaluation,omitempty"`
+	Error                string               `json:"error,omitempty"`
+	// One expression per fingerprint, as printed by discover -format expr
+	Fingerprints []string `json:"fingerprints"`
+}
+
+type SweepFileJSON struct {
+	Seed   uint64          `json:"seed"`
+	Config *Config         `json:"config"`
+	Runs   []*SweepRunJSON `json:"runs"`
+}
+
+func WriteSweepJSON(w io.Writer, results []*HyperparametersResult, seed uint64, config *Config) error {
+	file := &SweepFileJSON{Seed: seed, Config: config, Runs: make([]*SweepRunJSON, 0, len(results))}
+	for _, result := range results {
+		run := &SweepRunJSON{
+			NSamples:             result.n_samples,
+			SignThres:            result.sign_thres,
+			MaxSign:              result.max_sign,
+			FeatextProbability:   result.featext_probability,
+			Zmap:                 result.zmap,
+			EffectiveFunctions:   result.effective.n_func,
+			Signs:                result.n_signs,
+			FingerprintedPackets: result.n_fingerprinted,
+			Seconds:              result.duration.Round(time.Millisecond).Seconds(),
+			Fingerprints:         make([]string, 0, len(result.fgpts)),
+		}
+		if e := result.evaluation; e != nil {
+			run.Evaluation = &SweepEvaluationJSON{
+				Precision:    e.precision,
+				Recall:       e.recall,
+				F1:           e.f1,
+				Undiscovered: append(make([]string, 0), e.undiscovered...),
+			}
+		}
+		if result.err != nil {
+			run.Error = result.err.Error()
+		}
+		for _, fgpt := range result.fgpts {
+			run.Fingerprints = append(run.Fingerprints, SprintFingerprintExpr(fgpt, result.compositions))
+		}
+		file.Runs = append(file.Runs, run)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
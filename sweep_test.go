@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSweepGridAndRandom(t *testing.T) {
+	grid := SweepGrid([]int{1000, 2000}, []float64{250, 500, 1000}, []int{10}, []float64{0.3, 0.5})
+	if len(grid) != 12 {
+		t.Fatalf("Got %d runs, want 12", len(grid))
+	}
+	// Thresholds vary fastest, feature extraction probabilities slowest
+	if *grid[0] != (SweepParameters{1000, 250, 10, 0.3}) || *grid[4] != (SweepParameters{2000, 500, 10, 0.3}) || *grid[11] != (SweepParameters{2000, 1000, 10, 0.5}) {
+		t.Errorf("Got runs %+v, %+v and %+v", *grid[0], *grid[4], *grid[11])
+	}
+
+	draw := func() []SweepParameters {
+		runs := SweepRandom(SeededRand(1, SweepStream), 50, []int{1000, 2000}, []float64{250, 1000}, []int{5, 10}, []float64{0.3})
+		return Map[*SweepParameters, SweepParameters](runs, func(run *SweepParameters) SweepParameters { return *run })
+	}
+	runs := draw()
+	for _, run := range runs {
+		if run.n_samples < 1000 || run.n_samples > 2000 || run.sign_thres < 250 || run.sign_thres > 1000 || run.max_sign < 5 || run.max_sign > 10 || run.featext_probability != 0.3 {
+			t.Fatalf("Run %+v outside the given values", run)
+		}
+	}
+	if !slices.Equal(runs, draw()) {
+		t.Error("The same seed draws different runs")
+	}
+}
+
+// A small grid on synthetic data, with a row per run and fewer effective functions at higher thresholds
+func TestSweepSynthetic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs the search once per threshold")
+	}
+	tools := []*SyntheticTool{ZMapTool(0.05), MasscanTool(0.05), MiraiTool(0.05)}
+	data := GenerateSynthetic(SeededRand(1, PacketStream), tools, 2, 5000, 8, fixtureStart, time.Hour)
+	config := DefaultConfig()
+	config.Signs.MaxPerSample = 100
+	config.Iterations.MaxNothing = 2
+	binary_operations, err := SelectBinaryOperations([]string{"xor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thresholds := []float64{50, 500, 5000}
+	runs := SweepGrid([]int{2000}, thresholds, []int{10}, []float64{0.5})
+	results, err := Sweep(
+		context.Background(),
+		data.splits,
+		runs,
+		0,
+		300,
+		InitialSetFor(data.splits),
+		binary_operations,
+		[]string{"lbytes1", "lbytes2", "rbytes1", "rbytes2"},
+		5,
+		SplitLen(data.splits),
+		1,
+		config,
+		false,
+		data.GroundTruth(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(thresholds) {
+		t.Fatalf("Got %d results, want %d", len(results), len(thresholds))
+	}
+	for i, result := range results {
+		if result.sign_thres != thresholds[i] || result.evaluation == nil {
+			t.Fatalf("Result %d has threshold %g and evaluation %v", i, result.sign_thres, result.evaluation)
+		}
+		if i > 0 && result.effective.n_func > results[i - 1].effective.n_func {
+			t.Errorf("%d functions are effective at threshold %g, %d at %g", result.effective.n_func, result.sign_thres, results[i - 1].effective.n_func, results[i - 1].sign_thres)
+		}
+	}
+	if results[0].effective.n_func == results[len(results) - 1].effective.n_func {
+		t.Errorf("%d functions are effective at every threshold", results[0].effective.n_func)
+	}
+
+	var b bytes.Buffer
+	if err := WriteSweepCSV(&b, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(results) + 1 || !slices.Equal(rows[0], sweepColumns) {
+		t.Fatalf("Got CSV %v", rows)
+	}
+	for i, row := range rows[1:] {
+		if row[1] != formatFloat(thresholds[i]) || row[5] != strconv.Itoa(results[i].effective.n_func) || row[6] != strconv.Itoa(len(results[i].fgpts)) || row[12] == "" {
+			t.Errorf("Got CSV row %v for result %d", row, i)
+		}
+	}
+
+	b.Reset()
+	if err := WriteSweepJSON(&b, results, 1, config); err != nil {
+		t.Fatal(err)
+	}
+	var file SweepFileJSON
+	if err := json.Unmarshal(b.Bytes(), &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Runs) != len(results) || file.Seed != 1 {
+		t.Fatalf("Got %d runs of seed %d", len(file.Runs), file.Seed)
+	}
+	for i, run := range file.Runs {
+		if run.SignThres != thresholds[i] || run.EffectiveFunctions != results[i].effective.n_func || len(run.Fingerprints) != len(results[i].fgpts) || run.Evaluation == nil {
+			t.Errorf("Got JSON run %+v for result %d", run, i)
+		}
+		for _, expr := range run.Fingerprints {
+			if _, _, err := ParseFingerprint(expr); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+// Functions the pre-filter skips are left out of the count
+func TestCountEffectiveFunctionsPrefilter(t *testing.T) {
+	data := GenerateSynthetic(SeededRand(1, PacketStream), []*SyntheticTool{ZMapTool(0.05)}, 2, 5000, 8, fixtureStart, time.Hour)
+	binary_operations, err := SelectBinaryOperations([]string{"xor", "and"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := SeededRand(1, FunctionStream)
+	feature_extractions, err := SelectFeatureExtractions([]string{"lbytes1", "rbytes1", "rbitshift"}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compositions, bad_functions, err := Generate_compositions(r, 300, 0.5, InitialSetFor(data.splits), binary_operations, feature_extractions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(config *Config) int {
+		result, err := CountEffectiveFunctions(context.Background(), data.splits, compositions, bad_functions, 2000, 50, 10, 5, 1, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.n_func
+	}
+	config := DefaultConfig()
+	all := count(config)
+	// Fields with a few values, such as the TTL or MSS, have signs
+	config.Prefilter.Packets = 4096
+	config.Prefilter.MinEntropy = 4
+	prefiltered := count(config)
+	if prefiltered >= all {
+		t.Errorf("%d functions are effective, %d with the pre-filter", all, prefiltered)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Synthetic traffic
+//
+// Splits of background radiation mixed with packets of emulated scanning tools whose header
+// derivations are known, labelled per packet, to check what discover recovers.
+
+// An emulated scanning tool. apply overwrites the fields of a background packet the tool derives.
+type SyntheticTool struct {
+	name 	string
+	// Fraction of all packets sent by the tool
+	share 	float64
+	// Source addresses the tool scans from
+	sources []uint32
+	apply 	func(r *rand.Rand, p *Packet)
+}
+
+type SyntheticData struct {
+	splits 	[]*Split
+	// Per split and packet, the position in tools of the tool that sent it, or -1 for background
+	labels 	[][]int
+	tools 	[]*SyntheticTool
+}
+
+// Destination addresses lie in this /16, as seen by a telescope
+const SyntheticTelescope uint32 = 10 << 24
+
+// Background radiation: SYNs from many sources to random ports, with the TTLs and options of
+// common stacks. Windows are random as well, a handful of windows most of the background shares
+// next to the random windows of Mirai would score as signs like the header of a scanner.
+func backgroundPacket(r *rand.Rand, p *Packet) {
+	ttls := []uint8{64, 128, 255}
+	mss := []uint16{1460, 1440, 1360, 1400}
+	// MSS only, MSS SACK TS NOP WS, MSS NOP WS NOP NOP SACK
+	layouts := []uint32{0x20000000, 0x24813000, 0x21311400}
+
+	*p = Packet{}
+	p.IPId = uint16(r.Uint32())
+	p.SrcPort = uint16(1024 + r.IntN(64512))
+	p.DstPort = uint16(r.Uint32())
+	p.Seq = r.Uint32()
+	p.Window = uint16(r.Uint32())
+	p.TTL = ttls[r.IntN(len(ttls))] - uint8(r.IntN(30))
+	p.Flags = 2
+	p.MSS = mss[r.IntN(len(mss))]
+	p.OptLayout = layouts[r.IntN(len(layouts))]
+	p.IPLen = 44
+	if p.OptLayout != 0x20000000 {
+		p.IPLen = 60
+	}
+	SetIPv4Addrs(p, r.Uint32(), SyntheticTelescope | (r.Uint32() & 0xffff))
+}
+
+// SYN without options, as sent by the stateless scanners
+func bareSyn(p *Packet, ttl uint8, window uint16) {
+	p.TTL, p.Window = ttl, window
+	p.MSS, p.OptLayout, p.IPLen = 0, 0, 40
+}
+
+// ZMap sets the IP Id to 54321, scanning a single port
+func ZMapTool(share float64) *SyntheticTool {
+	return &SyntheticTool{"zmap", share, nil, func(r *rand.Rand, p *Packet) {
+		p.DstPort = 80
+		p.IPId = ZMapIPId
+		p.TTL, p.Window = 255, 65535
+		p.MSS, p.OptLayout, p.IPLen = 1460, 0x20000000, 44
+	}}
+}
+
+// Masscan derives the IP Id from the destination and its SYN cookie, scanning a few ports
+func MasscanTool(share float64) *SyntheticTool {
+	ports := []uint16{22, 80, 443, 3389, 8080}
+	return &SyntheticTool{"masscan", share, nil, func(r *rand.Rand, p *Packet) {
+		bareSyn(p, 255, 1024)
+		p.DstPort = ports[r.IntN(len(ports))]
+		p.IPId = uint16(p.DstIp ^ uint32(p.DstPort) ^ p.Seq)
+	}}
+}
+
+// Mirai uses the destination address as sequence number, scanning telnet on 23 and one in ten
+// times on 2323
+func MiraiTool(share float64) *SyntheticTool {
+	return &SyntheticTool{"mirai", share, nil, func(r *rand.Rand, p *Packet) {
+		bareSyn(p, 64, uint16(r.Uint32()))
+		p.DstPort = 23
+		if r.IntN(10) == 0 {
+			p.DstPort = 2323
+		}
+		p.Seq = p.DstIp
+	}}
+}
+
+// Key Unicornscan draws per scan, shared by the emulated scans
+const unicornscanSynKey uint32 = 0x5eed4b1d
+
+// Unicornscan sets the sequence number to its key xor the destination address and both ports, so
+// that replies can be matched without state, scanning a few ports
+func UnicornscanTool(share float64) *SyntheticTool {
+	ports := []uint16{21, 22, 80, 443}
+	return &SyntheticTool{"unicornscan", share, nil, func(r *rand.Rand, p *Packet) {
+		bareSyn(p, 64, 4096)
+		p.DstPort = ports[r.IntN(len(ports))]
+		p.Seq = unicornscanSynKey ^ p.DstIp ^ (uint32(p.DstPort) << 16 + uint32(p.SrcPort))
+	}}
+}
+
+// Setters of the packet fields a custom rule may derive, by key of the initial function reading them
+var syntheticFields = map[string]func(p *Packet, v uint64){
+	"ip_id":		func(p *Packet, v uint64) { p.IPId = uint16(v) },
+	"src_ip":		func(p *Packet, v uint64) { SetIPv4Addrs(p, uint32(v), p.DstIp) },
+	"dst_ip":		func(p *Packet, v uint64) { SetIPv4Addrs(p, p.SrcIp, uint32(v)) },
+	"src_port":		func(p *Packet, v uint64) { p.SrcPort = uint16(v) },
+	"dst_port":		func(p *Packet, v uint64) { p.DstPort = uint16(v) },
+	"seq":			func(p *Packet, v uint64) { p.Seq = uint32(v) },
+	"window":		func(p *Packet, v uint64) { p.Window = uint16(v) },
+	"ttl":			func(p *Packet, v uint64) { p.TTL = uint8(v) },
+	"ack":			func(p *Packet, v uint64) { p.Ack = uint32(v) },
+}
+
+// Nmap SYN scans use a window of 1024, a single MSS option of 1460 and a random TTL from 37 to 59
+func NmapTool(share float64) *SyntheticTool {
+	ports := []uint16{22, 80, 443, 445, 3389}
+	return &SyntheticTool{"nmap", share, nil, func(r *rand.Rand, p *Packet) {
+		p.DstPort = ports[r.IntN(len(ports))]
+		p.TTL, p.Window = uint8(37 + r.IntN(23)), 1024
+		p.MSS, p.OptLayout, p.IPLen = 1460, 0x20000000, 44
+	}}
+}
+
+// A tool setting field to the value of from xor c, truncated to the width of field, scanning a few
+// web ports
+func XorTool(name string, share float64, field string, from string, c uint64) (*SyntheticTool, error) {
+	set, ok := syntheticFields[field]
+	if !ok {
+		return nil, fmt.Errorf("Unknown field %q, a rule can set %s", field, syntheticFieldNames())
+	}
+	get := initialByKey(from)
+	if get == nil {
+		return nil, fmt.Errorf("Unknown field %q", from)
+	}
+	ports := []uint16{80, 443, 8080}
+	return &SyntheticTool{name, share, nil, func(r *rand.Rand, p *Packet) {
+		bareSyn(p, 128, 29200)
+		p.DstPort = ports[r.IntN(len(ports))]
+		set(p, get.eval(p) ^ c)
+	}}, nil
+}
+
+func syntheticFieldNames() string {
+	names := make([]string, 0, len(syntheticFields))
+	for _, init := range Initial_set {
+		if _, ok := syntheticFields[init.key]; ok {
+			names = append(names, init.key)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Parses a tool name, zmap, masscan, mirai, nmap or unicornscan, or a custom rule such as xor:ip_id=dst_port^4660
+func ParseSyntheticTool(spec string, share float64) (*SyntheticTool, error) {
+	switch spec {
+	case "zmap":
+		return ZMapTool(share), nil
+	case "masscan":
+		return MasscanTool(share), nil
+	case "mirai":
+		return MiraiTool(share), nil
+	case "nmap":
+		return NmapTool(share), nil
+	case "unicornscan":
+		return UnicornscanTool(share), nil
+	}
+	rule, ok := strings.CutPrefix(spec, "xor:")
+	if !ok {
+		return nil, fmt.Errorf("Unknown tool %q, expected zmap, masscan, mirai, nmap, unicornscan or xor:field=field^constant", spec)
+	}
+	field, expr, ok := strings.Cut(rule, "=")
+	if !ok {
+		return nil, fmt.Errorf("Rule %q has no '='", spec)
+	}
+	from, constant, has_const := strings.Cut(expr, "^")
+	var c uint64
+	if has_const {
+		var err error
+		if c, err = strconv.ParseUint(constant, 0, 64); err != nil {
+			return nil, fmt.Errorf("Rule %q: %w", spec, err)
+		}
+	}
+	return XorTool(spec, share, field, from, c)
+}
+
+// Generates n_splits splits of n_packets packets each, starting at start and slice apart. Every tool
+// scans from n_sources addresses and sends its share of the packets, the rest is background.
+func GenerateSynthetic(
+	r *rand.Rand,
+	tools []*SyntheticTool,
+	n_splits int,
+	n_packets int,
+	n_sources int,
+	start time.Time,
+	slice time.Duration,
+) *SyntheticData {
+	for _, tool := range tools {
+		tool.sources = make([]uint32, n_sources)
+		for i := range tool.sources {
+			tool.sources[i] = r.Uint32()
+		}
+	}
+	data := &SyntheticData{
+		splits:	make([]*Split, 0, n_splits),
+		labels:	make([][]int, 0, n_splits),
+		tools:	tools,
+	}
+	var p Packet
+	for i := 0; i < n_splits; i++ {
+		packets := NewPacketColumns(n_packets)
+		labels := make([]int, n_packets)
+		for j := range labels {
+			backgroundPacket(r, &p)
+			labels[j] = -1
+			x := r.Float64()
+			for k, tool := range tools {
+				if x < tool.share {
+					SetIPv4Addrs(&p, tool.sources[r.IntN(len(tool.sources))], p.DstIp)
+					tool.apply(r, &p)
+					labels[j] = k
+					break
+				}
+				x -= tool.share
+			}
+			packets.Append(&p)
+		}
+		t := start.Add(time.Duration(i) * slice).UTC().Format(time.DateTime)
+		data.splits = append(data.splits, NewSplit(t, packets))
+		data.labels = append(data.labels, labels)
+	}
+	return data
+}
+
+// Name of the tool that sent packet j of split i, or BackgroundLabel
+func (d *SyntheticData) Label(i int, j int) string {
+	if d.labels[i][j] < 0 {
+		return BackgroundLabel
+	}
+	return d.tools[d.labels[i][j]].name
+}
+
+// Writes one label per packet, in the order WriteFixture writes the packets
+func (d *SyntheticData) WriteLabels(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"time", "tool"}); err != nil {
+		return err
+	}
+	for i, spl := range d.splits {
+		for j := range d.labels[i] {
+			if err := writer.Write([]string{spl.time, d.Label(i, j)}); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
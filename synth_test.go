@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Discovery on a small generated dataset recovers every emulated tool
+func TestDiscoverSyntheticTools(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Runs the whole search")
+	}
+	tools := []*SyntheticTool{ZMapTool(0.05), MasscanTool(0.05), MiraiTool(0.05)}
+	data := GenerateSynthetic(SeededRand(1, PacketStream), tools, 2, 5000, 8, fixtureStart, time.Hour)
+
+	config := DefaultConfig()
+	// Tools send the same header values in every packet, so a sample has more signs than in real traffic
+	config.Signs.MaxPerSample = 100
+	config.Iterations.MaxNothing = 3
+	r := SeededRand(1, FunctionStream)
+	binary_operations, err := SelectBinaryOperations([]string{"xor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feature_extractions, err := SelectFeatureExtractions([]string{"lbytes1", "lbytes2", "rbytes1", "rbytes2"}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intersections, functionResults, _, err := Fgpt_ident_iterative(
+		context.Background(),
+		data.splits,
+		1000,
+		0.5,
+		InitialSetFor(data.splits),
+		binary_operations,
+		feature_extractions,
+		2000,
+		500,
+		10,
+		50,
+		SplitLen(data.splits),
+		r,
+		1,
+		config,
+		"",
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := EvaluateIntersections(intersections, functionResults, data.splits, data.GroundTruth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.undiscovered) > 0 {
+		t.Fatalf("Undiscovered tools: %v", e.undiscovered)
+	}
+	for tool, te := range e.per_tool {
+		if te.recall < 0.85 {
+			t.Errorf("Tool %s has recall %.4f", e.tools[tool], te.recall)
+		}
+	}
+	if e.precision < 0.99 {
+		t.Errorf("Got precision %.4f", e.precision)
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
 	"strings"
 )
 
@@ -41,32 +46,123 @@ func get_Window(p *Packet) interface{} {
 	return p.Window
 }
 
-// var Initial_set = []PacketFunction{(get_IPId, 1), (get_SrcIp, 1), (get_DstIp, 1), (get_SrcPort, 1), (get_DstPort, 1), (get_Seq, 1), (get_Window, 1)}
-var Initial_set = []PacketFunction{
-	get_IPId,
-	get_SrcIp,
-	get_DstIp, 
-	get_SrcPort, 
-	get_DstPort, 
-	get_Seq,
-	get_Window,
+func get_TTL(p *Packet) interface{} {
+	return p.TTL
+}
+
+func get_Flags(p *Packet) interface{} {
+	return p.Flags
+}
+
+func get_Ack(p *Packet) interface{} {
+	return p.Ack
+}
+
+func get_IPLen(p *Packet) interface{} {
+	return p.IPLen
+}
+
+func get_MSS(p *Packet) interface{} {
+	return p.MSS
+}
+
+func get_OptLayout(p *Packet) interface{} {
+	return p.OptLayout
+}
+
+// IPv6 addresses as two 64-bit halves, IPv4 packets give their IPv4-mapped address
+func get_SrcIp6Hi(p *Packet) interface{} {
+	return binary.BigEndian.Uint64(p.SrcIp6[:8])
+}
+
+func get_SrcIp6Lo(p *Packet) interface{} {
+	return binary.BigEndian.Uint64(p.SrcIp6[8:])
+}
+
+func get_DstIp6Hi(p *Packet) interface{} {
+	return binary.BigEndian.Uint64(p.DstIp6[:8])
+}
+
+func get_DstIp6Lo(p *Packet) interface{} {
+	return binary.BigEndian.Uint64(p.DstIp6[8:])
+}
+
+// Initial function with the key used in serialized fingerprints, the name used in its TCPComposition,
+// the width in bits of the value it returns and its typed and column-wise counterparts
+type InitialFunction struct {
+	key 	string
+	name 	string
+	f 		PacketFunction
+	width 	int
+	eval 	TypedFunction
+	columns 	ColumnFunction
+}
+
+var Initial_set = []*InitialFunction{
+	{"ip_id", "Get IP Id", get_IPId, 16, eval_IPId, columns_IPId},
+	{"src_ip", "Get Src IP", get_SrcIp, 32, eval_SrcIp, columns_SrcIp},
+	{"dst_ip", "Get Dst IP", get_DstIp, 32, eval_DstIp, columns_DstIp},
+	{"src_port", "Get Src Port", get_SrcPort, 16, eval_SrcPort, columns_SrcPort},
+	{"dst_port", "Get Dst Port", get_DstPort, 16, eval_DstPort, columns_DstPort},
+	{"seq", "Get Seq", get_Seq, 32, eval_Seq, columns_Seq},
+	{"window", "Get Window", get_Window, 16, eval_Window, columns_Window},
+	{"ttl", "Get TTL", get_TTL, 8, eval_TTL, columns_TTL},
+	{"tcp_flags", "Get TCP Flags", get_Flags, 8, eval_Flags, columns_Flags},
+	{"ack", "Get Ack", get_Ack, 32, eval_Ack, columns_Ack},
+	{"ip_len", "Get IP Length", get_IPLen, 16, eval_IPLen, columns_IPLen},
+	{"mss", "Get MSS", get_MSS, 16, eval_MSS, columns_MSS},
+	{"opt_layout", "Get Option Layout", get_OptLayout, 32, eval_OptLayout, columns_OptLayout},
+	{"src_ip6_hi", "Get Src IPv6 Hi", get_SrcIp6Hi, 64, eval_SrcIp6Hi, columns_SrcIp6Hi},
+	{"src_ip6_lo", "Get Src IPv6 Lo", get_SrcIp6Lo, 64, eval_SrcIp6Lo, columns_SrcIp6Lo},
+	{"dst_ip6_hi", "Get Dst IPv6 Hi", get_DstIp6Hi, 64, eval_DstIp6Hi, columns_DstIp6Hi},
+	{"dst_ip6_lo", "Get Dst IPv6 Lo", get_DstIp6Lo, 64, eval_DstIp6Lo, columns_DstIp6Lo},
+}
+
+// Initial_set without the IPv6 address halves if no packet of splits is IPv6, as they only give the
+// IPv4-mapped addresses then, a constant high half and a low half repeating src_ip or dst_ip
+func InitialSetFor(splits []*Split) []*InitialFunction {
+	for _, spl := range splits {
+		if slices.Contains(spl.packets.IPv6, true) {
+			return Initial_set
+		}
+	}
+	log.Printf("No IPv6 packets, functions are generated without the IPv6 address halves\n")
+	return Filter[*InitialFunction](Initial_set, func(init *InitialFunction) bool {
+		return !strings.Contains(init.key, "_ip6_")
+	})
 }
 
 // Binary operations
 
-func checkType(x interface{}) (uint8, bool, uint16, bool, uint32, bool) {
+func checkType(x interface{}) (uint8, bool, uint16, bool, uint32, bool, uint64, bool) {
 	switch x.(type) {
 	case uint8:
-		return uint8(x.(uint8)), true, uint16(0), false, uint32(0), false
+		return uint8(x.(uint8)), true, uint16(0), false, uint32(0), false, uint64(0), false
 	case uint16:
-		return uint8(0), false, uint16(x.(uint16)), true, uint32(0), false
+		return uint8(0), false, uint16(x.(uint16)), true, uint32(0), false, uint64(0), false
 	case uint32:
-		return uint8(0), false, uint16(0), false, uint32(x.(uint32)), true
+		return uint8(0), false, uint16(0), false, uint32(x.(uint32)), true, uint64(0), false
+	case uint64:
+		return uint8(0), false, uint16(0), false, uint32(0), false, uint64(x.(uint64)), true
 	default:
 		panic("Unsupported type")
 	}
 }
 
+// Value of x widened to uint64, with its original width in bits
+func widenUint(x interface{}) (uint64, int) {
+	x8, ok8, x16, ok16, x32, ok32, x64, _ := checkType(x)
+	if ok8 {
+		return uint64(x8), 8
+	} else if ok16 {
+		return uint64(x16), 16
+	} else if ok32 {
+		return uint64(x32), 32
+	} else {
+		return x64, 64
+	}
+}
+
 func falsePairUint8() Pair[uint8, uint8] {
 	return Pair[uint8, uint8]{a: 0, b: 0}
 }
@@ -79,35 +175,23 @@ func falsePairUint32() Pair[uint32, uint32] {
 	return Pair[uint32, uint32]{a: 0, b: 0}
 }
 
-func liftUints(x interface{}, y interface{}) (Pair[uint8, uint8], bool, Pair[uint16, uint16], bool, Pair[uint32, uint32], bool) {
-	x8, x_ok8, x16, x_ok16, x32, x_ok32 := checkType(x)
-	y8, y_ok8, y16, y_ok16, y32, _ := checkType(y)
-	if x_ok32 {
-		if y_ok8 {
-			return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: x32, b: uint32(y8)}, true
-		} else if y_ok16 {
-			return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: x32, b: uint32(y16)}, true
-		} else {
-			return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: x32, b: y32}, true
-		}
-	} else if x_ok16 {
-		if y_ok8 {
-			return falsePairUint8(), false, Pair[uint16, uint16]{a: x16, b: uint16(y8)}, true, falsePairUint32(), false
-		} else if y_ok16 {
-			return falsePairUint8(), false, Pair[uint16, uint16]{a: x16, b: y16}, true, falsePairUint32(), false
-		} else {
-			return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: uint32(x16), b: y32}, true
-		}
-	} else if x_ok8 {
-		if y_ok8 {	
-			return Pair[uint8, uint8]{a: x8, b: y8}, true, falsePairUint16(), false, falsePairUint32(), false
-		} else if y_ok16 {
-			return falsePairUint8(), false, Pair[uint16, uint16]{a: uint16(x8), b: y16}, true, falsePairUint32(), false
-		} else {
-			return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: uint32(x8), b: y32}, true
-		}
-	} else {
-		panic("Unsupported type")
+func falsePairUint64() Pair[uint64, uint64] {
+	return Pair[uint64, uint64]{a: 0, b: 0}
+}
+
+// Lifts x and y to the wider of both types
+func liftUints(x interface{}, y interface{}) (Pair[uint8, uint8], bool, Pair[uint16, uint16], bool, Pair[uint32, uint32], bool, Pair[uint64, uint64], bool) {
+	vx, wx := widenUint(x)
+	vy, wy := widenUint(y)
+	switch binaryWidth(wx, wy) {
+	case 8:
+		return Pair[uint8, uint8]{a: uint8(vx), b: uint8(vy)}, true, falsePairUint16(), false, falsePairUint32(), false, falsePairUint64(), false
+	case 16:
+		return falsePairUint8(), false, Pair[uint16, uint16]{a: uint16(vx), b: uint16(vy)}, true, falsePairUint32(), false, falsePairUint64(), false
+	case 32:
+		return falsePairUint8(), false, falsePairUint16(), false, Pair[uint32, uint32]{a: uint32(vx), b: uint32(vy)}, true, falsePairUint64(), false
+	default:
+		return falsePairUint8(), false, falsePairUint16(), false, falsePairUint32(), false, Pair[uint64, uint64]{a: vx, b: vy}, true
 	}
 }
 
@@ -115,13 +199,15 @@ func and_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFunct
 	return func(p *Packet) interface{} {
 		x := (fa)(p)
 		y := (fb)(p)
-		p8, p8_ok, p16, p16_ok, p32, _ := liftUints(x, y)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
 		if p8_ok {
 			return (p8.a & p8.b)
 		} else if p16_ok {
 			return (p16.a & p16.b)
-		} else {
+		} else if p32_ok {
 			return (p32.a & p32.b)
+		} else {
+			return (p64.a & p64.b)
 		}
 	}, (1 + count_a + count_b), &TCPComposition{"and", []*TCPComposition{comp_a, comp_b}}
 }
@@ -130,13 +216,15 @@ func or_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFuncti
 	return func(p *Packet) interface{} {
 		x := (fa)(p)
 		y := (fb)(p)
-		p8, p8_ok, p16, p16_ok, p32, _ := liftUints(x, y)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
 		if p8_ok {
 			return (p8.a | p8.b)
 		} else if p16_ok {
 			return (p16.a | p16.b)
-		} else {
+		} else if p32_ok {
 			return (p32.a | p32.b)
+		} else {
+			return (p64.a | p64.b)
 		}
 	}, (1 + count_a + count_b), &TCPComposition{"or", []*TCPComposition{comp_a, comp_b}}
 }
@@ -145,36 +233,124 @@ func xor_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFunct
 	return func(p *Packet) interface{} {
 		x := (fa)(p)
 		y := (fb)(p)
-		p8, p8_ok, p16, p16_ok, p32, _ := liftUints(x, y)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
 		if p8_ok {
 			return (p8.a ^ p8.b)
 		} else if p16_ok {
 			return (p16.a ^ p16.b)
-		} else {
+		} else if p32_ok {
 			return (p32.a ^ p32.b)
+		} else {
+			return (p64.a ^ p64.b)
 		}
 	}, (1 + count_a + count_b), &TCPComposition{"xor", []*TCPComposition{comp_a, comp_b}}
 }
 
+// Arithmetic operations wrap around at the lifted width, like the bitwise ones
+
+func add_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFunction, count_b int, comp_b *TCPComposition) (PacketFunction, int, *TCPComposition) {
+	return func(p *Packet) interface{} {
+		x := (fa)(p)
+		y := (fb)(p)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
+		if p8_ok {
+			return (p8.a + p8.b)
+		} else if p16_ok {
+			return (p16.a + p16.b)
+		} else if p32_ok {
+			return (p32.a + p32.b)
+		} else {
+			return (p64.a + p64.b)
+		}
+	}, (1 + count_a + count_b), &TCPComposition{"add", []*TCPComposition{comp_a, comp_b}}
+}
+
+func sub_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFunction, count_b int, comp_b *TCPComposition) (PacketFunction, int, *TCPComposition) {
+	return func(p *Packet) interface{} {
+		x := (fa)(p)
+		y := (fb)(p)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
+		if p8_ok {
+			return (p8.a - p8.b)
+		} else if p16_ok {
+			return (p16.a - p16.b)
+		} else if p32_ok {
+			return (p32.a - p32.b)
+		} else {
+			return (p64.a - p64.b)
+		}
+	}, (1 + count_a + count_b), &TCPComposition{"sub", []*TCPComposition{comp_a, comp_b}}
+}
+
+func mul_(fa PacketFunction, count_a int, comp_a *TCPComposition, fb PacketFunction, count_b int, comp_b *TCPComposition) (PacketFunction, int, *TCPComposition) {
+	return func(p *Packet) interface{} {
+		x := (fa)(p)
+		y := (fb)(p)
+		p8, p8_ok, p16, p16_ok, p32, p32_ok, p64, _ := liftUints(x, y)
+		if p8_ok {
+			return (p8.a * p8.b)
+		} else if p16_ok {
+			return (p16.a * p16.b)
+		} else if p32_ok {
+			return (p32.a * p32.b)
+		} else {
+			return (p64.a * p64.b)
+		}
+	}, (1 + count_a + count_b), &TCPComposition{"mul", []*TCPComposition{comp_a, comp_b}}
+}
+
 var Binary_operations = []BinaryFunction{
 	// and_,
 	// or_,
 	xor_,
 	}
 
+// All binary operations by TCPComposition name, including disabled ones
+var Binary_operations_by_name = map[string]BinaryFunction{
+	"and":	and_,
+	"or":	or_,
+	"xor":	xor_,
+	"add":	add_,
+	"sub":	sub_,
+	"mul":	mul_,
+}
+
+// Binary operations to generate functions from, by name
+func SelectBinaryOperations(names []string) ([]BinaryFunction, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No binary operations selected")
+	}
+	ops := make([]BinaryFunction, 0, len(names))
+	for _, name := range names {
+		op, ok := Binary_operations_by_name[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown binary operation %q", name)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// Result width of a binary operation, following liftUints
+func binaryWidth(width_a int, width_b int) int {
+	return Max(width_a, width_b)
+}
+
 // Feature extractions
 
-func lnbitshift_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction, int, *TCPComposition) {
+func lnbitshift_(n int) FeatureFunction {
 	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
 		return func(p *Packet) interface{} {
 			bin := (f)(p)
-			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok := checkType(bin)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, bin64_ok := checkType(bin)
 			if bin8_ok {
 				return (bin8 << n)
 			} else if bin16_ok {
 				return (bin16 << n)
 			} else if bin32_ok {
 				return (bin32 << n)
+			} else if bin64_ok {
+				return (bin64 << n)
 			} else {
 				panic("Unsupported type")
 			}
@@ -182,17 +358,19 @@ func lnbitshift_(n int) func(PacketFunction, int, *TCPComposition) (PacketFuncti
 	}
 }
 
-func rnbitshift_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction, int, *TCPComposition) {
+func rnbitshift_(n int) FeatureFunction {
 	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
 		return func(p *Packet) interface{} {
 			bin := (f)(p)
-			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok := checkType(bin)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, bin64_ok := checkType(bin)
 			if bin8_ok {
 				return (bin8 >> n)
 			} else if bin16_ok {
 				return (bin16 >> n)
 			} else if bin32_ok {
 				return (bin32 >> n)
+			} else if bin64_ok {
+				return (bin64 >> n)
 			} else {
 				panic("Unsupported type")
 			}
@@ -211,6 +389,10 @@ func getBytes(bin interface{}) ([]byte, int) {
 		bytes := make([]byte, 4)
 		binary.BigEndian.PutUint32(bytes, a)
 		return bytes, 4
+	} else if a, ok := bin.(uint64); ok {
+		bytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(bytes, a)
+		return bytes, 8
 	} else {
 		panic("Unsupported type")
 	}
@@ -224,12 +406,14 @@ func getUintFromBytes(bytes []byte, n int) interface{} {
 		return binary.BigEndian.Uint16(bytes)
 	case 4:
 		return binary.BigEndian.Uint32(bytes)
+	case 8:
+		return binary.BigEndian.Uint64(bytes)
 	default:
 		panic("Unsupported byte length")
 	}
 } 
 
-func lnbyte_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction, int, *TCPComposition) {
+func lnbyte_(n int) FeatureFunction {
 	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
 		return func(p *Packet) interface{} {
 			bin := (f)(p)
@@ -240,7 +424,7 @@ func lnbyte_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction,
 	}
 }
 
-func rnbyte_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction, int, *TCPComposition) {
+func rnbyte_(n int) FeatureFunction {
 	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
 		return func(p *Packet) interface{} {
 			bin := (f)(p)
@@ -254,6 +438,81 @@ func rnbyte_(n int) func(PacketFunction, int, *TCPComposition) (PacketFunction,
 	}
 }
 
+// Rotates within the width of the value, so rotl: 7 of a uint16 moves the top 7 bits to the bottom
+func rotl_(k int) FeatureFunction {
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		return func(p *Packet) interface{} {
+			bin := (f)(p)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, _ := checkType(bin)
+			if bin8_ok {
+				return bits.RotateLeft8(bin8, k)
+			} else if bin16_ok {
+				return bits.RotateLeft16(bin16, k)
+			} else if bin32_ok {
+				return bits.RotateLeft32(bin32, k)
+			} else {
+				return bits.RotateLeft64(bin64, k)
+			}
+		}, (count + 1), &TCPComposition{(fmt.Sprintf("rotl: %d", k)), []*TCPComposition{comp}}
+	}
+}
+
+func rotr_(k int) FeatureFunction {
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		return func(p *Packet) interface{} {
+			bin := (f)(p)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, _ := checkType(bin)
+			if bin8_ok {
+				return bits.RotateLeft8(bin8, -k)
+			} else if bin16_ok {
+				return bits.RotateLeft16(bin16, -k)
+			} else if bin32_ok {
+				return bits.RotateLeft32(bin32, -k)
+			} else {
+				return bits.RotateLeft64(bin64, -k)
+			}
+		}, (count + 1), &TCPComposition{(fmt.Sprintf("rotr: %d", k)), []*TCPComposition{comp}}
+	}
+}
+
+// And with a constant, truncated to the width of the value
+func mask_(c uint64) FeatureFunction {
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		return func(p *Packet) interface{} {
+			bin := (f)(p)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, _ := checkType(bin)
+			if bin8_ok {
+				return bin8 & uint8(c)
+			} else if bin16_ok {
+				return bin16 & uint16(c)
+			} else if bin32_ok {
+				return bin32 & uint32(c)
+			} else {
+				return bin64 & c
+			}
+		}, (count + 1), &TCPComposition{(fmt.Sprintf("mask: %d", c)), []*TCPComposition{comp}}
+	}
+}
+
+// Xor with a constant, truncated to the width of the value
+func xorc_(c uint64) FeatureFunction {
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		return func(p *Packet) interface{} {
+			bin := (f)(p)
+			bin8, bin8_ok, bin16, bin16_ok, bin32, bin32_ok, bin64, _ := checkType(bin)
+			if bin8_ok {
+				return bin8 ^ uint8(c)
+			} else if bin16_ok {
+				return bin16 ^ uint16(c)
+			} else if bin32_ok {
+				return bin32 ^ uint32(c)
+			} else {
+				return bin64 ^ c
+			}
+		}, (count + 1), &TCPComposition{(fmt.Sprintf("xorc: %d", c)), []*TCPComposition{comp}}
+	}
+}
+
 var Feature_extractions = []FeatureFunction{
 	lnbyte_(1),
 	lnbyte_(2),
@@ -261,12 +520,183 @@ var Feature_extractions = []FeatureFunction{
 	rnbyte_(2),
 }
 
+// Result width of feature extraction op with parameter n on a value of width bits,
+// or an error if n is not valid for it
+func featureWidth(op string, n uint64, width int) (int, error) {
+	switch op {
+	case "lbytes", "rbytes":
+		n_bytes := width / 8
+		if n < uint64(n_bytes) {
+			n_bytes = int(n)
+		}
+		if n_bytes != 1 && n_bytes != 2 && n_bytes != 4 && n_bytes != 8 {
+			return 0, fmt.Errorf("%s %d of a %d-bit value gives %d bytes, only 1, 2, 4 or 8 are supported", op, n, width, n_bytes)
+		}
+		return n_bytes * 8, nil
+	case "lbitshift", "rbitshift", "rotl", "rotr":
+		if n >= uint64(width) {
+			return 0, fmt.Errorf("%s %d exceeds the %d-bit value", op, n, width)
+		}
+		return width, nil
+	case "mask", "xorc":
+		if width < 64 && n >= 1<<width {
+			return 0, fmt.Errorf("%s constant %#x does not fit in the %d-bit value", op, n, width)
+		}
+		return width, nil
+	default:
+		return 0, fmt.Errorf("Unknown feature extraction %q", op)
+	}
+}
+
+// Constructor of a feature extraction from its parameter
+type FeatureConstructor func(uint64) FeatureFunction
+
+// Constructors of all feature extractions by TCPComposition name, which is formatted as "name: n"
+var Feature_constructors = map[string]FeatureConstructor{
+	"lbytes":		func(n uint64) FeatureFunction { return lnbyte_(int(n)) },
+	"rbytes":		func(n uint64) FeatureFunction { return rnbyte_(int(n)) },
+	"lbitshift":	func(n uint64) FeatureFunction { return lnbitshift_(int(n)) },
+	"rbitshift":	func(n uint64) FeatureFunction { return rnbitshift_(int(n)) },
+	"rotl":			func(n uint64) FeatureFunction { return rotl_(int(n)) },
+	"rotr":			func(n uint64) FeatureFunction { return rotr_(int(n)) },
+	"mask":			mask_,
+	"xorc":			xorc_,
+}
+
+// Feature extractions whose parameter is a constant rather than a count
+var Constant_features = map[string]bool{
+	"mask":	true,
+	"xorc":	true,
+}
+
+// Draws a parameter for feature extraction op on a value of width bits, that featureWidth accepts
+func sampleFeatureParam(r *rand.Rand, op string, width int) uint64 {
+	switch op {
+	case "lbytes", "rbytes":
+		// Only counts that actually drop bytes
+		n_bytes := []uint64{1, 2, 4}
+		n := 1
+		for n < len(n_bytes) && int(n_bytes[n]) * 8 < width {
+			n++
+		}
+		return n_bytes[r.IntN(n)]
+	case "lbitshift", "rbitshift", "rotl", "rotr":
+		if width <= 1 {
+			return 0
+		}
+		return uint64(1 + r.IntN(width - 1))
+	case "mask":
+		// A contiguous run of bits, such as 0xffff or 0xff00
+		lo := r.IntN(width)
+		length := 1 + r.IntN(width - lo)
+		if length == 64 {
+			return ^uint64(0)
+		}
+		return ((uint64(1) << length) - 1) << lo
+	case "xorc":
+		c := r.Uint64()
+		if width < 64 {
+			c &= (uint64(1) << width) - 1
+		}
+		return c
+	default:
+		panic("Unknown feature extraction")
+	}
+}
+
+// Feature extraction that samples its parameter from r for every function it is applied to,
+// based on the width of that function
+func sampled_(op string, r *rand.Rand) FeatureFunction {
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		width, err := CompositionWidth(comp)
+		if err != nil {
+			panic(err)
+		}
+		return Feature_constructors[op](sampleFeatureParam(r, op, width))(f, count, comp)
+	}
+}
+
+// Feature extraction with a fixed parameter. A function the parameter does not fit, such as a 16-bit one
+// for rotl20, is returned unchanged, and DeduplicateFunctions merges it with the original.
+func fixed_(op string, n uint64) FeatureFunction {
+	feat_ext := Feature_constructors[op](n)
+	return func(f PacketFunction, count int, comp *TCPComposition) (PacketFunction, int, *TCPComposition) {
+		width, err := CompositionWidth(comp)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := featureWidth(op, n, width); err != nil {
+			return f, count, comp
+		}
+		return feat_ext(f, count, comp)
+	}
+}
+
+// Feature extractions to generate functions from, by name. A name with a parameter suffix,
+// as in lbytes2, always uses that parameter on the functions it fits; a bare name, as in rotl,
+// samples it from r.
+func SelectFeatureExtractions(names []string, r *rand.Rand) ([]FeatureFunction, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No feature extractions selected")
+	}
+	exts := make([]FeatureFunction, 0, len(names))
+	for _, name := range names {
+		if _, ok := Feature_constructors[name]; ok {
+			exts = append(exts, sampled_(name, r))
+			continue
+		}
+		op, n, ok := splitSuffix(name)
+		if _, known := Feature_constructors[op]; !ok || !known {
+			return nil, fmt.Errorf("Unknown feature extraction %q", name)
+		}
+		// Fits no function if it does not fit a 64-bit one
+		if _, err := featureWidth(op, n, 64); err != nil {
+			return nil, err
+		}
+		exts = append(exts, fixed_(op, n))
+	}
+	return exts, nil
+}
+
+// Width in bits of the values returned by the function comp describes
+func CompositionWidth(comp *TCPComposition) (int, error) {
+	switch len(comp.comp) {
+	case 0:
+		init := initialByName(comp.name)
+		if init == nil {
+			return 0, fmt.Errorf("Unknown initial function %q", comp.name)
+		}
+		return init.width, nil
+	case 1:
+		op, n, ok := parseFeatureName(comp.name)
+		if !ok {
+			return 0, fmt.Errorf("Unknown feature extraction %q", comp.name)
+		}
+		width, err := CompositionWidth(comp.comp[0])
+		if err != nil {
+			return 0, err
+		}
+		return featureWidth(op, n, width)
+	default:
+		width_a, err := CompositionWidth(comp.comp[0])
+		if err != nil {
+			return 0, err
+		}
+		width_b, err := CompositionWidth(comp.comp[1])
+		if err != nil {
+			return 0, err
+		}
+		return binaryWidth(width_a, width_b), nil
+	}
+}
+
 func PrintFingerprints(fingerprints []*Fingerprint, compositions []*TCPComposition) {
 	for i, fingerprint := range fingerprints {
 		fmt.Printf("%s\n", SprintFingerprint(fingerprint, i, compositions))
 	}
 }
 
+// Signs as trees, then the fingerprint as an expression that -expr accepts
 func SprintFingerprint(fgpt *Fingerprint, i int, compositions []*TCPComposition) string {
 	init := ""
 	init += fmt.Sprintf("Fingerprint %d:\n", i)
@@ -277,6 +707,7 @@ func SprintFingerprint(fgpt *Fingerprint, i int, compositions []*TCPComposition)
 	) {
 		init += s
 	}
+	init += fmt.Sprintf("Expr: %s\n", SprintFingerprintExpr(fgpt, compositions))
 	return init
 }
 
@@ -290,6 +721,8 @@ func SprintSigns(signs []*Sign, f_indices []int, compositions []*TCPComposition)
 	return
 }
 
+// Indented tree of comp, which stays readable for deep compositions. TCPExpr prints comp in the
+// expression syntax instead.
 func TCPString(comp *TCPComposition, depth int) (ret string) {
 	comp_ := *comp 
 	if len(comp_.comp) != 0 {
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// Packets with every field drawn from r
+func RandomPackets(r *rand.Rand, n int) []*Packet {
+	packets := make([]*Packet, n)
+	for i := range packets {
+		p := &Packet{
+			IPId:		uint16(r.Uint32()),
+			SrcPort:	uint16(r.Uint32()),
+			DstPort:	uint16(r.Uint32()),
+			Seq:		r.Uint32(),
+			Window:		uint16(r.Uint32()),
+			TTL:		uint8(r.Uint32()),
+			Flags:		uint8(r.Uint32()),
+			Ack:		r.Uint32(),
+			IPLen:		uint16(r.Uint32()),
+			MSS:		uint16(r.Uint32()),
+			OptLayout:	r.Uint32(),
+		}
+		// A quarter IPv6, so the 64-bit functions see varying values
+		if r.IntN(4) == 0 {
+			var src, dst [16]byte
+			binary.BigEndian.PutUint64(src[:8], r.Uint64())
+			binary.BigEndian.PutUint64(src[8:], r.Uint64())
+			binary.BigEndian.PutUint64(dst[:8], r.Uint64())
+			binary.BigEndian.PutUint64(dst[8:], r.Uint64())
+			SetIPv6Addrs(p, src, dst)
+		} else {
+			SetIPv4Addrs(p, r.Uint32(), r.Uint32())
+		}
+		packets[i] = p
+	}
+	return packets
+}
+
+// Functions generated from every binary operation and feature extraction, with their closures,
+// typed and column-wise versions
+func generateBenchFunctions(tb testing.TB, n int) ([]PacketFunction, []TypedFunction, []ColumnFunction) {
+	tb.Helper()
+	binary_operations, err := SelectBinaryOperations(strings.Split("and,or,xor,add,sub,mul", ","))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r := SeededRand(1, FunctionStream)
+	feature_extractions, err := SelectFeatureExtractions(strings.Split("lbytes,rbytes,lbitshift,rbitshift,rotl,rotr,mask,xorc", ","), r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	functions, _, compositions := Generate_functions(r, n, 0.5, Initial_set, binary_operations, feature_extractions)
+	typed, err := CompileCompositions(compositions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	columns, err := CompileColumnFunctions(compositions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return functions, typed, columns
+}
+
+func TestTypedFunctionsMatchClosures(t *testing.T) {
+	functions, typed, _ := generateBenchFunctions(t, 1000)
+	for _, p := range RandomPackets(SeededRand(1, PacketStream), 2000) {
+		for i, f := range functions {
+			if want, got := LiftInt(f(p)), int(typed[i](p)); got != want {
+				t.Fatalf("Function %d: typed gives %d, closure %d", i, got, want)
+			}
+		}
+	}
+}
+
+func TestColumnFunctionsMatchTyped(t *testing.T) {
+	_, typed, columns := generateBenchFunctions(t, 1000)
+	// Not a multiple of ColumnBlock, so the last block is partial
+	packets := RandomPackets(SeededRand(1, PacketStream), 2 * ColumnBlock + 17)
+	cols := PacketsToColumns(packets)
+	for i, f := range columns {
+		EvalColumns(f, cols, func(start int, values []uint64) bool {
+			for j, v := range values {
+				if want := typed[i](packets[start + j]); v != want {
+					t.Fatalf("Function %d, packet %d: column gives %d, typed %d", i, start + j, v, want)
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestInitialSetForIPv4Splits(t *testing.T) {
+	packets := NewPacketColumns(2)
+	var p Packet
+	SetIPv4Addrs(&p, 1, 2)
+	packets.Append(&p)
+	splits := []*Split{NewSplit("a", packets), NewSplit("b", NewPacketColumns(0))}
+	initial_set := InitialSetFor(splits)
+	if len(initial_set) != len(Initial_set) - 4 {
+		t.Fatalf("Got %d initial functions for IPv4 packets, want %d", len(initial_set), len(Initial_set) - 4)
+	}
+	for _, init := range initial_set {
+		if init.width == 64 {
+			t.Fatalf("Got %s for IPv4 packets", init.key)
+		}
+	}
+
+	SetIPv6Addrs(&p, [16]byte{0x20, 0x01}, [16]byte{0x20, 0x01, 15: 1})
+	packets.Append(&p)
+	splits[0] = NewSplit("a", packets)
+	if got := InitialSetFor(splits); len(got) != len(Initial_set) {
+		t.Fatalf("Got %d initial functions with an IPv6 packet, want all %d", len(got), len(Initial_set))
+	}
+}
+
+// Every op evaluates all functions on the next packet, as Split_worker and FilterPacketsWorker do
+func BenchmarkClosures(b *testing.B) {
+	functions, _, _ := generateBenchFunctions(b, 1000)
+	packets := RandomPackets(SeededRand(1, PacketStream), 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	sum := 0
+	for i := 0; i < b.N; i++ {
+		p := packets[i % len(packets)]
+		for _, f := range functions {
+			sum += LiftInt(f(p))
+		}
+	}
+	benchSink = sum
+}
+
+func BenchmarkTyped(b *testing.B) {
+	_, typed, _ := generateBenchFunctions(b, 1000)
+	packets := RandomPackets(SeededRand(1, PacketStream), 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	sum := 0
+	for i := 0; i < b.N; i++ {
+		p := packets[i % len(packets)]
+		for _, f := range typed {
+			sum += int(f(p))
+		}
+	}
+	benchSink = sum
+}
+
+// Ops are packets as in the other benchmarks, evaluated a block of rows per function as Split_worker does
+func BenchmarkColumns(b *testing.B) {
+	_, _, columns := generateBenchFunctions(b, 1000)
+	cols := PacketsToColumns(RandomPackets(SeededRand(1, PacketStream), 10000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	var block [ColumnBlock]uint64
+	sum := 0
+	for done := 0; done < b.N; {
+		start := done % cols.Len()
+		values := block[:Min(Min(ColumnBlock, cols.Len() - start), b.N - done)]
+		for _, f := range columns {
+			f(cols, start, values)
+			for _, v := range values {
+				sum += int(v)
+			}
+		}
+		done += len(values)
+	}
+	benchSink = sum
+}
+
+// Keeps the compiler from dropping benchmarked evaluations
+var benchSink int
@@ -3,7 +3,8 @@ package main
 import (
 	"sync"
 	"context"
-    "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"net/netip"
+	"time"
 )
 
 type Packet struct {
@@ -14,10 +15,23 @@ type Packet struct {
     DstPort uint16
     Seq 	uint32
     Window 	uint16
+    TTL 	uint8
+    Flags 	uint8
+    Ack 	uint32
+    IPLen 	uint16
+    MSS 	uint16
+    // Kinds of the first 8 TCP options, one nibble each starting at the most significant,
+    // kinds above 14 are stored as 15
+    OptLayout 	uint32
+    // For IPv6 packets SrcIp and DstIp hold the lowest 32 bits of the address,
+    // for IPv4 packets SrcIp6 and DstIp6 hold the IPv4-mapped address
+    IPv6 	bool
+    SrcIp6 	[16]byte
+    DstIp6 	[16]byte
 }
 
 type Split struct {
-	packets []*Packet
+	packets *PacketColumns
 	size 	int
 	time 	string
 }
@@ -30,7 +44,7 @@ type PacketIndex struct {
 type Intersection struct {
 	idxs 	[]int
 	f_idxs	[]int
-	packets []*PacketIndex
+	packets *PacketSet
 	size 	int 
 }
 
@@ -40,7 +54,7 @@ type Pair[T, U any] struct {
 }
 
 type Sign struct {
-	f PacketFunction
+	f TypedFunction
 	b int
 }
 
@@ -55,11 +69,14 @@ type TCPComposition struct {
 }
 
 type FunctionJob struct {
-	function 	PacketFunction
+	ctx 		context.Context
+	function 	TypedFunction
+	columns 	ColumnFunction
 	index 		int
 	splits 		*[]*Split
 	sign_thres 	float64
 	max_sign 	int
+	scorer 		SignScorer
 	wg 			*sync.WaitGroup
 }
 
@@ -69,7 +86,8 @@ type FunctionResult struct {
 }
 
 type SplitJob struct {
-	function 	PacketFunction
+	ctx 		context.Context
+	function 	ColumnFunction
 	split 		*Split
 	wg			*sync.WaitGroup
 }
@@ -80,8 +98,10 @@ type SplitResult struct {
 }
 
 type DatabaseJob struct {
-	ctx 		*context.Context 
-	conn 		*driver.Conn 
+	ctx 		context.Context 
+	conn 		PacketSource
+	table 		*PacketTable
+	idx 		int
 	time 		string	
 	limit 		bool
 	n_limit 	int
@@ -89,26 +109,75 @@ type DatabaseJob struct {
 	wg 			*sync.WaitGroup
 }
 
+type DatabaseResult struct {
+	idx 	int
+	split 	*Split
+	err 	error
+}
+
 type FilterPacketsJob struct {
+	ctx 		context.Context
 	idx 		int 
 	f_result	*FunctionResult
+	columns 	ColumnFunction
 	split_idx 	int 
-	packets 	[]*Packet
+	packets 	*PacketColumns
 	wg 			*sync.WaitGroup
 }
 
 type FilterPacketsResult struct {
-	idx 	int 
-	n_ports int
-	f_idx 	int
-	packets []*PacketIndex
+	idx 		int 
+	n_ports 	int
+	f_idx 		int
+	split_idx 	int
+	packets 	*Bitmap
 }
 
 type IntersectionJob struct {
+	ctx 		context.Context
+	anchor 		int
 	xs 			[]*Intersection
 	min_overlap float64
+	max_sets 	int
+	wg 			*sync.WaitGroup
+}
+
+type IntersectionResult struct {
+	anchor 			int
+	intersections 	[]*Intersection
+	err 			error
+}
+
+type EntropyJob struct {
+	ctx 		context.Context
+	index 		int
+	columns 	ColumnFunction
+	packets 	*PacketColumns
 	wg 			*sync.WaitGroup
-	startIndex 	int
+}
+
+type EntropyResult struct {
+	index 		int
+	entropy 	float64
+}
+
+type ClassifyJob struct {
+	ctx 		context.Context
+	split_idx 	int
+	split 		*Split
+	labels 		[]string
+	matchers 	[]FingerprintFunc
+	first_match bool
+	wg 			*sync.WaitGroup
+}
+
+type ClassifyResult struct {
+	split_idx 	int
+	// Per label, with unclassified last, the packets of the split given the label
+	packets 	[]*Bitmap
+	data 		[]*FingerprintData
+	// Packets with more than one label, by their labels joined with +
+	overlaps 	map[string]int
 }
 
 type AppearanceRatio struct {
@@ -122,17 +191,28 @@ type CountEffectiveFunctionsResult struct {
 }
 
 type HyperparametersResult struct {
-	fgpt		*Fingerprint
-	n_samples 	int 
-	sign_thres 	float64
-	n_signs 	int
-	signs		[]*FunctionResult
-	zmap 		bool
+	fgpts 					[]*Fingerprint
+	compositions 			[]*TCPComposition
+	n_samples 				int 
+	sign_thres 				float64
+	max_sign 				int
+	featext_probability 	float64
+	n_signs 				int
+	signs					[]*FunctionResult
+	zmap 					bool
+	// Functions with an effective sign on a sample at sign_thres
+	effective 				*CountEffectiveFunctionsResult
+	n_fingerprinted 		int
+	duration 				time.Duration
+	// Only set when the dataset is labelled
+	evaluation 				*Evaluation
+	// The run stopped early with this error, its results are those found until then
+	err 					error
 }
 
 type FingerprintData struct{
-	packets 	[]*Packet
-	sources 	map[uint32]int 
+	n_packets 	int
+	sources 	map[netip.Addr]int 
 	n_sources 	int
 	ports 		map[uint16]int
 	n_ports 	int
@@ -4,7 +4,6 @@ import (
 	"sync"
 	"slices"
 	"cmp"
-	"runtime"
 )
 
 type Worker[T, U any] struct {
@@ -19,6 +18,10 @@ func Function_worker(
 ) {
 	// Set up split workers
 	for functionJob := range w.tasks {
+		if functionJob.ctx.Err() != nil {
+			functionJob.wg.Done()
+			continue
+		}
 		// Send split jobs to channel
 		// Pass wg to splitjob to ensure all results are received
 
@@ -36,7 +39,8 @@ func Function_worker(
 		for _, split := range *functionJob.splits {
 			wg.Add(1)
 			tasks <- &SplitJob{
-				function: 	functionJob.function,
+				ctx: 		functionJob.ctx,
+				function: 	functionJob.columns,
 				split: 		split,
 				wg: 		&wg,
 			}
@@ -61,6 +65,11 @@ func Function_worker(
 			}
 			size += splitResult.size
 		}
+		// Counts are incomplete once cancelled
+		if functionJob.ctx.Err() != nil {
+			functionJob.wg.Done()
+			continue
+		}
 		// Compute appearance ratio
 		appearanceRatios := make([]*AppearanceRatio, 0, len(acc_counts))
 		for bin, count := range acc_counts {
@@ -72,29 +81,25 @@ func Function_worker(
 				},
 			)
 		}
-		// Force garbage collector so acc_counts is removed from memory
-		runtime.GC()
 		// Find effective signs
-		// Sort binaries on appearance ratio
+		// Sort binaries on appearance ratio, ties by binary as acc_counts has no order
 		slices.SortFunc(appearanceRatios, func(a, b *AppearanceRatio) int {
-			return -cmp.Compare(a.ratio, b.ratio)
+			return cmp.Or(-cmp.Compare(a.ratio, b.ratio), cmp.Compare(a.binary, b.binary))
 		})
 		// Find effective signs based on appearance ratios
+		ratios := Map[*AppearanceRatio, float64](appearanceRatios, func(a *AppearanceRatio) float64 {
+			return a.ratio
+		})
 		max_idx := -1
 		for i := 0; i < Min(functionJob.max_sign, len(appearanceRatios)); i++ {
-			ef, err := effective_indicator(
-				appearanceRatios[i].ratio,
-				Map[*AppearanceRatio, float64](appearanceRatios, func(a *AppearanceRatio) float64 {
-					return a.ratio
-				}),
-			)
+			ef, err := functionJob.scorer.Score(i, ratios, size)
 			if err == nil && ef > functionJob.sign_thres {
 				max_idx = i
 			}
 		}
 		// Return Signs
 		if max_idx != -1 {
-			for i := 0; i < max_idx; i++ {
+			for i := 0; i <= max_idx; i++ {
 				w.results <- &FunctionResult{
 					sign:	&Sign{
 						f:	functionJob.function,
@@ -112,16 +117,14 @@ func Split_worker(
 	w *Worker[*SplitJob, *SplitResult],
 ) {
 	for splitJob := range w.tasks {
-		size := len(splitJob.split.packets)
+		size := splitJob.split.packets.Len()
 		counts := make(map[int]int)
-		for _, packet := range splitJob.split.packets {
-			binary := splitJob.function(packet)
-			if _, ok := counts[LiftInt(binary)]; ok {
-				counts[LiftInt(binary)] += 1
-			} else {
-				counts[LiftInt(binary)] = 1
+		EvalColumns(splitJob.function, splitJob.split.packets, func(_ int, values []uint64) bool {
+			for _, v := range values {
+				counts[int(v)] += 1
 			}
-		}
+			return splitJob.ctx.Err() == nil
+		})
 
 		w.results <- &SplitResult{
 			counts: counts,
@@ -135,21 +138,28 @@ func FilterPacketsWorker(
 	w *Worker[*FilterPacketsJob, *FilterPacketsResult],
 ) {
 	for filterPacketsJob := range w.tasks {
-		packets := make([]*PacketIndex, 0, 5000)
+		if filterPacketsJob.ctx.Err() != nil {
+			filterPacketsJob.wg.Done()
+			continue
+		}
+		packets := NewBitmap()
 		ports := make(map[uint16]struct{})
-		for i, p := range filterPacketsJob.packets {
-			if LiftInt(filterPacketsJob.f_result.sign.f(p)) == filterPacketsJob.f_result.sign.b {
-				ports[p.DstPort] = struct{}{}
-				packets = append(packets, &PacketIndex{
-					split_idx:	filterPacketsJob.split_idx,
-					packet_idx:	i,
-				})
+		b := uint64(filterPacketsJob.f_result.sign.b)
+		dst_ports := filterPacketsJob.packets.DstPort
+		EvalColumns(filterPacketsJob.columns, filterPacketsJob.packets, func(start int, values []uint64) bool {
+			for i, v := range values {
+				if v == b {
+					ports[dst_ports[start + i]] = struct{}{}
+					packets.Add(uint32(start + i))
+				}
 			}
-		}
+			return filterPacketsJob.ctx.Err() == nil
+		})
 		w.results <- &FilterPacketsResult{
 			idx:		filterPacketsJob.idx,
 			n_ports:	len(ports),
 			f_idx:		filterPacketsJob.f_result.index,
+			split_idx:	filterPacketsJob.split_idx,
 			packets:	packets,
 		}
 		filterPacketsJob.wg.Done()
@@ -157,64 +167,52 @@ func FilterPacketsWorker(
 }
 
 func IntersectionWorker(
-	w *Worker[*IntersectionJob, *Intersection],
+	w *Worker[*IntersectionJob, *IntersectionResult],
 ) {
 	for j := range w.tasks {
-		all_packets := Map[*Intersection, []*PacketIndex](
-			j.xs,
-			func(a *Intersection) []*PacketIndex {
-				return a.packets 
-			},
-		)
-		intersection := intersectAll(all_packets...)
-		has_overlap := false
-		for _, inter := range j.xs {
-			if overlap(j.min_overlap, intersection, inter) {
-				has_overlap = true
-				all_idxs := Map[*Intersection, []int](
-					j.xs,
-					func(a *Intersection) []int {
-						return a.idxs
-					},
-				)
-				idxs := Reduce[[]int, []int](
-					all_idxs,
-					[]int{},
-					appendIdxs,
-				)
-				all_f_idxs := Map[*Intersection, []int](
-					j.xs,
-					func(a *Intersection) []int {
-						return a.f_idxs 
-					},
-				)
-				f_idxs := Reduce[[]int, []int](
-					all_f_idxs,
-					[]int{},
-					appendIdxs,
-				)
-				w.results <- &Intersection{
-					idxs:		idxs,
-					f_idxs:		f_idxs,
-					packets:	intersection,
-					size:		len(intersection),
-				}
-			}
+		intersections, err := consolidateFrom(j.ctx, j.anchor, j.xs, j.min_overlap, j.max_sets)
+		w.results <- &IntersectionResult{
+			anchor:			j.anchor,
+			intersections:	intersections,
+			err:			err,
 		}
+		j.wg.Done()
+	}
+}
 
-		if !has_overlap {
-			for _, inter := range j.xs {
-				w.results <- inter
-			}
+func EntropyWorker(
+	w *Worker[*EntropyJob, *EntropyResult],
+) {
+	for j := range w.tasks {
+		if j.ctx.Err() != nil {
+			j.wg.Done()
+			continue
+		}
+		w.results <- &EntropyResult{
+			index:		j.index,
+			entropy:	column_entropy(j.ctx, j.columns, j.packets),
+		}
+		j.wg.Done()
+	}
+}
+
+func ClassifyWorker(
+	w *Worker[*ClassifyJob, *ClassifyResult],
+) {
+	for j := range w.tasks {
+		if j.ctx.Err() != nil {
+			j.wg.Done()
+			continue
 		}
+		w.results <- classify_split(j.ctx, j.split_idx, j.split, j.labels, j.matchers, j.first_match)
 		j.wg.Done()
 	}
 }
 
 func overlap(
 	min_overlap float64,
-	intersection []*PacketIndex,
+	intersection *PacketSet,
 	x *Intersection,
 ) bool {
-	return float64(len(intersection)) > min_overlap * float64(x.size)
+	return float64(intersection.Len()) > min_overlap * float64(x.size)
 }
\ No newline at end of file